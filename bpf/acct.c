@@ -21,27 +21,152 @@ struct acct_event_t {
   u16 srcport;
   u16 dstport;
   u8 proto;
+  u8 type;
+  u8 tcp_state;
+  u8 family;
+  u32 status;
+  u16 zone;
+  union nf_inet_addr reply_srcaddr;
+  union nf_inet_addr reply_dstaddr;
+  u16 reply_srcport;
+  u16 reply_dstport;
+};
+
+// Type tag set on each acct_event_t, allowing userspace to tell update and
+// destroy events apart when they are delivered through a single ring buffer.
+enum event_type {
+  EventUpdate = 1,
+  EventDestroy = 2,
 };
 
 enum o_config {
   ConfigReady,
+  ConfigCIDRInclude,
+  ConfigNetNSAllow,
+  ConfigProtoAllow,
+  ConfigMarkValue,
+  ConfigMarkMask,
+  ConfigCurveBank,
   ConfigMax,
 };
 
-enum o_config_ratecurve {
-  ConfigCurve0Age,
-  ConfigCurve0Interval,
-  ConfigCurve1Age,
-  ConfigCurve1Interval,
-  ConfigCurve2Age,
-  ConfigCurve2Interval,
-  ConfigCurveMax,
+// Maximum amount of (age, interval) points in the rate curve.
+#define CURVE_MAX 16
+
+// Maximum amount of rate curves, including the default curve in slot 0.
+#define CURVE_SLOTS 8
+
+// Indices of a curve point's age and interval in a curve of config_ratecurve.
+#define CURVE_AGE(i) (2 * (i))
+#define CURVE_INTERVAL(i) (2 * (i) + 1)
+
+// Amount of config_ratecurve entries taken up by a single curve and by a single bank.
+#define CURVE_SLOT_SIZE (2 * CURVE_MAX)
+#define CURVE_BANK_SIZE (CURVE_SLOTS * CURVE_SLOT_SIZE)
+
+// Maximum amount of selectors per bank in curve_select.
+#define CURVE_SELECT_MAX 1024
+
+// Key of the curve_select map. The fields following prefixlen are matched
+// most significant bit first, so the port is stored in network byte order.
+struct curve_key {
+  u32 prefixlen;
+  u8 bank;
+  u8 proto;
+  u16 port;
+};
+
+// Offsets of kernel struct members and values of kernel enums read by the
+// program. When built with ACCT_BTF, these are resolved by userspace from the
+// running kernel's BTF and stored in the `config_offsets` map.
+// Indexed by enum o_offset.
+enum o_offset {
+  OffsetConnStatus,
+  OffsetConnExt,
+  OffsetConnNet,
+  OffsetConnMark,
+  OffsetConnTupleOrig,
+  OffsetTupleSrcAddr,
+  OffsetTupleSrcPort,
+  OffsetTupleDstAddr,
+  OffsetTupleDstPort,
+  OffsetTupleProto,
+  OffsetExtOffset,
+  OffsetExtIDAcct,
+  OffsetExtIDTstamp,
+  OffsetAcctCounter,
+  OffsetTstampStart,
+  OffsetNetInum,
+  OffsetTupleL3Num,
+  OffsetConnTCPState,
+  OffsetConnZone,
+  OffsetConnTupleReply,
+  OffsetMax,
+};
+
+// Reasons for dropping an event in the probe based on the filters configured
+// by userspace. Indexes the `filter_stats` map.
+enum o_filter_stats {
+  FilterStatCIDRInclude,
+  FilterStatCIDRExclude,
+  FilterStatNetNS,
+  FilterStatProto,
+  FilterStatConnmark,
+  FilterStatMax,
+};
+
+// Flow tracking maps failing to store an entry because they are full.
+// Indexes the `flow_stats` map.
+enum o_flow_stats {
+  FlowStatCooldownFull,
+  FlowStatOriginFull,
+  FlowStatMax,
+};
+
+// Values of the entries in the `filter_netns` map.
+enum filter_verdict {
+  FilterAllow = 1,
+  FilterDeny = 2,
+};
+
+// Key of the CIDR filter maps. The address family is part of the prefix,
+// so the first 32 bits of each prefix always need to match exactly.
+struct cidr_key {
+  u32 prefixlen;
+  u32 family;
+  union nf_inet_addr addr;
 };
 
 // Magic value that userspace writes into the ConfigReady location when
 // configuration from userspace has completed.
 const int ready_val = 0x90;
 
+#ifdef ACCT_RINGBUF
+
+// BPF_MAP_TYPE_RINGBUF was introduced in Linux 5.8. Use its literal value
+// so the program can be built against older kernel headers.
+#define ACCT_MAP_TYPE_RINGBUF 27
+
+// Ring buffer to send both update and destroy events to userspace.
+// max_entries is the size of the buffer in bytes and is overridden
+// by userspace at load time.
+struct bpf_map_def SEC("maps/ringbuf_acct") ringbuf_acct = {
+  .type = ACCT_MAP_TYPE_RINGBUF,
+  .max_entries = 1 << 20,
+};
+
+// Per-CPU counters of events that could not be written to the ring buffer,
+// indexed by enum event_type. The ring buffer itself does not keep track
+// of failed writes, so this is the only way for userspace to observe loss.
+struct bpf_map_def SEC("maps/ringbuf_lost") ringbuf_lost = {
+  .type = BPF_MAP_TYPE_PERCPU_ARRAY,
+  .key_size = sizeof(u32),
+  .value_size = sizeof(u64),
+  .max_entries = EventDestroy + 1,
+};
+
+#else
+
 // perf map to send update events to userspace.
 struct bpf_map_def SEC("maps/perf_acct_update") perf_acct_update = {
   .type = BPF_MAP_TYPE_PERF_EVENT_ARRAY,
@@ -52,8 +177,11 @@ struct bpf_map_def SEC("maps/perf_acct_end") perf_acct_end = {
   .type = BPF_MAP_TYPE_PERF_EVENT_ARRAY,
 };
 
+#endif
+
 // Hash that holds a kernel timestamp per flow indicating when
 // the flow may send its next update event to userspace.
+// max_entries is overridden by userspace at load time.
 struct bpf_map_def SEC("maps/flow_cooldown") flow_cooldown = {
   .type = BPF_MAP_TYPE_HASH,
   .key_size = sizeof(u64),
@@ -63,6 +191,7 @@ struct bpf_map_def SEC("maps/flow_cooldown") flow_cooldown = {
 
 // Hash that holds a timestamp per flow indicating when the flow
 // was first seen. Used to implement age-based event rate limiting.
+// max_entries is overridden by userspace at load time.
 struct bpf_map_def SEC("maps/flow_origin") flow_origin = {
   .type = BPF_MAP_TYPE_HASH,
   .key_size = sizeof(struct nf_conn *),
@@ -70,6 +199,40 @@ struct bpf_map_def SEC("maps/flow_origin") flow_origin = {
   .max_entries = 65535,
 };
 
+// Key of the `flow_seed` map, identifying a flow by its original tuple
+// and network namespace.
+struct flow_seed_key {
+  union nf_inet_addr srcaddr;
+  union nf_inet_addr dstaddr;
+  u32 netns;
+  u16 srcport;
+  u16 dstport;
+  u8 proto;
+  u8 family;
+  u16 pad;
+};
+
+// Hash holding the start timestamps of flows that existed before the probe
+// was loaded, written by userspace from a dump of the conntrack table.
+// Used instead of guessing the flow's age when it is first seen.
+// max_entries is overridden by userspace at load time.
+struct bpf_map_def SEC("maps/flow_seed") flow_seed = {
+  .type = BPF_MAP_TYPE_HASH,
+  .key_size = sizeof(struct flow_seed_key),
+  .value_size = sizeof(u64),
+  .max_entries = 65535,
+  .map_flags = BPF_F_NO_PREALLOC,
+};
+
+// Per-CPU counters of failed inserts into the flow tracking maps,
+// indexed by enum o_flow_stats.
+struct bpf_map_def SEC("maps/flow_stats") flow_stats = {
+  .type = BPF_MAP_TYPE_PERCPU_ARRAY,
+  .key_size = sizeof(u32),
+  .value_size = sizeof(u64),
+  .max_entries = FlowStatMax,
+};
+
 // Communication channel between the kprobe and the kretprobe.
 // Holds a pointer to the nf_conn in the hot path (kprobe) and
 // reads + deletes it in the kretprobe.
@@ -89,16 +252,123 @@ struct bpf_map_def SEC("maps/config") config = {
   .max_entries = ConfigMax,
 };
 
-// Array holding pairs of (age, interval) values,
-// used for age-based rate limiting.
-// Indexed by enum o_config_ratecurve.
+// Array holding pairs of (age, interval) values in order of increasing age,
+// used for age-based rate limiting. Indexed by CURVE_AGE and CURVE_INTERVAL.
+// Unused points have a negative age.
+// Holds two banks of CURVE_SLOTS curves, ConfigCurveBank selects the active one.
+// This allows userspace to replace the curves of a running probe without the
+// program ever observing a partially-written curve.
 struct bpf_map_def SEC("maps/config_ratecurve") config_ratecurve = {
   .type = BPF_MAP_TYPE_ARRAY,
-  .key_size = sizeof(enum o_config_ratecurve),
+  .key_size = sizeof(u32),
+  .value_size = sizeof(u64),
+  .max_entries = 2 * CURVE_BANK_SIZE,
+};
+
+// BPF_MAP_TYPE_LPM_TRIE was introduced in Linux 4.11. Use its literal value
+// so the program can be built against older kernel headers. Userspace replaces
+// it with a plain hash map on kernels that don't support it.
+#define ACCT_MAP_TYPE_LPM_TRIE 11
+
+// Prefixes of flows to be sampled. If ConfigCIDRInclude is set, only flows
+// with a source or destination address within one of these prefixes are sampled.
+struct bpf_map_def SEC("maps/filter_cidr_include") filter_cidr_include = {
+  .type = ACCT_MAP_TYPE_LPM_TRIE,
+  .key_size = sizeof(struct cidr_key),
+  .value_size = sizeof(u8),
+  .max_entries = 1024,
+  .map_flags = BPF_F_NO_PREALLOC,
+};
+
+// Prefixes of flows to be ignored. Flows with a source or destination address
+// within one of these prefixes are never sampled.
+struct bpf_map_def SEC("maps/filter_cidr_exclude") filter_cidr_exclude = {
+  .type = ACCT_MAP_TYPE_LPM_TRIE,
+  .key_size = sizeof(struct cidr_key),
+  .value_size = sizeof(u8),
+  .max_entries = 1024,
+  .map_flags = BPF_F_NO_PREALLOC,
+};
+
+// Network namespace inodes to be sampled or ignored, with an enum filter_verdict
+// as the value. If ConfigNetNSAllow is set, only flows in namespaces marked
+// FilterAllow are sampled. Flows in namespaces marked FilterDeny are never sampled.
+struct bpf_map_def SEC("maps/filter_netns") filter_netns = {
+  .type = BPF_MAP_TYPE_HASH,
+  .key_size = sizeof(u32),
+  .value_size = sizeof(u8),
+  .max_entries = 1024,
+};
+
+// Layer 4 protocols to be sampled if ConfigProtoAllow is set, indexed by
+// protocol number. Flows with protocols set to zero are ignored.
+struct bpf_map_def SEC("maps/filter_proto") filter_proto = {
+  .type = BPF_MAP_TYPE_ARRAY,
+  .key_size = sizeof(u32),
+  .value_size = sizeof(u8),
+  .max_entries = 256,
+};
+
+// Selects the rate curve of a flow by its protocol and destination port.
+// Holds the index of a curve slot in config_ratecurve. Entries of both banks
+// are present while userspace switches banks. Flows not matching any entry
+// use the default curve in slot 0.
+struct bpf_map_def SEC("maps/curve_select") curve_select = {
+  .type = ACCT_MAP_TYPE_LPM_TRIE,
+  .key_size = sizeof(struct curve_key),
+  .value_size = sizeof(u32),
+  .max_entries = 2 * CURVE_SELECT_MAX,
+  .map_flags = BPF_F_NO_PREALLOC,
+};
+
+// Per-CPU counters of flows ignored by the probe's filters,
+// indexed by enum o_filter_stats.
+struct bpf_map_def SEC("maps/filter_stats") filter_stats = {
+  .type = BPF_MAP_TYPE_PERCPU_ARRAY,
+  .key_size = sizeof(u32),
+  .value_size = sizeof(u64),
+  .max_entries = FilterStatMax,
+};
+
+#ifdef ACCT_BTF
+
+// Array holding offsets of kernel struct members and kernel enum values,
+// resolved by userspace from the running kernel's BTF at load time.
+// Indexed by enum o_offset.
+struct bpf_map_def SEC("maps/config_offsets") config_offsets = {
+  .type = BPF_MAP_TYPE_ARRAY,
+  .key_size = sizeof(enum o_offset),
   .value_size = sizeof(u64),
-  .max_entries = ConfigCurveMax,
+  .max_entries = OffsetMax,
 };
 
+// offset_get returns an entry from the offsets array.
+// Returns 0 if an entry was not found at the requested index.
+static __always_inline u64 offset_get(enum o_offset offset_enum) {
+
+  u32 offset = offset_enum;
+  u64 *offp = bpf_map_lookup_elem(&config_offsets, &offset);
+  if (offp)
+    return *offp;
+
+  return 0;
+}
+
+// Value of optional offsets that are not present in the running kernel.
+#define OFFSET_NONE ((u64)-1)
+
+// Use the offset resolved at load time.
+#define OFFSET(o, expr) offset_get(o)
+#define OFFSET_VALID(o) (offset_get(o) != OFFSET_NONE)
+
+#else
+
+// Use the offset resolved at build time from the kernel headers.
+#define OFFSET(o, expr) (expr)
+#define OFFSET_VALID(o) (1)
+
+#endif
+
 // probe_ready reads the `config` array map for the Ready flag.
 // It returns true if the Ready flag is set to 0x90 (go).
 static __always_inline bool probe_ready() {
@@ -109,6 +379,18 @@ static __always_inline bool probe_ready() {
   return (rp && *rp == ready_val);
 }
 
+// config_get returns an entry from the `config` array map.
+// Returns 0 if an entry was not found at the requested index.
+static __always_inline u64 config_get(enum o_config config_enum) {
+
+  u32 offset = config_enum;
+  u64 *confp = bpf_map_lookup_elem(&config, &offset);
+  if (confp)
+    return *confp;
+
+  return 0;
+}
+
 // get_acct_ext gets a reference to the nf_conn's accounting extension.
 // Returns non-zero on error.
 static __always_inline int get_acct_ext(struct nf_conn_acct **acct_ext, struct nf_conn *ct) {
@@ -118,12 +400,13 @@ static __always_inline int get_acct_ext(struct nf_conn_acct **acct_ext, struct n
   // is called for unix socket usage as well. Also, the acct
   // extension memory is uninitialized if the acct sysctl is disabled.
   struct nf_ct_ext *ct_ext;
-  bpf_probe_read(&ct_ext, sizeof(ct_ext), &ct->ext);
+  bpf_probe_read(&ct_ext, sizeof(ct_ext), (void *)ct + OFFSET(OffsetConnExt, offsetof(struct nf_conn, ext)));
   if (!ct_ext)
     return -1;
 
   u8 ct_acct_offset;
-  bpf_probe_read(&ct_acct_offset, sizeof(ct_acct_offset), &ct_ext->offset[NF_CT_EXT_ACCT]);
+  bpf_probe_read(&ct_acct_offset, sizeof(ct_acct_offset), (void *)ct_ext +
+    OFFSET(OffsetExtOffset, offsetof(struct nf_ct_ext, offset)) + OFFSET(OffsetExtIDAcct, NF_CT_EXT_ACCT));
   if (!ct_acct_offset)
     return -1;
 
@@ -140,12 +423,13 @@ static __always_inline int get_acct_ext(struct nf_conn_acct **acct_ext, struct n
 static __always_inline int get_ts_ext(struct nf_conn_tstamp **ts_ext, struct nf_conn *ct) {
 
   struct nf_ct_ext *ct_ext;
-  bpf_probe_read(&ct_ext, sizeof(ct_ext), &ct->ext);
+  bpf_probe_read(&ct_ext, sizeof(ct_ext), (void *)ct + OFFSET(OffsetConnExt, offsetof(struct nf_conn, ext)));
   if (!ct_ext)
     return -1;
 
   u8 ct_ts_offset;
-  bpf_probe_read(&ct_ts_offset, sizeof(ct_ts_offset), &ct_ext->offset[NF_CT_EXT_TSTAMP]);
+  bpf_probe_read(&ct_ts_offset, sizeof(ct_ts_offset), (void *)ct_ext +
+    OFFSET(OffsetExtOffset, offsetof(struct nf_ct_ext, offset)) + OFFSET(OffsetExtIDTstamp, NF_CT_EXT_TSTAMP));
   if (!ct_ts_offset)
     return -1;
 
@@ -163,7 +447,7 @@ static __always_inline int get_ts_ext(struct nf_conn_tstamp **ts_ext, struct nf_
 // ignored until this field is set.
 static __always_inline u32 flow_status(struct nf_conn *ct) {
   u32 status;
-  bpf_probe_read(&status, sizeof(status), &ct->status);
+  bpf_probe_read(&status, sizeof(status), (void *)ct + OFFSET(OffsetConnStatus, offsetof(struct nf_conn, status)));
   return status;
 }
 
@@ -176,7 +460,7 @@ static __always_inline int extract_counters(struct acct_event_t *data, struct nf
     return -1;
 
   struct nf_conn_counter ctr[IP_CT_DIR_MAX];
-  bpf_probe_read(&ctr, sizeof(ctr), &acct_ext->counter);
+  bpf_probe_read(&ctr, sizeof(ctr), (void *)acct_ext + OFFSET(OffsetAcctCounter, offsetof(struct nf_conn_acct, counter)));
 
   data->packets_orig = ctr[IP_CT_DIR_ORIGINAL].packets.counter;
   data->bytes_orig = ctr[IP_CT_DIR_ORIGINAL].bytes.counter;
@@ -195,48 +479,165 @@ static __always_inline int extract_tstamp(struct acct_event_t *data, struct nf_c
   if (get_ts_ext(&ts_ext, ct))
     return -1;
 
-  bpf_probe_read(&data->start, sizeof(data->start), &ts_ext->start);
+  bpf_probe_read(&data->start, sizeof(data->start),
+    (void *)ts_ext + OFFSET(OffsetTstampStart, offsetof(struct nf_conn_tstamp, start)));
 
   return 0;
 }
 
-// extract_tuple extracts tuple information (proto, src/dest ip and port) of an nf_conn
-// into an acct_event_t.
+// extract_tuple extracts tuple information (address family, proto, src/dest ip and port)
+// of an nf_conn into an acct_event_t.
 static __always_inline void extract_tuple(struct acct_event_t *data, struct nf_conn *ct) {
 
-  struct nf_conntrack_tuple_hash tuplehash[IP_CT_DIR_MAX];
-  bpf_probe_read(&tuplehash, sizeof(tuplehash), &ct->tuplehash);
+  void *tuple = (void *)ct +
+    OFFSET(OffsetConnTupleOrig, offsetof(struct nf_conn, tuplehash[IP_CT_DIR_ORIGINAL].tuple));
 
-  data->proto = tuplehash[IP_CT_DIR_ORIGINAL].tuple.dst.protonum;
+  // The address family (AF_INET or AF_INET6) determines how many bytes
+  // of the nf_inet_addr unions are meaningful.
+  u16 l3num = 0;
+  bpf_probe_read(&l3num, sizeof(l3num),
+    tuple + OFFSET(OffsetTupleL3Num, offsetof(struct nf_conntrack_tuple, src.l3num)));
+  data->family = l3num;
 
-  data->srcaddr = tuplehash[IP_CT_DIR_ORIGINAL].tuple.src.u3;
-  data->dstaddr = tuplehash[IP_CT_DIR_ORIGINAL].tuple.dst.u3;
+  bpf_probe_read(&data->proto, sizeof(data->proto),
+    tuple + OFFSET(OffsetTupleProto, offsetof(struct nf_conntrack_tuple, dst.protonum)));
 
-  data->srcport = tuplehash[IP_CT_DIR_ORIGINAL].tuple.src.u.all;
-  data->dstport = tuplehash[IP_CT_DIR_ORIGINAL].tuple.dst.u.all;
+  bpf_probe_read(&data->srcaddr, sizeof(data->srcaddr),
+    tuple + OFFSET(OffsetTupleSrcAddr, offsetof(struct nf_conntrack_tuple, src.u3)));
+  bpf_probe_read(&data->dstaddr, sizeof(data->dstaddr),
+    tuple + OFFSET(OffsetTupleDstAddr, offsetof(struct nf_conntrack_tuple, dst.u3)));
+
+  bpf_probe_read(&data->srcport, sizeof(data->srcport),
+    tuple + OFFSET(OffsetTupleSrcPort, offsetof(struct nf_conntrack_tuple, src.u.all)));
+  bpf_probe_read(&data->dstport, sizeof(data->dstport),
+    tuple + OFFSET(OffsetTupleDstPort, offsetof(struct nf_conntrack_tuple, dst.u.all)));
 }
 
-// extract_netns extracts the nf_conn's network namespace inode number into an acct_event_t.
-static __always_inline void extract_netns(struct acct_event_t *data, struct nf_conn *ct) {
+// extract_reply_tuple extracts the addresses and ports of the reply direction
+// of an nf_conn into an acct_event_t. They differ from the original direction
+// when source or destination NAT was applied to the flow.
+static __always_inline void extract_reply_tuple(struct acct_event_t *data, struct nf_conn *ct) {
+
+  void *tuple = (void *)ct +
+    OFFSET(OffsetConnTupleReply, offsetof(struct nf_conn, tuplehash[IP_CT_DIR_REPLY].tuple));
+
+  bpf_probe_read(&data->reply_srcaddr, sizeof(data->reply_srcaddr),
+    tuple + OFFSET(OffsetTupleSrcAddr, offsetof(struct nf_conntrack_tuple, src.u3)));
+  bpf_probe_read(&data->reply_dstaddr, sizeof(data->reply_dstaddr),
+    tuple + OFFSET(OffsetTupleDstAddr, offsetof(struct nf_conntrack_tuple, dst.u3)));
+
+  bpf_probe_read(&data->reply_srcport, sizeof(data->reply_srcport),
+    tuple + OFFSET(OffsetTupleSrcPort, offsetof(struct nf_conntrack_tuple, src.u.all)));
+  bpf_probe_read(&data->reply_dstport, sizeof(data->reply_dstport),
+    tuple + OFFSET(OffsetTupleDstPort, offsetof(struct nf_conntrack_tuple, dst.u.all)));
+}
+
+// flow_proto returns the layer 4 protocol number of an nf_conn.
+static __always_inline u8 flow_proto(struct nf_conn *ct) {
+  u8 proto = 0;
+  bpf_probe_read(&proto, sizeof(proto), (void *)ct +
+    OFFSET(OffsetConnTupleOrig, offsetof(struct nf_conn, tuplehash[IP_CT_DIR_ORIGINAL].tuple)) +
+    OFFSET(OffsetTupleProto, offsetof(struct nf_conntrack_tuple, dst.protonum)));
+  return proto;
+}
+
+// flow_netns returns the inode number of the nf_conn's network namespace.
+// Returns zero if the namespace could not be read.
+static __always_inline u32 flow_netns(struct nf_conn *ct) {
 
   // Obtain reference to network namespace.
   // Warning: ct_net is a possible_net_t with a single member,
   // so we read `struct net` instead at the same location. Reading
   // the `*net` in `possible_net_t` will yield a (non-zero) garbage value.
   struct net *net;
-  bpf_probe_read(&net, sizeof(net), &ct->ct_net);
+  bpf_probe_read(&net, sizeof(net), (void *)ct + OFFSET(OffsetConnNet, offsetof(struct nf_conn, ct_net)));
 
+  u32 inum = 0;
   if (net) {
-    // netns field will remain zero if probe read fails.
-    bpf_probe_read(&data->netns, sizeof(data->netns), &net->ns.inum);
+    bpf_probe_read(&inum, sizeof(inum), (void *)net + OFFSET(OffsetNetInum, offsetof(struct net, ns.inum)));
   }
+
+  return inum;
+}
+
+// flow_connmark returns the nf_conn's connection mark.
+static __always_inline u32 flow_connmark(struct nf_conn *ct) {
+  u32 mark = 0;
+  bpf_probe_read(&mark, sizeof(mark), (void *)ct + OFFSET(OffsetConnMark, offsetof(struct nf_conn, mark)));
+  return mark;
+}
+
+// flow_tcp_state returns the TCP conntrack state (enum tcp_conntrack) of an nf_conn.
+// Must only be called for TCP flows.
+static __always_inline u8 flow_tcp_state(struct nf_conn *ct) {
+  u8 state = 0;
+  bpf_probe_read(&state, sizeof(state), (void *)ct + OFFSET(OffsetConnTCPState, offsetof(struct nf_conn, proto.tcp.state)));
+  return state;
+}
+
+// flow_zone returns the nf_conn's conntrack zone ID. Returns zero if the
+// running kernel was built without support for conntrack zones.
+static __always_inline u16 flow_zone(struct nf_conn *ct) {
+  u16 zone = 0;
+#ifdef CONFIG_NF_CONNTRACK_ZONES
+  if (!OFFSET_VALID(OffsetConnZone))
+    return 0;
+  bpf_probe_read(&zone, sizeof(zone), (void *)ct + OFFSET(OffsetConnZone, offsetof(struct nf_conn, zone.id)));
+#endif
+  return zone;
+}
+
+// extract_state extracts the nf_conn's status bits, TCP state and conntrack zone
+// into an acct_event_t. The protocol needs to be extracted into data beforehand.
+static __always_inline void extract_state(struct acct_event_t *data, struct nf_conn *ct) {
+  data->status = flow_status(ct);
+  data->zone = flow_zone(ct);
+  if (data->proto == IPPROTO_TCP)
+    data->tcp_state = flow_tcp_state(ct);
+}
+
+// extract_netns extracts the nf_conn's network namespace inode number into an acct_event_t.
+static __always_inline void extract_netns(struct acct_event_t *data, struct nf_conn *ct) {
+  // netns field will remain zero if probe read fails.
+  data->netns = flow_netns(ct);
+}
+
+// extract_connmark extracts the nf_conn's connection mark into an acct_event_t.
+static __always_inline void extract_connmark(struct acct_event_t *data, struct nf_conn *ct) {
+  data->connmark = flow_connmark(ct);
+}
+
+// curve_bank returns the index of the active bank in the curve array.
+static __always_inline u32 curve_bank() {
+  return config_get(ConfigCurveBank) ? 1 : 0;
+}
+
+// curve_select_offset returns the offset in the curve array of the rate curve
+// selected for the flow's protocol and destination port in the active bank.
+// Flows not matched by any selector use the default curve in slot 0.
+static __always_inline u32 curve_select_offset(struct acct_event_t *data) {
+
+  u32 bank = curve_bank();
+
+  struct curve_key key = {
+    .prefixlen = 32,
+    .bank = bank,
+    .proto = data->proto,
+    .port = data->dstport,
+  };
+
+  u32 slot = 0;
+  u32 *slotp = bpf_map_lookup_elem(&curve_select, &key);
+  if (slotp && *slotp < CURVE_SLOTS)
+    slot = *slotp;
+
+  return bank * CURVE_BANK_SIZE + slot * CURVE_SLOT_SIZE;
 }
 
 // curve_get returns an entry from the curve array as a signed 64-bit integer.
 // Returns negative if an entry was not found at the requested index.
-static __always_inline s64 curve_get(enum o_config_ratecurve curve_enum) {
+static __always_inline s64 curve_get(u32 offset) {
 
-  int offset = curve_enum;
   u64 *confp = bpf_map_lookup_elem(&config_ratecurve, &offset);
   if (confp)
     return *confp;
@@ -244,6 +645,103 @@ static __always_inline s64 curve_get(enum o_config_ratecurve curve_enum) {
   return -1;
 }
 
+// cidr_match returns true if addr is contained in one of the prefixes
+// stored in the given CIDR filter map.
+static __always_inline bool cidr_match(void *map, u16 family, union nf_inet_addr *addr) {
+
+  struct cidr_key key = {
+    .prefixlen = 32 + (family == AF_INET ? 32 : 128),
+    .family = family,
+  };
+  __builtin_memcpy(&key.addr, addr, sizeof(key.addr));
+
+  return bpf_map_lookup_elem(map, &key) != 0;
+}
+
+// filter_stats_incr increments the counter of the given filter.
+static __always_inline void filter_stats_incr(enum o_filter_stats stat) {
+
+  u32 key = stat;
+  u64 *ctr = bpf_map_lookup_elem(&filter_stats, &key);
+  if (ctr)
+    *ctr += 1;
+}
+
+// flow_stats_incr increments the given flow map counter.
+static __always_inline void flow_stats_incr(enum o_flow_stats stat) {
+
+  u32 key = stat;
+  u64 *ctr = bpf_map_lookup_elem(&flow_stats, &key);
+  if (ctr)
+    *ctr += 1;
+}
+
+// flow_filtered_meta returns true if the flow is to be ignored according to the
+// network namespace, protocol and connmark filters configured by userspace.
+// Reads the nf_conn directly, so can be called before building an event.
+// When count is set, the filter that caused the flow to be ignored is counted
+// in the `filter_stats` map. This should only happen once for each flow.
+static __always_inline bool flow_filtered_meta(struct nf_conn *ct, bool count) {
+
+  u32 netns = flow_netns(ct);
+  u8 *verdict = bpf_map_lookup_elem(&filter_netns, &netns);
+
+  if ((verdict && *verdict == FilterDeny) ||
+      (config_get(ConfigNetNSAllow) && !(verdict && *verdict == FilterAllow))) {
+    if (count)
+      filter_stats_incr(FilterStatNetNS);
+    return true;
+  }
+
+  if (config_get(ConfigProtoAllow)) {
+    u32 proto = flow_proto(ct);
+    u8 *allowed = bpf_map_lookup_elem(&filter_proto, &proto);
+    if (!allowed || !*allowed) {
+      if (count)
+        filter_stats_incr(FilterStatProto);
+      return true;
+    }
+  }
+
+  // A zero mask disables the connmark filter.
+  u64 mask = config_get(ConfigMarkMask);
+  if (mask && (flow_connmark(ct) & mask) != config_get(ConfigMarkValue)) {
+    if (count)
+      filter_stats_incr(FilterStatConnmark);
+    return true;
+  }
+
+  return false;
+}
+
+// flow_filtered_addr returns true if the flow is to be ignored according to the
+// CIDR filters configured by userspace. Expects the event's tuple to be extracted.
+// When count is set, the filter that caused the flow to be ignored is counted
+// in the `filter_stats` map. This should only happen once for each flow.
+static __always_inline bool flow_filtered_addr(struct acct_event_t *data, struct nf_conn *ct, bool count) {
+
+  u16 family = data->family;
+
+  // When include prefixes are configured, either the flow's source
+  // or destination address need to match one of them.
+  if (config_get(ConfigCIDRInclude) &&
+      !cidr_match(&filter_cidr_include, family, &data->srcaddr) &&
+      !cidr_match(&filter_cidr_include, family, &data->dstaddr)) {
+    if (count)
+      filter_stats_incr(FilterStatCIDRInclude);
+    return true;
+  }
+
+  if (cidr_match(&filter_cidr_exclude, family, &data->srcaddr) ||
+      cidr_match(&filter_cidr_exclude, family, &data->dstaddr)) {
+    if (count)
+      filter_stats_incr(FilterStatCIDRExclude);
+    return true;
+  }
+
+  return false;
+}
+
 // flow_cooldown_expired returns true if the flow's cooldown period is over.
 static __always_inline bool flow_cooldown_expired(struct nf_conn *ct, u64 ts) {
 
@@ -258,12 +756,44 @@ static __always_inline bool flow_cooldown_expired(struct nf_conn *ct, u64 ts) {
   return (ts >= next);
 }
 
+// flow_seed_origin looks up the start timestamp of a flow that existed
+// before the probe was loaded, as seeded by userspace. Returns 0 if the flow
+// was not seeded. Seeds are removed after they are used.
+static __always_inline u64 flow_seed_origin(struct acct_event_t *data, struct nf_conn *ct) {
+
+  struct flow_seed_key key = {
+    .netns = flow_netns(ct),
+    .srcport = data->srcport,
+    .dstport = data->dstport,
+    .proto = data->proto,
+    .family = data->family,
+  };
+  __builtin_memcpy(&key.srcaddr, &data->srcaddr, sizeof(key.srcaddr));
+  __builtin_memcpy(&key.dstaddr, &data->dstaddr, sizeof(key.dstaddr));
+
+  u64 *seedp = bpf_map_lookup_elem(&flow_seed, &key);
+  if (!seedp)
+    return 0;
+
+  u64 seed = *seedp;
+  bpf_map_delete_elem(&flow_seed, &key);
+
+  return seed;
+}
+
 // flow_initialize_origin sets the first-seen timestamp of the nf_conn
-// to ts. If pkts_total is larger than one, the flow is considered as old as
-// the second age threshold (curve1age), to protect against event storms
-// when the program is restarted.
+// to ts. If pkts_total is larger than one, the flow existed before the
+// probe was loaded. Its start timestamp is taken from the seeds written
+// by userspace if possible. Otherwise, it is considered as old as the
+// second point's age of the flow's rate curve, to protect against
+// event storms when the program is restarted.
 // This call is write-once due to BPF_NOEXIST.
-static __always_inline u64 flow_initialize_origin(struct nf_conn *ct, u64 ts, u64 pkts_total) {
+static __always_inline u64 flow_initialize_origin(struct nf_conn *ct, struct acct_event_t *data, u64 ts, u64 pkts_total, u32 curve) {
+
+  // Return early if the flow already has an origin.
+  u64 *originp = bpf_map_lookup_elem(&flow_origin, &ct);
+  if (originp)
+    return *originp;
 
   u64 origin = ts;
 
@@ -271,7 +801,14 @@ static __always_inline u64 flow_initialize_origin(struct nf_conn *ct, u64 ts, u6
   if (pkts_total < 2)
     goto update;
 
-  s64 curve1_age = curve_get(ConfigCurve1Age);
+  // Use the flow's real start timestamp if it was seeded.
+  u64 seed = flow_seed_origin(data, ct);
+  if (seed > 0 && seed <= ts) {
+    origin = seed;
+    goto update;
+  }
+
+  s64 curve1_age = curve_get(curve + CURVE_AGE(1));
   if (curve1_age < 0)
     goto update;
 
@@ -284,7 +821,9 @@ static __always_inline u64 flow_initialize_origin(struct nf_conn *ct, u64 ts, u6
   }
 
 update:
-  bpf_map_update_elem(&flow_origin, &ct, &origin, BPF_NOEXIST);
+  // Hash maps return E2BIG when they are full.
+  if (bpf_map_update_elem(&flow_origin, &ct, &origin, BPF_NOEXIST) == -E2BIG)
+    flow_stats_incr(FlowStatOriginFull);
 
   return origin;
 }
@@ -307,54 +846,73 @@ static __always_inline u64 flow_get_age(struct nf_conn *ct, u64 ts) {
 }
 
 // flow_get_interval returns the interval (cooldown period) to be set
-// for the flow during the current event.
+// for the flow during the current event, using the rate curve at the
+// given offset in the curve array.
 // Returns negative if the flow is younger than the minimum age threshold,
 // or if an internal curve lookup error occurred.
-static __always_inline s64 flow_get_interval(struct nf_conn *ct, u64 ts) {
+static __always_inline s64 flow_get_interval(struct nf_conn *ct, u64 ts, u32 curve) {
 
   // Always returns a positive or 0 value.
   u64 age = flow_get_age(ct, ts);
 
   // Don't consider flows that are under a minimum age.
   // Return negative interval to signal that the event should be dropped.
-  s64 curve0_age = curve_get(ConfigCurve0Age);
-  if (curve0_age < 0) return -1;
-  if (age < curve0_age)
-    return -1;
+  s64 interval = -1;
 
-  // Between age 0 and age 1, use interval 0.
-  s64 curve1_age = curve_get(ConfigCurve1Age);
-  if (curve1_age < 0) return -1;
-  if (age < curve1_age)
-    return curve_get(ConfigCurve0Interval);
+  // Use the interval of the last curve point the flow has reached.
+  // The loop is unrolled for kernels without support for bounded loops.
+#pragma unroll
+  for (u32 i = 0; i < CURVE_MAX; i++) {
+    s64 point_age = curve_get(curve + CURVE_AGE(i));
 
-  // Between age 1 and age 2, use interval 1.
-  s64 curve2_age = curve_get(ConfigCurve2Age);
-  if (curve2_age < 0) return -1;
-  if (age < curve2_age)
-    return curve_get(ConfigCurve1Interval);
+    // Stop at the first unused point or the first point the flow hasn't reached.
+    if (point_age < 0 || age < point_age)
+      break;
 
-  // Beyond age 2, use interval 2.
-  return curve_get(ConfigCurve2Interval);
+    interval = curve_get(curve + CURVE_INTERVAL(i));
+  }
+
+  return interval;
 }
 
-static __always_inline u64 flow_set_cooldown(struct nf_conn *ct, u64 ts) {
+static __always_inline s64 flow_set_cooldown(struct nf_conn *ct, u64 ts, u32 curve) {
 
   // Get the update interval for this flow.
   // A negative result indicates that the event should be dropped
   // due to the flow being too young or a failing rate curve lookup.
-  s64 interval = flow_get_interval(ct, ts);
+  s64 interval = flow_get_interval(ct, ts, curve);
   if (interval < 0)
-    return 0;
+    return interval;
 
   // Set the cooldown expiration time to the current timestamp plus
   // the cooldown period.
   u64 next = ts + interval;
-  bpf_map_update_elem(&flow_cooldown, &ct, &next, BPF_ANY);
+  if (bpf_map_update_elem(&flow_cooldown, &ct, &next, BPF_ANY) == -E2BIG)
+    flow_stats_incr(FlowStatCooldownFull);
 
   return interval;
 }
 
+// submit_event sends an event to userspace. When built with ACCT_RINGBUF,
+// all events are written to the same ring buffer and are told apart by their
+// type tag. Otherwise, events are written to the perf array matching their type.
+static __always_inline void submit_event(struct acct_event_t *data, struct pt_regs *ctx) {
+
+#ifdef ACCT_RINGBUF
+  if (bpf_ringbuf_output(&ringbuf_acct, data, sizeof(*data), 0)) {
+    u32 key = data->type;
+    u64 *lost = bpf_map_lookup_elem(&ringbuf_lost, &key);
+    if (lost)
+      *lost += 1;
+  }
+#else
+  if (data->type == EventDestroy)
+    bpf_perf_event_output(ctx, &perf_acct_end, BPF_F_CURRENT_CPU, data, sizeof(*data));
+  else
+    bpf_perf_event_output(ctx, &perf_acct_update, BPF_F_CURRENT_CPU, data, sizeof(*data));
+#endif
+}
+
 // flow_cleanup removes all possible map entries related to the connection.
 static __always_inline void flow_cleanup(struct nf_conn *ct) {
   bpf_map_delete_elem(&flow_cooldown, &ct);
@@ -362,17 +920,24 @@ static __always_inline void flow_cleanup(struct nf_conn *ct) {
 }
 
 // flow_sample_update samples an update event for an nf_conn.
-static __always_inline u64 flow_sample_update(struct nf_conn *ct, u64 ts, struct pt_regs *ctx) {
+// new is set when the flow is sampled for the first time, when it is
+// inserted into the conntrack table.
+static __always_inline u64 flow_sample_update(struct nf_conn *ct, u64 ts, struct pt_regs *ctx, bool new) {
 
   // Ignore flows with a zero status field.
   if (flow_status(ct) == 0)
     return 0;
 
+  // Drop the event if the flow is ignored by the configured filters.
+  if (flow_filtered_meta(ct, new))
+    return 0;
+
   // Allocate event struct after all checks have succeeded.
   struct acct_event_t data = {
     .start = 0,
     .ts = ts,
     .cptr = (u64)ct,
+    .type = EventUpdate,
   };
 
   // Pull counters onto the BPF stack first, so that we can make event rate
@@ -386,34 +951,49 @@ static __always_inline u64 flow_sample_update(struct nf_conn *ct, u64 ts, struct
 // period during which it cannot send more events. The length of this period
 // depends on the age of the flow. The older the flow, the longer the period,
 // and the lower the update frequency. The age thresholds and update intervals
-// can be configured through the 'config_ratecurve' map.
+// can be configured through the 'config_ratecurve' map, and are selected
+// for each flow by its protocol and destination port using 'curve_select'.
   u64 pkts_total = (data.packets_orig + data.packets_ret);
   if (pkts_total > 1 && !flow_cooldown_expired(ct, ts))
     return 0;
 
+  // Extract proto, src/dst address and ports.
+  extract_tuple(&data, ct);
+
+  // Drop the event if the flow's addresses are ignored by the configured filters.
+  // Ignored flows never get a cooldown or origin timestamp.
+  if (flow_filtered_addr(&data, ct, new))
+    return 0;
+
+  // Select the flow's rate curve by its protocol and destination port.
+  // The bank is read once, so all curve points come from the same bank.
+  u32 curve = curve_select_offset(&data);
+
   // Store a reference timestamp ('origin') to allow future event cycles to
   // determine the age of the flow. This is write-once and will only store
   // a value on the first call of each flow.
-  flow_initialize_origin(ct, ts, pkts_total);
+  flow_initialize_origin(ct, &data, ts, pkts_total, curve);
 
   // Set the cooldown expiration to the current timestamp plus a cooldown period
   // based on the age of the flow. flow_set_cooldown returns negative if
   // the event should be dropped due to the flow being too young or
   // because of an internal curve lookup error.
-  if (flow_set_cooldown(ct, ts) < 0)
+  if (flow_set_cooldown(ct, ts, curve) < 0)
     return 0;
 
-  // Extract proto, src/dst address and ports.
-  extract_tuple(&data, ct);
   // Extract network namespace identifier (inode).
   extract_netns(&data, ct);
   // Extract the start timestamp of a flow.
   extract_tstamp(&data, ct);
   // Extract conntrack connection mark.
-  bpf_probe_read(&data.connmark, sizeof(data.connmark), &ct->mark);
+  extract_connmark(&data, ct);
+  // Extract status bits, TCP state and zone.
+  extract_state(&data, ct);
+  // Extract reply-direction addresses and ports (NAT translations).
+  extract_reply_tuple(&data, ct);
 
   // Submit event to userspace.
-  bpf_perf_event_output(ctx, &perf_acct_update, BPF_F_CURRENT_CPU, &data, sizeof(data));
+  submit_event(&data, ctx);
 
   return 0;
 }
@@ -425,10 +1005,15 @@ static __always_inline u64 flow_sample_destroy(struct nf_conn *ct, u64 ts, struc
   if (flow_status(ct) == 0)
     return 0;
 
+  // Filtered flows were already counted when they were inserted.
+  if (flow_filtered_meta(ct, false))
+    return 0;
+
   struct acct_event_t data = {
     .start = 0,
     .ts = ts,
     .cptr = (u64)ct,
+    .type = EventDestroy,
   };
 
   // Ignore the event if the nf_conn doesn't contain counters.
@@ -436,11 +1021,17 @@ static __always_inline u64 flow_sample_destroy(struct nf_conn *ct, u64 ts, struc
     return 0;
 
   extract_tuple(&data, ct);
+
+  if (flow_filtered_addr(&data, ct, false))
+    return 0;
+
   extract_netns(&data, ct);
   extract_tstamp(&data, ct);
-  bpf_probe_read(&data.connmark, sizeof(data.connmark), &ct->mark);
+  extract_connmark(&data, ct);
+  extract_state(&data, ct);
+  extract_reply_tuple(&data, ct);
 
-  bpf_perf_event_output(ctx, &perf_acct_end, BPF_F_CURRENT_CPU, &data, sizeof(data));
+  submit_event(&data, ctx);
 
   return 0;
 }
@@ -465,7 +1056,7 @@ int kprobe____nf_conntrack_hash_insert(struct pt_regs *ctx) {
 
   struct nf_conn *ct = (struct nf_conn *) PT_REGS_PARM1(ctx);
 
-  return flow_sample_update(ct, ts, ctx);
+  return flow_sample_update(ct, ts, ctx, true);
 }
 
 // Top half of the update sampler. Stash the nf_conn pointer to later process
@@ -506,7 +1097,7 @@ int kretprobe____nf_ct_refresh_acct(struct pt_regs *ctx) {
   struct nf_conn *ct = *ctp;
   bpf_map_delete_elem(&currct, &pid);
 
-  return flow_sample_update(ct, ts, ctx);
+  return flow_sample_update(ct, ts, ctx, false);
 }
 
 // Sample destroy events. This probe sends destroy events to userspace as well
@@ -59,6 +59,14 @@ static int (*bpf_skb_set_tunnel_key)(void *ctx, void *key, int size, int flags)
 static unsigned long long (*bpf_get_prandom_u32)(void) =
 	(void *) BPF_FUNC_get_prandom_u32;
 
+/* BPF_FUNC_ringbuf_output was introduced in Linux 5.8. Use its literal helper
+ * ID so programs using it can be built against older kernel headers.
+ */
+static int (*bpf_ringbuf_output)(void *ringbuf, void *data,
+				 unsigned long long size,
+				 unsigned long long flags) =
+	(void *) 130;
+
 /* a helper structure used by eBPF C program
  * to describe map attributes to elf_bpf loader
  */
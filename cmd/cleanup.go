@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// cleanupCmd represents the cleanup command.
+var cleanupCmd = &cobra.Command{
+	Use:   "cleanup",
+	Short: "Remove kprobes left behind by conntracct instances that did not shut down cleanly.",
+	Long: `Removes kprobes created in tracefs by conntracct processes that are no longer running,
+eg. after being killed by SIGKILL. Kprobes of running instances are left untouched.
+This is only needed on kernels without a kprobe PMU (before 4.17), and is also done
+automatically when starting the probe.`,
+	RunE:         cleanup,
+	SilenceUsage: true, // Don't show usage when RunE returns error.
+}
+
+func init() {
+	rootCmd.AddCommand(cleanupCmd)
+}
+
+func cleanup(cmd *cobra.Command, args []string) error {
+
+	removed, err := bpf.CleanupKprobes()
+	if err != nil {
+		return errors.Wrap(err, "cleaning up kprobes")
+	}
+
+	for _, g := range removed {
+		log.Infof("Removed orphaned kprobe group %s", g)
+	}
+
+	log.Infof("Removed %d orphaned kprobe group(s)", len(removed))
+
+	return nil
+}
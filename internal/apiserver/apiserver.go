@@ -44,6 +44,8 @@ func Run(addr string) error {
 	r := mux.NewRouter()
 
 	r.HandleFunc("/stats", HandleStats)
+	r.HandleFunc("/probe/config", HandleProbeConfig).Methods(http.MethodGet)
+	r.HandleFunc("/probe/config", HandleProbeReconfigure).Methods(http.MethodPut)
 
 	http.Handle("/", r)
 	go func() {
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"net/http"
 
+	"github.com/ti-mo/conntracct/internal/config"
 	"github.com/ti-mo/conntracct/internal/sinks/types"
 )
 
@@ -11,6 +12,7 @@ import (
 func HandleStats(w http.ResponseWriter, r *http.Request) {
 
 	probe := pipe.ProbeStats()
+	sources := pipe.SourceStats()
 	pline := pipe.Stats()
 
 	sinks := make(map[string]types.SinkStats)
@@ -20,6 +22,7 @@ func HandleStats(w http.ResponseWriter, r *http.Request) {
 
 	s := map[string]interface{}{
 		"probe":    probe,
+		"sources":  sources,
 		"pipeline": pline,
 		"sinks":    sinks,
 	}
@@ -27,7 +30,58 @@ func HandleStats(w http.ResponseWriter, r *http.Request) {
 	out, err := json.Marshal(s)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		write(w, err.Error())
+		write(w, "%s", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	write(w, "%s", out)
+}
+
+// HandleProbeConfig returns the effective configuration of the probe in JSON format.
+func HandleProbeConfig(w http.ResponseWriter, r *http.Request) {
+	writeProbeConfig(w)
+}
+
+// HandleProbeReconfigure applies the probe configuration in the JSON request
+// body to the running probe and returns its effective configuration.
+// Takes the same keys as the probe section of the configuration file. Omitted
+// keys are reset to their defaults. The probe's transport and buffer sizes
+// cannot be changed at runtime and are ignored.
+func HandleProbeReconfigure(w http.ResponseWriter, r *http.Request) {
+
+	var m map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		write(w, "decoding request body: %s", err)
+		return
+	}
+
+	pc, err := config.DecodeProbeConfigMap(m)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		write(w, "%s", err)
+		return
+	}
+	pc.Default(config.DefaultProbeConfig)
+
+	if err := pipe.ReconfigureProbe(pc); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		write(w, "%s", err)
+		return
+	}
+
+	writeProbeConfig(w)
+}
+
+// writeProbeConfig writes the effective probe configuration to w in JSON format.
+func writeProbeConfig(w http.ResponseWriter) {
+
+	out, err := json.Marshal(pipe.ProbeConfig())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		write(w, "%s", err)
 		return
 	}
 
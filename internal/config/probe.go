@@ -1,7 +1,13 @@
 package config
 
 import (
+	"encoding/json"
 	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/mitchellh/mapstructure"
@@ -9,99 +15,150 @@ import (
 	"github.com/ti-mo/conntracct/pkg/bpf"
 )
 
+// Sources of conntrack events selectable as the probe's backend.
+const (
+	// BackendBPF uses a BPF program attached to kprobes in the conntrack module.
+	BackendBPF = "bpf"
+	// BackendNetlink uses ctnetlink events and periodic dumps of the
+	// conntrack table, for hosts that don't permit loading BPF programs.
+	BackendNetlink = "netlink"
+)
+
 // DefaultProbeConfig is the default probe configuration.
 var DefaultProbeConfig = ProbeConfig{
-	RateCurve: &Curve{
-		Zero: &CurvePoint{
-			Age:  durationPtr(0),
-			Rate: durationPtr(20 * time.Second),
-		},
-		One: &CurvePoint{
-			Age:  durationPtr(1 * time.Minute),
-			Rate: durationPtr(1 * time.Minute),
-		},
-		Two: &CurvePoint{
-			Age:  durationPtr(5 * time.Minute),
-			Rate: durationPtr(5 * time.Minute),
-		},
+	Backend: BackendBPF,
+	RateCurve: Curve{
+		{Age: 0, Rate: 20 * time.Second},
+		{Age: 1 * time.Minute, Rate: 1 * time.Minute},
+		{Age: 5 * time.Minute, Rate: 5 * time.Minute},
 	},
 }
 
 // ProbeConfig represents the configuration of an accounting probe.
 type ProbeConfig struct {
+	// Source of conntrack events, 'bpf' (default) or 'netlink'.
+	Backend string `mapstructure:"backend"`
+
 	// Probe Rate Curve structure.
-	RateCurve *Curve `mapstructure:"rate_curve"`
+	RateCurve Curve `mapstructure:"rate_curve"`
+
+	// Additional rate curves selected by protocol and destination port.
+	// Flows not matched by any of these use RateCurve.
+	RateCurves []NamedCurve `mapstructure:"rate_curves"`
+
+	// Transport used for receiving events from the kernel.
+	// One of 'auto' (default), 'ringbuf' or 'perf'.
+	Transport bpf.Transport `mapstructure:"transport"`
+
+	// Size of the BPF ring buffer in bytes.
+	RingBufferSize int `mapstructure:"ring_buffer_size"`
+
+	// Size of each CPU's perf buffer in bytes.
+	PerfBufferSize int `mapstructure:"perf_buffer_size"`
+
+	// Maximum amount of flows tracked by the probe for rate limiting.
+	// Defaults to the host's nf_conntrack_max.
+	FlowMapSize int `mapstructure:"flow_map_size"`
+
+	// Time after which flows that stopped generating events are removed
+	// from the probe's flow tracking maps. Defaults to 6 hours.
+	FlowReapHorizon time.Duration `mapstructure:"flow_reap_horizon"`
+
+	// Dump the conntrack table when the probe is started, emitting an event
+	// for each existing flow and using its real start time as its age.
+	SeedFlows bool `mapstructure:"seed_flows"`
+
+	// Interval at which the netlink backend dumps the conntrack table
+	// for reading the counters of flows. Defaults to 10 seconds.
+	DumpInterval time.Duration `mapstructure:"dump_interval"`
+
+	// Secret for keying the 64-bit flow IDs of events. Unkeyed if empty.
+	// Never reported back through String or MarshalJSON.
+	FlowIDKey string `mapstructure:"flow_id_key"`
+
+	// IPv4/IPv6 prefixes of flows to sample. If not empty, only flows with a
+	// source or destination address in one of these prefixes are sampled.
+	CIDRInclude []*net.IPNet `mapstructure:"cidr_include"`
+
+	// IPv4/IPv6 prefixes of flows to ignore. Flows with a source or
+	// destination address in one of these prefixes are never sampled.
+	CIDRExclude []*net.IPNet `mapstructure:"cidr_exclude"`
+
+	// Inode numbers of network namespaces to sample. If not empty,
+	// only flows in these namespaces are sampled.
+	NetNSAllow []uint32 `mapstructure:"netns_allow"`
+
+	// Inode numbers of network namespaces whose flows are never sampled.
+	NetNSDeny []uint32 `mapstructure:"netns_deny"`
+
+	// Names or numbers of the layer 4 protocols to sample.
+	// If not empty, only flows of these protocols are sampled.
+	Protocols []uint8 `mapstructure:"protocols"`
+
+	// When ConnmarkMask is non-zero, only flows with a connmark equal to
+	// ConnmarkValue after applying the mask are sampled.
+	ConnmarkValue uint32 `mapstructure:"connmark_value"`
+	ConnmarkMask  uint32 `mapstructure:"connmark_mask"`
 }
 
-// Default recursively sets the given default values on the ProbeConfig.
-// Finds any nil values in the configuration tree and initializes them
+// Default sets the given default values on the ProbeConfig.
+// Finds any unset values in the configuration and initializes them
 // to the given default.
 func (pc *ProbeConfig) Default(def ProbeConfig) {
-	// No ratecurve specified, copy a pointer to the whole default structure.
-	if pc.RateCurve == nil {
+	// No ratecurve specified, use the whole default curve.
+	if len(pc.RateCurve) == 0 {
 		pc.RateCurve = def.RateCurve
-	} else {
-		pc.RateCurve.Default(*def.RateCurve)
+	}
+
+	if pc.Backend == "" {
+		pc.Backend = def.Backend
 	}
 }
 
 func (pc *ProbeConfig) String() string {
-	return fmt.Sprintf("ProbeConfig{RateCurve: %s}", pc.RateCurve)
+	return fmt.Sprintf("ProbeConfig{Backend: %s, RateCurve: %s, RateCurves: %v, Transport: %s, RingBufferSize: %d, PerfBufferSize: %d, "+
+		"FlowMapSize: %d, FlowReapHorizon: %s, SeedFlows: %t, DumpInterval: %s, CIDRInclude: %v, CIDRExclude: %v, NetNSAllow: %v, NetNSDeny: %v, "+
+		"Protocols: %v, ConnmarkValue: %#x, ConnmarkMask: %#x}",
+		pc.Backend, pc.RateCurve, pc.RateCurves, pc.Transport, pc.RingBufferSize, pc.PerfBufferSize,
+		pc.FlowMapSize, pc.FlowReapHorizon, pc.SeedFlows, pc.DumpInterval, pc.CIDRInclude, pc.CIDRExclude, pc.NetNSAllow, pc.NetNSDeny, pc.Protocols,
+		pc.ConnmarkValue, pc.ConnmarkMask)
 }
 
 // Curve is the probe's rate curve configuration.
-type Curve struct {
-	Zero *CurvePoint `mapstructure:"0"`
-	One  *CurvePoint `mapstructure:"1"`
-	Two  *CurvePoint `mapstructure:"2"`
-}
-
-// Default recursively sets the given default values on the Curve.
-func (c *Curve) Default(def Curve) {
+// Its points are ordered by increasing age.
+type Curve []CurvePoint
 
-	if c.Zero == nil {
-		c.Zero = def.Zero
-	} else {
-		c.Zero.Default(*def.Zero.Age, *def.Zero.Rate)
-	}
-
-	if c.One == nil {
-		c.One = def.One
-	} else {
-		c.One.Default(*def.One.Age, *def.One.Rate)
-	}
-
-	if c.Two == nil {
-		c.Two = def.Two
-	} else {
-		c.Two.Default(*def.Two.Age, *def.Two.Rate)
-	}
-}
-
-func (c *Curve) String() string {
-	return fmt.Sprintf("{Zero: %s, One: %s, Two: %s}", c.Zero, c.One, c.Two)
+func (c Curve) String() string {
+	return fmt.Sprintf("%v", []CurvePoint(c))
 }
 
 // CurvePoint is an age/rate point in the probe's rate curve.
 type CurvePoint struct {
 	// The age a flow must have to be affected by this rate.
-	Age *time.Duration `mapstructure:"age"`
+	Age time.Duration `mapstructure:"age"`
 	// The update rate of the flow.
-	Rate *time.Duration `mapstructure:"rate"`
+	Rate time.Duration `mapstructure:"rate"`
 }
 
-// Default initializes nil age or rate fields on the CurvePoint to the given values.
-func (cp *CurvePoint) Default(age, rate time.Duration) {
-	if cp.Age == nil {
-		cp.Age = &age
-	}
-	if cp.Rate == nil {
-		cp.Rate = &rate
-	}
+func (cp CurvePoint) String() string {
+	return fmt.Sprintf("[from:%s, every:%s]", cp.Age, cp.Rate)
 }
 
-func (cp *CurvePoint) String() string {
-	return fmt.Sprintf("[from:%s, every:%s]", cp.Age, cp.Rate)
+// NamedCurve is a rate curve used for the flows of a protocol,
+// optionally limited to a set of destination ports.
+type NamedCurve struct {
+	Name string `mapstructure:"name"`
+	// Name or number of the layer 4 protocol of the flows using the curve.
+	Protocol uint8 `mapstructure:"protocol"`
+	// Destination ports or port ranges ('first-last') of the flows using
+	// the curve. When empty, the curve is used for all flows of Protocol
+	// that are not matched by a curve with ports.
+	Ports []bpf.PortRange `mapstructure:"ports"`
+	Curve Curve           `mapstructure:"curve"`
+}
+
+func (nc NamedCurve) String() string {
+	return fmt.Sprintf("{Name: %s, Protocol: %d, Ports: %v, Curve: %s}", nc.Name, nc.Protocol, nc.Ports, nc.Curve)
 }
 
 // DecodeProbeConfigMap extracts a ProbeConfig from a string map of
@@ -111,8 +168,15 @@ func DecodeProbeConfigMap(cfg map[string]interface{}) (*ProbeConfig, error) {
 	var out ProbeConfig
 
 	d, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
-		DecodeHook: mapstructure.StringToTimeDurationHookFunc(),
-		Result:     &out,
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			mapstructure.StringToTimeDurationHookFunc(),
+			stringToTransportHookFunc(),
+			stringToIPNetHookFunc(),
+			stringToProtocolHookFunc(),
+			mapToCurveHookFunc(),
+			toPortRangeHookFunc(),
+		),
+		Result: &out,
 	})
 	if err != nil {
 		panic(err)
@@ -129,17 +193,325 @@ func DecodeProbeConfigMap(cfg map[string]interface{}) (*ProbeConfig, error) {
 // BPFConfig extracts a pkg/bpf.Config from a ProbeConfig.
 func (pc *ProbeConfig) BPFConfig() bpf.Config {
 	return bpf.Config{
-		Curve0: bpf.CurvePoint{
-			Age:  *pc.RateCurve.Zero.Age,
-			Rate: *pc.RateCurve.Zero.Rate,
-		},
-		Curve1: bpf.CurvePoint{
-			Age:  *pc.RateCurve.One.Age,
-			Rate: *pc.RateCurve.One.Rate,
-		},
-		Curve2: bpf.CurvePoint{
-			Age:  *pc.RateCurve.Two.Age,
-			Rate: *pc.RateCurve.Two.Rate,
-		},
+		Curve:          pc.RateCurve.BPFCurve(),
+		Curves:         pc.BPFCurves(),
+		Transport:      pc.Transport,
+		RingBufferSize: pc.RingBufferSize,
+		PerfBufferSize: pc.PerfBufferSize,
+		FlowMapSize:    pc.FlowMapSize,
+		ReapHorizon:    pc.FlowReapHorizon,
+		SeedFlows:      pc.SeedFlows,
+		DumpInterval:   pc.DumpInterval,
+		FlowIDKey:      pc.FlowIDKey,
+		Filter:         pc.Filter(),
+	}
+}
+
+// BPFCurve converts the Curve to a list of pkg/bpf.CurvePoints.
+func (c Curve) BPFCurve() []bpf.CurvePoint {
+	out := make([]bpf.CurvePoint, 0, len(c))
+	for _, p := range c {
+		out = append(out, bpf.CurvePoint{Age: p.Age, Rate: p.Rate})
+	}
+	return out
+}
+
+// BPFCurves extracts the ProbeConfig's named curves as pkg/bpf.RateCurves.
+func (pc *ProbeConfig) BPFCurves() []bpf.RateCurve {
+	var out []bpf.RateCurve
+	for _, nc := range pc.RateCurves {
+		out = append(out, bpf.RateCurve{
+			Name:     nc.Name,
+			Protocol: nc.Protocol,
+			Ports:    nc.Ports,
+			Curve:    nc.Curve.BPFCurve(),
+		})
+	}
+	return out
+}
+
+// curveFromBPF converts a list of pkg/bpf.CurvePoints to a Curve.
+func curveFromBPF(points []bpf.CurvePoint) Curve {
+	out := make(Curve, 0, len(points))
+	for _, p := range points {
+		out = append(out, CurvePoint{Age: p.Age, Rate: p.Rate})
+	}
+	return out
+}
+
+// ProbeConfigFromBPF builds a ProbeConfig from a pkg/bpf.Config,
+// eg. to report the effective configuration of a running probe.
+// The flow ID key and the backend are omitted.
+func ProbeConfigFromBPF(cfg bpf.Config) *ProbeConfig {
+
+	var curves []NamedCurve
+	for _, c := range cfg.Curves {
+		curves = append(curves, NamedCurve{
+			Name:     c.Name,
+			Protocol: c.Protocol,
+			Ports:    c.Ports,
+			Curve:    curveFromBPF(c.Curve),
+		})
+	}
+
+	return &ProbeConfig{
+		RateCurve:       curveFromBPF(cfg.Curve),
+		RateCurves:      curves,
+		Transport:       cfg.Transport,
+		RingBufferSize:  cfg.RingBufferSize,
+		PerfBufferSize:  cfg.PerfBufferSize,
+		FlowMapSize:     cfg.FlowMapSize,
+		FlowReapHorizon: cfg.ReapHorizon,
+		SeedFlows:       cfg.SeedFlows,
+		DumpInterval:    cfg.DumpInterval,
+		CIDRInclude:     cfg.Filter.CIDRInclude,
+		CIDRExclude:     cfg.Filter.CIDRExclude,
+		NetNSAllow:      cfg.Filter.NetNSAllow,
+		NetNSDeny:       cfg.Filter.NetNSDeny,
+		Protocols:       cfg.Filter.Protocols,
+		ConnmarkValue:   cfg.Filter.ConnmarkValue,
+		ConnmarkMask:    cfg.Filter.ConnmarkMask,
+	}
+}
+
+// MarshalJSON marshals the ProbeConfig into the same format accepted
+// by DecodeProbeConfigMap, so the output can be decoded again.
+func (pc ProbeConfig) MarshalJSON() ([]byte, error) {
+
+	type point struct {
+		Age  string `json:"age"`
+		Rate string `json:"rate"`
+	}
+
+	type namedCurve struct {
+		Name     string   `json:"name"`
+		Protocol uint8    `json:"protocol"`
+		Ports    []string `json:"ports"`
+		Curve    []point  `json:"curve"`
+	}
+
+	points := func(c Curve) []point {
+		out := make([]point, 0, len(c))
+		for _, p := range c {
+			out = append(out, point{Age: p.Age.String(), Rate: p.Rate.String()})
+		}
+		return out
+	}
+
+	curves := make([]namedCurve, 0, len(pc.RateCurves))
+	for _, nc := range pc.RateCurves {
+		ports := make([]string, 0, len(nc.Ports))
+		for _, pr := range nc.Ports {
+			ports = append(ports, pr.String())
+		}
+		curves = append(curves, namedCurve{Name: nc.Name, Protocol: nc.Protocol, Ports: ports, Curve: points(nc.Curve)})
+	}
+
+	cidrs := func(ns []*net.IPNet) []string {
+		out := make([]string, 0, len(ns))
+		for _, n := range ns {
+			out = append(out, n.String())
+		}
+		return out
+	}
+
+	// Marshal protocols as a list of numbers instead of a base64 string.
+	protos := make([]uint, 0, len(pc.Protocols))
+	for _, p := range pc.Protocols {
+		protos = append(protos, uint(p))
+	}
+
+	return json.Marshal(struct {
+		Backend         string       `json:"backend"`
+		RateCurve       []point      `json:"rate_curve"`
+		RateCurves      []namedCurve `json:"rate_curves"`
+		Transport       string       `json:"transport"`
+		RingBufferSize  int          `json:"ring_buffer_size"`
+		PerfBufferSize  int          `json:"perf_buffer_size"`
+		FlowMapSize     int          `json:"flow_map_size"`
+		FlowReapHorizon string       `json:"flow_reap_horizon"`
+		SeedFlows       bool         `json:"seed_flows"`
+		DumpInterval    string       `json:"dump_interval"`
+		CIDRInclude     []string     `json:"cidr_include"`
+		CIDRExclude     []string     `json:"cidr_exclude"`
+		NetNSAllow      []uint32     `json:"netns_allow"`
+		NetNSDeny       []uint32     `json:"netns_deny"`
+		Protocols       []uint       `json:"protocols"`
+		ConnmarkValue   uint32       `json:"connmark_value"`
+		ConnmarkMask    uint32       `json:"connmark_mask"`
+	}{
+		Backend:         pc.Backend,
+		RateCurve:       points(pc.RateCurve),
+		RateCurves:      curves,
+		Transport:       pc.Transport.String(),
+		RingBufferSize:  pc.RingBufferSize,
+		PerfBufferSize:  pc.PerfBufferSize,
+		FlowMapSize:     pc.FlowMapSize,
+		FlowReapHorizon: pc.FlowReapHorizon.String(),
+		SeedFlows:       pc.SeedFlows,
+		DumpInterval:    pc.DumpInterval.String(),
+		CIDRInclude:     cidrs(pc.CIDRInclude),
+		CIDRExclude:     cidrs(pc.CIDRExclude),
+		NetNSAllow:      pc.NetNSAllow,
+		NetNSDeny:       pc.NetNSDeny,
+		Protocols:       protos,
+		ConnmarkValue:   pc.ConnmarkValue,
+		ConnmarkMask:    pc.ConnmarkMask,
+	})
+}
+
+// Filter extracts a pkg/bpf.Filter from a ProbeConfig.
+func (pc *ProbeConfig) Filter() bpf.Filter {
+	return bpf.Filter{
+		CIDRInclude:   pc.CIDRInclude,
+		CIDRExclude:   pc.CIDRExclude,
+		NetNSAllow:    pc.NetNSAllow,
+		NetNSDeny:     pc.NetNSDeny,
+		Protocols:     pc.Protocols,
+		ConnmarkValue: pc.ConnmarkValue,
+		ConnmarkMask:  pc.ConnmarkMask,
+	}
+}
+
+// stringToTransportHookFunc returns a mapstructure.DecodeHookFunc that converts
+// strings to bpf.Transports.
+func stringToTransportHookFunc() mapstructure.DecodeHookFunc {
+	return func(
+		f reflect.Type,
+		t reflect.Type,
+		data interface{}) (interface{}, error) {
+		if f.Kind() != reflect.String {
+			return data, nil
+		}
+		if t != reflect.TypeOf(bpf.Transport(0)) {
+			return data, nil
+		}
+
+		return bpf.ParseTransport(data.(string))
+	}
+}
+
+// stringToIPNetHookFunc returns a mapstructure.DecodeHookFunc that converts
+// strings in CIDR notation to *net.IPNets.
+func stringToIPNetHookFunc() mapstructure.DecodeHookFunc {
+	return func(
+		f reflect.Type,
+		t reflect.Type,
+		data interface{}) (interface{}, error) {
+		if f.Kind() != reflect.String {
+			return data, nil
+		}
+		if t != reflect.TypeOf(&net.IPNet{}) {
+			return data, nil
+		}
+
+		_, n, err := net.ParseCIDR(data.(string))
+		return n, err
+	}
+}
+
+// protocols maps protocol names accepted in the configuration
+// to their protocol numbers.
+var protocols = map[string]uint8{
+	"icmp":    1,
+	"tcp":     6,
+	"udp":     17,
+	"dccp":    33,
+	"gre":     47,
+	"esp":     50,
+	"ah":      51,
+	"icmpv6":  58,
+	"sctp":    132,
+	"udplite": 136,
+}
+
+// stringToProtocolHookFunc returns a mapstructure.DecodeHookFunc that converts
+// protocol names and numbers in strings to uint8s.
+func stringToProtocolHookFunc() mapstructure.DecodeHookFunc {
+	return func(
+		f reflect.Type,
+		t reflect.Type,
+		data interface{}) (interface{}, error) {
+		if f.Kind() != reflect.String {
+			return data, nil
+		}
+		if t != reflect.TypeOf(uint8(0)) {
+			return data, nil
+		}
+
+		s := strings.ToLower(data.(string))
+		if p, ok := protocols[s]; ok {
+			return p, nil
+		}
+
+		p, err := strconv.ParseUint(s, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("unknown protocol '%s'", data)
+		}
+
+		return uint8(p), nil
+	}
+}
+
+// mapToCurveHookFunc returns a mapstructure.DecodeHookFunc that converts
+// rate curves in the legacy map format, with curve points keyed by their
+// index, to a list of curve points ordered by index.
+func mapToCurveHookFunc() mapstructure.DecodeHookFunc {
+	return func(
+		f reflect.Type,
+		t reflect.Type,
+		data interface{}) (interface{}, error) {
+		if f.Kind() != reflect.Map {
+			return data, nil
+		}
+		if t != reflect.TypeOf(Curve{}) {
+			return data, nil
+		}
+
+		v := reflect.ValueOf(data)
+		idx := make([]int, 0, v.Len())
+		points := make(map[int]interface{}, v.Len())
+
+		for _, k := range v.MapKeys() {
+			i, err := strconv.Atoi(fmt.Sprint(k.Interface()))
+			if err != nil {
+				return nil, fmt.Errorf("invalid rate curve point index '%v'", k.Interface())
+			}
+			idx = append(idx, i)
+			points[i] = v.MapIndex(k).Interface()
+		}
+
+		sort.Ints(idx)
+
+		out := make([]interface{}, 0, len(idx))
+		for _, i := range idx {
+			out = append(out, points[i])
+		}
+
+		return out, nil
+	}
+}
+
+// toPortRangeHookFunc returns a mapstructure.DecodeHookFunc that converts
+// port numbers and strings holding a port or a port range to bpf.PortRanges.
+func toPortRangeHookFunc() mapstructure.DecodeHookFunc {
+	return func(
+		f reflect.Type,
+		t reflect.Type,
+		data interface{}) (interface{}, error) {
+		if t != reflect.TypeOf(bpf.PortRange{}) {
+			return data, nil
+		}
+
+		switch f.Kind() {
+		case reflect.String:
+			return bpf.ParsePortRange(data.(string))
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.Float32, reflect.Float64:
+			return bpf.ParsePortRange(fmt.Sprint(data))
+		}
+
+		return data, nil
 	}
 }
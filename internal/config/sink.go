@@ -34,6 +34,15 @@ type SinkConfig struct {
 	// Whether or not the sink should receive the flows' source ports.
 	SourcePorts bool `mapstructure:"sourcePorts"`
 
+	// Identify flows by their 64-bit flow ID instead of the 32-bit one.
+	// Used as the flow_id tag (influxdb) or the document ID (elastic).
+	FlowID64 bool `mapstructure:"flowID64"`
+
+	// Whether or not the sink should receive the flows' Community IDs,
+	// and the seed used for calculating them.
+	CommunityID     bool   `mapstructure:"communityID"`
+	CommunityIDSeed uint16 `mapstructure:"communityIDSeed"`
+
 	// Name of the sink.
 	Name string `mapstructure:"-"`
 
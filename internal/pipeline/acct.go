@@ -1,15 +1,11 @@
 package pipeline
 
 import (
-	"strings"
-
 	"github.com/pkg/errors"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/ti-mo/conntracct/internal/config"
-
-	"github.com/ti-mo/conntracct/pkg/bpf"
 )
 
 // Init initializes the pipeline. Only runs once, subsequent calls are no-ops.
@@ -28,43 +24,74 @@ func (p *Pipeline) Init(pc *config.ProbeConfig) error {
 	return err
 }
 
-// initProbe initializes the accounting probe and consumers.
+// initProbe initializes the event source selected by the probe
+// configuration's backend and attaches it to the pipeline.
 // Should only be called once, eg. gated behind a sync.Once.
 func (p *Pipeline) initProbe(pc *config.ProbeConfig) error {
 
 	// Extract BPF configuration from app configuration.
 	cfg := pc.BPFConfig()
 
-	// Create a new accounting probe.
-	ap, err := bpf.NewProbe(cfg)
-	if err != nil {
-		return errors.Wrap(err, "initializing BPF probe")
+	var src configurableSource
+	var sc *sourceConsumers
+
+	switch pc.Backend {
+	case config.BackendBPF, "":
+		ps, err := newProbeSource(cfg, p.stats)
+		if err != nil {
+			return err
+		}
+		src, sc = ps, ps.consumers
+
+	case config.BackendNetlink:
+		nl, err := newNetlinkSource(cfg)
+		if err != nil {
+			return err
+		}
+		src, sc = nl, nl.consumers
+
+	default:
+		return errors.Errorf("unknown probe backend '%s'", pc.Backend)
+	}
+
+	// Store references to the source's consumer stats.
+	p.stats.UpdateSourceStats = sc.update.Stats()
+	p.stats.DestroySourceStats = sc.destroy.Stats()
+
+	if err := p.AddSource(src); err != nil {
+		return err
 	}
 
-	log.Infof("Inserted probe version %s", ap.Kernel().Version)
+	p.acctSource = src
 
-	// Register accounting update/destroy event consumers.
-	// From the perspective of the pipeline, these are sources.
-	au := bpf.NewConsumer("PipelineAcctUpdate", make(chan bpf.Event, 1024), bpf.ConsumerUpdate)
-	if err := ap.RegisterConsumer(au); err != nil {
-		return errors.Wrap(err, "registering update consumer to probe")
+	return nil
+}
+
+// AddSource attaches an EventSource to the pipeline. Its events are delivered
+// to the pipeline's sinks along with those of other sources. If the pipeline
+// was already started, the source is started immediately.
+func (p *Pipeline) AddSource(s EventSource) error {
+
+	if s == nil {
+		return errSourceNil
+	}
+
+	p.acctSourceMu.Lock()
+	defer p.acctSourceMu.Unlock()
+
+	for _, src := range p.acctSources {
+		if src.Name() == s.Name() {
+			return errDupSource
+		}
 	}
-	// Store references to the source and its stats.
-	p.acctUpdateSource = au
-	p.stats.UpdateSourceStats = au.Stats()
-	log.Debug("Registered Probe consumer " + au.Name())
-
-	ad := bpf.NewConsumer("PipelineAcctDestroy", make(chan bpf.Event, 1024), bpf.ConsumerDestroy)
-	if err := ap.RegisterConsumer(ad); err != nil {
-		return errors.Wrap(err, "registering destroy consumer to probe")
+
+	if p.started {
+		if err := p.startSource(s); err != nil {
+			return err
+		}
 	}
-	// Store references to the source and its stats.
-	p.acctDestroySource = ad
-	p.stats.DestroySourceStats = ad.Stats()
-	log.Debug("Registered Probe consumer " + ad.Name())
 
-	// Save the Probe reference to the pipeline.
-	p.acctProbe = ap
+	p.acctSources = append(p.acctSources, s)
 
 	return nil
 }
@@ -72,7 +99,11 @@ func (p *Pipeline) initProbe(pc *config.ProbeConfig) error {
 // Start starts all resources registered to the pipeline.
 func (p *Pipeline) Start() error {
 
-	if p.acctProbe == nil {
+	p.acctSourceMu.RLock()
+	n := len(p.acctSources)
+	p.acctSourceMu.RUnlock()
+
+	if n == 0 {
 		return errAcctNotInitialized
 	}
 
@@ -85,50 +116,84 @@ func (p *Pipeline) Start() error {
 	return err
 }
 
-// startAcct starts the Probe and starts goroutines reading Events from
-// update and destroy sources.
+// startAcct starts all event sources attached to the pipeline.
 func (p *Pipeline) startAcct() error {
 
-	// Start the conntracct event consumer.
-	go p.acctUpdateWorker()
-	go p.acctDestroyWorker()
+	p.acctSourceMu.Lock()
+	defer p.acctSourceMu.Unlock()
 
-	// Start the Probe.
-	if err := p.acctProbe.Start(); err != nil {
-		if strings.Contains(err.Error(), "kprobe_events") {
-			log.Warn("Either another conntracct instance is running, or the program was sent a SIGKILL. Try running 'echo | sudo tee /sys/kernel/debug/tracing/kprobe_events'. (will detach all kprobes)")
+	for _, s := range p.acctSources {
+		if err := p.startSource(s); err != nil {
+			return err
 		}
-		return errors.Wrap(err, "starting probe")
 	}
 
-	log.Info("Started accounting probe and workers")
+	p.started = true
+
+	log.Info("Started event sources and workers")
+
+	return nil
+}
+
+// startSource starts the given source and goroutines reading events
+// from its update and destroy streams.
+func (p *Pipeline) startSource(s EventSource) error {
+
+	if err := s.Start(); err != nil {
+		return errors.Wrapf(err, "starting source %s", s.Name())
+	}
+
+	// Start the conntracct event consumers.
+	go p.acctUpdateWorker(s)
+	go p.acctDestroyWorker(s)
+	if s.Lost() != nil {
+		go p.acctLostWorker(s)
+	}
 
 	return nil
 }
 
-// acctUpdateWorker reads from the pipeline's update event channel
-// and delivers events to all registered sinks listening for update events.
+// acctLostWorker receives notifications of samples lost by the given source,
+// records the gaps in the pipeline's statistics and delivers them to all sinks,
+// marking the affected time window as incomplete.
+func (p *Pipeline) acctLostWorker(s EventSource) {
+
+	for l := range s.Lost() {
+		p.stats.addGap(l.Count, l.Time)
+
+		log.Debugf("Event source %s: %s", s.Name(), l)
+
+		p.acctSinkMu.RLock()
+		for _, sink := range p.acctSinks {
+			sink.PushGap(l)
+		}
+		p.acctSinkMu.RUnlock()
+	}
+}
+
+// acctUpdateWorker reads batches from the given source's update stream
+// and delivers them to all registered sinks listening for update events.
 // This code closely resembles acctDestroyWorker due to this being in the hot
 // path, avoiding as much branching and unnecessary work as possible.
-func (p *Pipeline) acctUpdateWorker() {
+func (p *Pipeline) acctUpdateWorker(s EventSource) {
 
-	c := p.acctUpdateSource.Events()
+	c := s.Updates()
 
 	for {
-		ae, ok := <-c
+		b, ok := <-c
 		if !ok {
-			log.Debug("Pipeline's update event channel closed, stopping worker.")
+			log.Debugf("Update stream of source %s closed, stopping worker.", s.Name())
 			break
 		}
 
 		// Record pipeline statistics.
-		p.stats.IncrEventsUpdate()
+		p.stats.AddEventsUpdate(len(b))
 
 		// Fan out to all registered accounting sinks.
 		p.acctSinkMu.RLock()
 		for _, s := range p.acctSinks {
 			if s.WantUpdate() {
-				s.PushUpdate(ae)
+				s.PushUpdateBatch(b)
 			}
 		}
 		p.acctSinkMu.RUnlock()
@@ -136,25 +201,25 @@ func (p *Pipeline) acctUpdateWorker() {
 }
 
 // acctDestroyWorker is a copy of acctUpdateWorker, but for destroy events.
-func (p *Pipeline) acctDestroyWorker() {
+func (p *Pipeline) acctDestroyWorker(s EventSource) {
 
-	c := p.acctDestroySource.Events()
+	c := s.Destroys()
 
 	for {
-		ae, ok := <-c
+		b, ok := <-c
 		if !ok {
-			log.Debug("Pipeline's destroy event channel closed, stopping worker.")
+			log.Debugf("Destroy stream of source %s closed, stopping worker.", s.Name())
 			break
 		}
 
 		// Record pipeline statistics.
-		p.stats.IncrEventsDestroy()
+		p.stats.AddEventsDestroy(len(b))
 
 		// Fan out to all registered accounting sinks.
 		p.acctSinkMu.RLock()
 		for _, s := range p.acctSinks {
 			if s.WantDestroy() {
-				s.PushDestroy(ae)
+				s.PushDestroyBatch(b)
 			}
 		}
 		p.acctSinkMu.RUnlock()
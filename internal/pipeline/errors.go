@@ -6,4 +6,7 @@ var (
 	errAcctNotInitialized = errors.New("accounting not yet initialized")
 	errSinkNotInit        = errors.New("sink must be initialized before registering with pipeline")
 	errProbeConfig        = errors.New("received nil probe configuration")
+	errProbeRestartLimit  = errors.New("probe restart limit reached")
+	errSourceNil          = errors.New("given event source is nil")
+	errDupSource          = errors.New("an event source with the same name is already attached")
 )
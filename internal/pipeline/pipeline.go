@@ -3,6 +3,11 @@ package pipeline
 import (
 	"sync"
 
+	"github.com/pkg/errors"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ti-mo/conntracct/internal/config"
 	"github.com/ti-mo/conntracct/internal/sinks"
 	"github.com/ti-mo/conntracct/pkg/bpf"
 )
@@ -11,11 +16,16 @@ import (
 // data ingest pipeline.
 type Pipeline struct {
 	start sync.Once
+	init  sync.Once
+
+	// Event sources attached to the pipeline. Sources attached after the
+	// pipeline was started are started immediately.
+	acctSourceMu sync.RWMutex
+	acctSources  []EventSource
+	started      bool
 
-	init              sync.Once
-	acctProbe         *bpf.Probe
-	acctUpdateSource  *bpf.Consumer
-	acctDestroySource *bpf.Consumer
+	// Source created from the probe configuration by Init.
+	acctSource configurableSource
 
 	acctSinkMu sync.RWMutex
 	acctSinks  []sinks.Sink
@@ -64,14 +74,82 @@ func (p *Pipeline) GetSinks() []sinks.Sink {
 }
 
 // Stop gracefully tears down all resources of a Pipeline structure.
+// Stops all event sources, returns the first error encountered.
 func (p *Pipeline) Stop() error {
-	// Stop the accounting probe.
-	return p.acctProbe.Stop()
+
+	p.acctSourceMu.Lock()
+	defer p.acctSourceMu.Unlock()
+
+	var err error
+	for _, s := range p.acctSources {
+		if serr := s.Stop(); serr != nil && err == nil {
+			err = errors.Wrapf(serr, "stopping source %s", s.Name())
+		}
+	}
+
+	return err
 }
 
-// ProbeStats returns a snapshot copy of the pipeline's probe's statistics.
+// ProbeStats returns a snapshot copy of the statistics of the
+// pipeline's probe, the source created from the probe configuration.
 func (p *Pipeline) ProbeStats() bpf.ProbeStats {
-	return p.acctProbe.Stats()
+
+	if p.acctSource == nil {
+		return bpf.ProbeStats{}
+	}
+
+	return p.acctSource.Stats()
+}
+
+// SourceStats returns snapshot copies of the statistics of all
+// event sources attached to the pipeline, indexed by their names.
+func (p *Pipeline) SourceStats() map[string]bpf.ProbeStats {
+
+	p.acctSourceMu.RLock()
+	defer p.acctSourceMu.RUnlock()
+
+	out := make(map[string]bpf.ProbeStats, len(p.acctSources))
+	for _, s := range p.acctSources {
+		out[s.Name()] = s.Stats()
+	}
+
+	return out
+}
+
+// ProbeConfig returns the effective configuration of the pipeline's probe.
+func (p *Pipeline) ProbeConfig() *config.ProbeConfig {
+
+	if p.acctSource == nil {
+		return nil
+	}
+
+	pc := config.ProbeConfigFromBPF(p.acctSource.Config())
+	pc.Backend = p.acctSource.Name()
+
+	return pc
+}
+
+// ReconfigureProbe applies the given configuration to the pipeline's running
+// probe. Flows known to the probe are not reset, so sinks don't receive a burst
+// of updates. The probe's backend, transport and buffer sizes cannot be changed.
+func (p *Pipeline) ReconfigureProbe(pc *config.ProbeConfig) error {
+
+	if pc == nil {
+		return errProbeConfig
+	}
+
+	src := p.acctSource
+	if src == nil {
+		return errAcctNotInitialized
+	}
+
+	if err := src.Reconfigure(pc.BPFConfig()); err != nil {
+		return errors.Wrap(err, "reconfiguring probe")
+	}
+
+	log.Info("Reconfigured probe: ", p.ProbeConfig())
+
+	return nil
 }
 
 // Stats returns a snapshot copy of the pipeline's statistics.
@@ -0,0 +1,96 @@
+package pipeline
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// EventSource is a source of accounting events consumed by the Pipeline,
+// eg. the BPF probe. Multiple sources can be attached to a Pipeline, their
+// events are delivered to the same sinks.
+type EventSource interface {
+	// Name uniquely identifies the source within the Pipeline.
+	Name() string
+
+	// Start starts delivering events on the source's streams.
+	Start() error
+	// Stop stops the source and closes its streams after delivering
+	// any pending events.
+	Stop() error
+
+	// Updates and Destroys return the streams of the source's update and
+	// destroy events, delivered in batches. Batches are owned by the receiver.
+	Updates() <-chan []bpf.Event
+	Destroys() <-chan []bpf.Event
+
+	// Lost returns a channel receiving notifications of events lost by
+	// the source. Nil if the source never loses events.
+	Lost() <-chan bpf.LostSamples
+
+	// Stats returns a snapshot copy of the source's statistics.
+	Stats() bpf.ProbeStats
+}
+
+// configurableSource is an EventSource created from the probe configuration,
+// whose configuration can be read and changed at runtime.
+type configurableSource interface {
+	EventSource
+
+	Config() bpf.Config
+	Reconfigure(bpf.Config) error
+}
+
+// bpfSource is implemented by the event sources in pkg/bpf.
+type bpfSource interface {
+	RegisterConsumer(*bpf.Consumer) error
+	RemoveConsumer(*bpf.Consumer) error
+	SubscribeLost(chan bpf.LostSamples) error
+	UnsubscribeLost(chan bpf.LostSamples) error
+}
+
+// sourceConsumers are the update and destroy Consumers and the lost sample
+// channel through which an EventSource receives events from a pkg/bpf source.
+type sourceConsumers struct {
+	update  *bpf.Consumer
+	destroy *bpf.Consumer
+	lost    chan bpf.LostSamples
+}
+
+// newSourceConsumers returns a new set of sourceConsumers.
+// Events are received in batches of the default size and deadline.
+func newSourceConsumers() *sourceConsumers {
+	return &sourceConsumers{
+		update:  bpf.NewBatchConsumer("PipelineAcctUpdate", make(chan []bpf.Event, 64), bpf.ConsumerUpdate, 0, 0),
+		destroy: bpf.NewBatchConsumer("PipelineAcctDestroy", make(chan []bpf.Event, 64), bpf.ConsumerDestroy, 0, 0),
+		lost:    make(chan bpf.LostSamples, 64),
+	}
+}
+
+// register registers the consumers to src and subscribes them to lost samples.
+func (sc *sourceConsumers) register(src bpfSource) error {
+
+	for _, c := range []*bpf.Consumer{sc.update, sc.destroy} {
+		if err := src.RegisterConsumer(c); err != nil {
+			return errors.Wrapf(err, "registering consumer %s", c.Name())
+		}
+	}
+
+	if err := src.SubscribeLost(sc.lost); err != nil {
+		return errors.Wrap(err, "subscribing to lost samples")
+	}
+
+	return nil
+}
+
+// close removes the consumers from src, closing their channels.
+func (sc *sourceConsumers) close(src bpfSource) error {
+
+	for _, c := range []*bpf.Consumer{sc.update, sc.destroy} {
+		if err := src.RemoveConsumer(c); err != nil {
+			return errors.Wrapf(err, "removing consumer %s", c.Name())
+		}
+	}
+
+	return src.UnsubscribeLost(sc.lost)
+}
@@ -0,0 +1,113 @@
+package pipeline
+
+import (
+	"github.com/pkg/errors"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ti-mo/conntracct/internal/config"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// netlinkSource is an EventSource reading events from a bpf.NetlinkSource.
+type netlinkSource struct {
+	consumers *sourceConsumers
+	source    *bpf.NetlinkSource
+}
+
+// newNetlinkSource subscribes to conntrack events using the given
+// configuration and returns a netlinkSource reading them.
+func newNetlinkSource(cfg bpf.Config) (*netlinkSource, error) {
+
+	ns, err := bpf.NewNetlinkSource(cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "initializing netlink source")
+	}
+
+	log.Info("Subscribed to conntrack events over netlink")
+
+	nl := &netlinkSource{
+		consumers: newSourceConsumers(),
+		source:    ns,
+	}
+
+	if err := nl.consumers.register(ns); err != nil {
+		return nil, errors.Wrap(err, "registering to netlink source")
+	}
+
+	return nl, nil
+}
+
+// Name returns the name of the netlink backend.
+func (nl *netlinkSource) Name() string {
+	return config.BackendNetlink
+}
+
+// Start starts the netlink source and watches it for read errors.
+func (nl *netlinkSource) Start() error {
+
+	if err := nl.source.Start(); err != nil {
+		return errors.Wrap(err, "starting netlink source")
+	}
+
+	go nl.errorWorker()
+
+	log.Info("Started netlink source")
+
+	return nil
+}
+
+// Stop stops the netlink source and closes the source's streams.
+func (nl *netlinkSource) Stop() error {
+
+	if err := nl.source.Stop(); err != nil {
+		return err
+	}
+
+	return nl.consumers.close(nl.source)
+}
+
+// Updates returns the stream of the source's update events.
+func (nl *netlinkSource) Updates() <-chan []bpf.Event {
+	return nl.consumers.update.Batches()
+}
+
+// Destroys returns the stream of the source's destroy events.
+func (nl *netlinkSource) Destroys() <-chan []bpf.Event {
+	return nl.consumers.destroy.Batches()
+}
+
+// Lost returns the channel receiving notifications of events lost by the netlink source.
+func (nl *netlinkSource) Lost() <-chan bpf.LostSamples {
+	return nl.consumers.lost
+}
+
+// Stats returns a snapshot copy of the netlink source's statistics.
+func (nl *netlinkSource) Stats() bpf.ProbeStats {
+	return nl.source.Stats()
+}
+
+// Config returns the netlink source's effective configuration.
+func (nl *netlinkSource) Config() bpf.Config {
+	return nl.source.Config()
+}
+
+// Reconfigure replaces the rate curves and filter of the netlink source.
+func (nl *netlinkSource) Reconfigure(cfg bpf.Config) error {
+	return nl.source.Reconfigure(cfg)
+}
+
+// errorWorker logs the errors reported by the netlink source.
+// Exits when the source is stopped.
+func (nl *netlinkSource) errorWorker() {
+
+	for err := range nl.source.Errors() {
+		re, ok := err.(*bpf.ReadError)
+		if !ok || !re.Fatal {
+			log.Warn("Error reading events from netlink: ", err)
+			continue
+		}
+
+		log.Error("Netlink source stopped reading from socket: ", err)
+	}
+}
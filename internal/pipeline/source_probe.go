@@ -0,0 +1,220 @@
+package pipeline
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ti-mo/conntracct/internal/config"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// probeRestartLimit is the maximum amount of times the accounting probe
+// is restarted after failing.
+const probeRestartLimit = 5
+
+// probeSource is an EventSource reading events from a BPF probe.
+// The probe is replaced when it stops reading events from the kernel.
+type probeSource struct {
+	consumers *sourceConsumers
+
+	// The probe is replaced when it is restarted after a failure. running is
+	// cleared when a failed probe was stopped and could not be replaced.
+	probeMu sync.RWMutex
+	probe   *bpf.Probe
+	running bool
+	stopped bool
+
+	// Statistics of the pipeline, recording probe restarts.
+	stats *Stats
+}
+
+// newProbeSource loads a BPF probe using the given configuration
+// and returns a probeSource reading its events.
+func newProbeSource(cfg bpf.Config, stats *Stats) (*probeSource, error) {
+
+	ap, err := bpf.NewProbe(cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "initializing BPF probe")
+	}
+
+	log.Infof("Inserted probe version %s (%s mode) using %s transport", ap.Kernel().Version, ap.Kernel().Mode(), ap.Transport())
+
+	ps := &probeSource{
+		consumers: newSourceConsumers(),
+		probe:     ap,
+		stats:     stats,
+	}
+
+	// From the perspective of the pipeline, the probe's consumers are sources.
+	if err := ps.consumers.register(ap); err != nil {
+		_ = ap.Close()
+		return nil, errors.Wrap(err, "registering to probe")
+	}
+	log.Debug("Registered Probe consumers")
+
+	return ps, nil
+}
+
+// Name returns the name of the probe's backend.
+func (ps *probeSource) Name() string {
+	return config.BackendBPF
+}
+
+// Start starts the probe and watches it for read errors.
+func (ps *probeSource) Start() error {
+
+	ps.probeMu.Lock()
+	defer ps.probeMu.Unlock()
+
+	ap := ps.probe
+
+	if err := ap.Start(); err != nil {
+		if strings.Contains(err.Error(), "kprobe_events") {
+			log.Warn("The running kernel does not support the kprobe PMU, falling back to tracefs failed. " +
+				"Make sure tracefs is mounted at /sys/kernel/tracing and conntracct has permission to write to it. " +
+				"Kprobes left behind by crashed instances can be removed using 'conntracct cleanup'.")
+		}
+		return errors.Wrap(err, "starting probe")
+	}
+	ps.running = true
+
+	go ps.errorWorker(ap)
+
+	log.Info("Started accounting probe")
+
+	return nil
+}
+
+// Stop stops the probe, preventing it from being restarted,
+// and closes the source's streams.
+func (ps *probeSource) Stop() error {
+
+	ps.probeMu.Lock()
+	defer ps.probeMu.Unlock()
+
+	ps.stopped = true
+
+	// A failed probe that could not be replaced was already stopped.
+	if ps.running {
+		ps.running = false
+		if err := ps.probe.Stop(); err != nil {
+			return err
+		}
+	}
+
+	return ps.consumers.close(ps.probe)
+}
+
+// current returns the source's current probe.
+func (ps *probeSource) current() *bpf.Probe {
+
+	ps.probeMu.RLock()
+	defer ps.probeMu.RUnlock()
+
+	return ps.probe
+}
+
+// Updates returns the stream of the source's update events.
+func (ps *probeSource) Updates() <-chan []bpf.Event {
+	return ps.consumers.update.Batches()
+}
+
+// Destroys returns the stream of the source's destroy events.
+func (ps *probeSource) Destroys() <-chan []bpf.Event {
+	return ps.consumers.destroy.Batches()
+}
+
+// Lost returns the channel receiving notifications of events lost by the probe.
+func (ps *probeSource) Lost() <-chan bpf.LostSamples {
+	return ps.consumers.lost
+}
+
+// Stats returns a snapshot copy of the probe's statistics.
+func (ps *probeSource) Stats() bpf.ProbeStats {
+	return ps.current().Stats()
+}
+
+// Config returns the probe's effective configuration.
+func (ps *probeSource) Config() bpf.Config {
+	return ps.current().Config()
+}
+
+// Reconfigure replaces the rate curves and filter of the probe.
+func (ps *probeSource) Reconfigure(cfg bpf.Config) error {
+	return ps.current().Reconfigure(cfg)
+}
+
+// errorWorker logs the errors reported by the given Probe and restarts it
+// when it stops reading events from the kernel. Exits when the Probe is stopped.
+func (ps *probeSource) errorWorker(ap *bpf.Probe) {
+
+	for err := range ap.Errors() {
+		re, ok := err.(*bpf.ReadError)
+		if !ok || !re.Fatal {
+			log.Warn("Error reading events from probe: ", err)
+			continue
+		}
+
+		log.Error("Accounting probe failed: ", err)
+
+		if err := ps.restart(ap); err != nil {
+			log.Error("Not restarting accounting probe, no longer receiving events: ", err)
+		}
+	}
+}
+
+// restart replaces the failed Probe old with a new Probe using the same
+// configuration, and moves the source's consumers over to it. Gives up after
+// probeRestartLimit restarts, since the failure is unlikely to be transient.
+func (ps *probeSource) restart(old *bpf.Probe) error {
+
+	ps.probeMu.Lock()
+	defer ps.probeMu.Unlock()
+
+	// The source was stopped or the probe was already replaced.
+	if ps.stopped || ps.probe != old {
+		return nil
+	}
+
+	if atomic.LoadUint64(&ps.stats.ProbeRestarts) >= probeRestartLimit {
+		return errProbeRestartLimit
+	}
+
+	// Never stop the failed probe again, even if it cannot be replaced.
+	ps.running = false
+	if err := old.Stop(); err != nil {
+		log.Warn("Error stopping failed accounting probe: ", err)
+	}
+
+	ap, err := bpf.NewProbe(old.Config())
+	if err != nil {
+		return errors.Wrap(err, "initializing BPF probe")
+	}
+
+	if err := ps.consumers.register(ap); err != nil {
+		_ = ap.Close()
+		return errors.Wrap(err, "registering to probe")
+	}
+
+	if err := ap.Start(); err != nil {
+		// Unregister the consumers without closing them, they are
+		// closed along with the failed probe when the source is stopped.
+		_ = ap.Close()
+		return errors.Wrap(err, "starting probe")
+	}
+
+	ps.probe = ap
+	ps.running = true
+	ps.stats.incrProbeRestarts()
+
+	go ps.errorWorker(ap)
+
+	log.Info("Restarted accounting probe")
+
+	return nil
+}
@@ -0,0 +1,82 @@
+package pipeline
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// testSource is an EventSource delivering the batches sent on its channels.
+type testSource struct {
+	name     string
+	updates  chan []bpf.Event
+	destroys chan []bpf.Event
+	started  bool
+}
+
+func newTestSource(name string) *testSource {
+	return &testSource{
+		name:     name,
+		updates:  make(chan []bpf.Event, 1),
+		destroys: make(chan []bpf.Event, 1),
+	}
+}
+
+func (ts *testSource) Name() string                 { return ts.name }
+func (ts *testSource) Updates() <-chan []bpf.Event  { return ts.updates }
+func (ts *testSource) Destroys() <-chan []bpf.Event { return ts.destroys }
+func (ts *testSource) Lost() <-chan bpf.LostSamples { return nil }
+func (ts *testSource) Stats() bpf.ProbeStats        { return bpf.ProbeStats{Transport: ts.name} }
+
+func (ts *testSource) Start() error {
+	ts.started = true
+	return nil
+}
+
+func (ts *testSource) Stop() error {
+	close(ts.updates)
+	close(ts.destroys)
+	return nil
+}
+
+func TestPipelineSources(t *testing.T) {
+
+	p := New()
+	assert.Equal(t, errAcctNotInitialized, p.Start())
+
+	a, b := newTestSource("a"), newTestSource("b")
+	require.NoError(t, p.AddSource(a))
+	assert.Equal(t, errDupSource, p.AddSource(newTestSource("a")))
+	assert.Equal(t, errSourceNil, p.AddSource(nil))
+
+	require.NoError(t, p.Start())
+	assert.True(t, a.started)
+
+	// Sources attached to a running pipeline are started immediately.
+	require.NoError(t, p.AddSource(b))
+	assert.True(t, b.started)
+
+	// Events of all sources are received side by side.
+	a.updates <- []bpf.Event{{}, {}}
+	b.updates <- []bpf.Event{{}}
+	b.destroys <- []bpf.Event{{}}
+
+	for i := 0; i < 1000; i++ {
+		if s := p.Stats(); s.EventsUpdate == 3 && s.EventsDestroy == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	s := p.Stats()
+	assert.EqualValues(t, 3, s.EventsUpdate)
+	assert.EqualValues(t, 1, s.EventsDestroy)
+
+	assert.Len(t, p.SourceStats(), 2)
+	assert.Equal(t, "b", p.SourceStats()["b"].Transport)
+
+	require.NoError(t, p.Stop())
+}
@@ -2,6 +2,7 @@ package pipeline
 
 import (
 	"sync/atomic"
+	"time"
 
 	"github.com/ti-mo/conntracct/pkg/bpf"
 )
@@ -10,11 +11,21 @@ import (
 // data processing pipeline.
 type Stats struct {
 
-	// amount of event structs received from kernel
+	// amount of events received from all sources
 	EventsTotal   uint64 `json:"events_total"`
 	EventsUpdate  uint64 `json:"events_update"`
 	EventsDestroy uint64 `json:"events_destroy"`
 
+	// amount of gaps in the event stream caused by samples lost in the kernel,
+	// the amount of samples lost and the time of the last gap in unix nanoseconds
+	Gaps        uint64 `json:"gaps"`
+	SamplesLost uint64 `json:"samples_lost"`
+	LastGap     int64  `json:"last_gap"`
+
+	// amount of times the probe was restarted after failing
+	ProbeRestarts uint64 `json:"probe_restarts"`
+
+	// statistics of the consumers of the source created from the probe configuration
 	UpdateSourceStats  *bpf.ConsumerStats `json:"update_source"`
 	DestroySourceStats *bpf.ConsumerStats `json:"destroy_source"`
 }
@@ -38,6 +49,32 @@ func (s *Stats) IncrEventsDestroy() {
 	s.incrEventsTotal()
 }
 
+// AddEventsUpdate atomically increases the amount of update events
+// received from event sources by n.
+func (s *Stats) AddEventsUpdate(n int) {
+	atomic.AddUint64(&s.EventsUpdate, uint64(n))
+	atomic.AddUint64(&s.EventsTotal, uint64(n))
+}
+
+// AddEventsDestroy atomically increases the amount of destroy events
+// received from event sources by n.
+func (s *Stats) AddEventsDestroy(n int) {
+	atomic.AddUint64(&s.EventsDestroy, uint64(n))
+	atomic.AddUint64(&s.EventsTotal, uint64(n))
+}
+
+// addGap atomically records a gap of count lost samples at the given time.
+func (s *Stats) addGap(count uint64, t time.Time) {
+	atomic.AddUint64(&s.Gaps, 1)
+	atomic.AddUint64(&s.SamplesLost, count)
+	atomic.StoreInt64(&s.LastGap, t.UnixNano())
+}
+
+// incrProbeRestarts atomically increases the probe restart counter by one.
+func (s *Stats) incrProbeRestarts() {
+	atomic.AddUint64(&s.ProbeRestarts, 1)
+}
+
 // Get returns a copy of the Stats structure created using atomic loads.
 // The values can be inconsistent with each other, as they are written and
 // read concurrently without locks.
@@ -47,6 +84,10 @@ func (s *Stats) Get() Stats {
 		EventsTotal:   atomic.LoadUint64(&s.EventsTotal),
 		EventsUpdate:  atomic.LoadUint64(&s.EventsUpdate),
 		EventsDestroy: atomic.LoadUint64(&s.EventsDestroy),
+		Gaps:          atomic.LoadUint64(&s.Gaps),
+		SamplesLost:   atomic.LoadUint64(&s.SamplesLost),
+		LastGap:       atomic.LoadInt64(&s.LastGap),
+		ProbeRestarts: atomic.LoadUint64(&s.ProbeRestarts),
 	}
 
 	// Get Update source stats if present.
@@ -43,6 +43,23 @@ func (d *Dummy) PushDestroy(e bpf.Event) {
 	d.stats.IncrDestroyEventsDropped()
 }
 
+// PushUpdateBatch sends a batch of update events into the abyss.
+func (d *Dummy) PushUpdateBatch(es []bpf.Event) {
+	for _, e := range es {
+		d.PushUpdate(e)
+	}
+}
+
+// PushDestroyBatch sends a batch of destroy events into the abyss.
+func (d *Dummy) PushDestroyBatch(es []bpf.Event) {
+	for _, e := range es {
+		d.PushDestroy(e)
+	}
+}
+
+// PushGap ignores the gap marker.
+func (d *Dummy) PushGap(l bpf.LostSamples) {}
+
 // Name gets the name of the Dummy.
 func (d *Dummy) Name() string {
 	return d.config.Name
@@ -8,8 +8,8 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-// batch is a batch of events.
-type batch []*event
+// batch is a batch of bulk requests, holding events and gap markers.
+type batch []elastic.BulkableRequest
 
 // newBatch allocates a new InfluxDB point batch to the sink structure.
 func (s *ElasticSink) newBatch() {
@@ -18,23 +18,46 @@ func (s *ElasticSink) newBatch() {
 	s.stats.SetBatchLength(0)
 }
 
-// addBatchEvent adds the given event to the current batch.
+// addBatchEvents adds the given events to the current batch.
 // If the operation causes the batch watermark to be reached,
 // the batch is flushed. Do not call while holding batchMu.
-func (s *ElasticSink) addBatchEvent(e *event) {
+func (s *ElasticSink) addBatchEvents(es ...*event) {
+
+	reqs := make([]elastic.BulkableRequest, 0, len(es))
+	for _, e := range es {
+		reqs = append(reqs,
+			elastic.NewBulkUpdateRequest().
+				// Use ES as a latest value store, update the flow's document
+				// with the latest counters on each incoming event.
+				DocAsUpsert(true).
+				Id(s.docID(e)).
+				Doc(e).
+				RetryOnConflict(1),
+		)
+	}
+
+	s.addBatchRequests(reqs...)
+}
+
+// addBatchRequests adds the given bulk requests to the current batch.
+// If the operation causes the batch watermark to be reached,
+// the batch is flushed. Do not call while holding batchMu.
+func (s *ElasticSink) addBatchRequests(reqs ...elastic.BulkableRequest) {
 
 	s.batchMu.Lock()
 
-	// Add the given point to the current batch.
-	s.batch = append(s.batch, e)
+	for _, r := range reqs {
+		// Add the given request to the current batch.
+		s.batch = append(s.batch, r)
 
-	// Record the current batch length.
-	batchLen := len(s.batch)
-	s.stats.SetBatchLength(batchLen)
+		// Record the current batch length.
+		batchLen := len(s.batch)
+		s.stats.SetBatchLength(batchLen)
 
-	// Flush the batch when the watermark is reached.
-	if batchLen >= int(s.config.BatchSize) {
-		s.flushBatch()
+		// Flush the batch when the watermark is reached.
+		if batchLen >= int(s.config.BatchSize) {
+			s.flushBatch()
+		}
 	}
 
 	s.batchMu.Unlock()
@@ -70,22 +93,8 @@ func (s *ElasticSink) sendBatch(b batch) {
 	// Create an elastic bulk request.
 	bulk := s.client.Bulk().Index(s.config.Database)
 
-	// Create index requests for each event in the batch.
-	reqs := make([]elastic.BulkableRequest, 0, len(b))
-	for _, e := range b {
-		reqs = append(reqs,
-			elastic.NewBulkUpdateRequest().
-				// Use ES as a latest value store, update the flow's document
-				// with the latest counters on each incoming event.
-				DocAsUpsert(true).
-				Id(strconv.FormatUint(uint64(e.FlowID), 10)).
-				Doc(e).
-				RetryOnConflict(1),
-		)
-	}
-
-	// Add all index requests to the bulk request.
-	bulk.Add(reqs...)
+	// Add all requests in the batch to the bulk request.
+	bulk.Add(b...)
 
 	// Send the request.
 	resp, err := bulk.Do(context.Background())
@@ -112,3 +121,12 @@ func (s *ElasticSink) sendBatch(b batch) {
 		}
 	}
 }
+
+// docID returns the ID of the document holding the event's flow.
+// Uses the 64-bit flow ID if configured, the 32-bit one otherwise.
+func (s *ElasticSink) docID(e *event) string {
+	if s.config.FlowID64 {
+		return strconv.FormatUint(e.FlowID64, 10)
+	}
+	return strconv.FormatUint(uint64(e.FlowID), 10)
+}
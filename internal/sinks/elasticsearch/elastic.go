@@ -2,6 +2,7 @@ package elasticsearch
 
 import (
 	"context"
+	"os"
 	"strings"
 	"sync"
 	"time"
@@ -103,7 +104,7 @@ func (s *ElasticSink) PushUpdate(e bpf.Event) {
 	}
 
 	s.transformEvent(&ee)
-	s.addBatchEvent(&ee)
+	s.addBatchEvents(&ee)
 }
 
 // PushDestroy pushes a destroy event into the buffer of the ElasticSearch accounting sink.
@@ -116,7 +117,52 @@ func (s *ElasticSink) PushDestroy(e bpf.Event) {
 	}
 
 	s.transformEvent(&ee)
-	s.addBatchEvent(&ee)
+	s.addBatchEvents(&ee)
+}
+
+// PushUpdateBatch pushes a batch of update events into the buffer of the ElasticSearch accounting sink.
+func (s *ElasticSink) PushUpdateBatch(es []bpf.Event) {
+	s.addBatchEvents(s.events(es, "established")...)
+}
+
+// PushDestroyBatch pushes a batch of destroy events into the buffer of the ElasticSearch accounting sink.
+func (s *ElasticSink) PushDestroyBatch(es []bpf.Event) {
+	s.addBatchEvents(s.events(es, "finished")...)
+}
+
+// events wraps and transforms a list of BPF events with the given state.
+func (s *ElasticSink) events(es []bpf.Event, state string) []*event {
+	out := make([]*event, 0, len(es))
+	for _, e := range es {
+		// Copy the event, transformEvent modifies it and the batch
+		// is shared with other sinks.
+		e := e
+		ee := event{
+			State: state,
+			Event: &e,
+		}
+		s.transformEvent(&ee)
+		out = append(out, &ee)
+	}
+	return out
+}
+
+// PushGap pushes a document marking a gap in the flow data caused by events
+// lost in the kernel into the buffer of the ElasticSearch accounting sink.
+func (s *ElasticSink) PushGap(l bpf.LostSamples) {
+
+	hostname, _ := os.Hostname()
+
+	g := gap{
+		State:     "gap",
+		Hostname:  hostname,
+		Timestamp: uint64(l.Time.UnixNano() / int64(time.Millisecond)),
+		Lost:      l.Count,
+		Buffer:    l.Buffer.String(),
+		CPU:       l.CPU,
+	}
+
+	s.addBatchRequests(elastic.NewBulkIndexRequest().Doc(g))
 }
 
 // IsInit returns true if the ElasticSearch accounting sink was successfully initialized.
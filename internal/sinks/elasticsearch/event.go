@@ -1,6 +1,7 @@
 package elasticsearch
 
 import (
+	"net"
 	"os"
 	"time"
 
@@ -24,9 +25,33 @@ type event struct {
 	*bpf.Event
 
 	// Calculated fields.
-	PacketsTotal uint64 `json:"packets_total"`
-	BytesTotal   uint64 `json:"bytes_total"`
-	ProtoName    string `json:"proto_name"`
+	PacketsTotal uint64   `json:"packets_total"`
+	BytesTotal   uint64   `json:"bytes_total"`
+	ProtoName    string   `json:"proto_name"`
+	StatusFlags  []string `json:"status_flags"`
+	TCPStateName string   `json:"tcp_state_name,omitempty"`
+	CommunityID  string   `json:"community_id,omitempty"`
+
+	// Translated endpoints, only set when NAT was applied to the flow.
+	NATSrcAddr net.IP `json:"nat_src_addr,omitempty"`
+	NATSrcPort uint16 `json:"nat_src_port,omitempty"`
+	NATDstAddr net.IP `json:"nat_dst_addr,omitempty"`
+	NATDstPort uint16 `json:"nat_dst_port,omitempty"`
+}
+
+// gap is a document marking a time window with missing flow data,
+// caused by events lost in the kernel.
+type gap struct {
+	// Always 'gap'.
+	State    string `json:"flow_state"`
+	Hostname string `json:"hostname"`
+
+	// Time the loss was detected, in milliseconds.
+	Timestamp uint64 `json:"timestamp"`
+
+	Lost   uint64 `json:"lost"`
+	Buffer string `json:"buffer"`
+	CPU    int    `json:"cpu"`
 }
 
 // transformEvent applies transformations on an event before
@@ -57,4 +82,22 @@ func (s *ElasticSink) transformEvent(e *event) {
 	e.PacketsTotal = e.PacketsOrig + e.PacketsRet
 	e.BytesTotal = e.BytesOrig + e.BytesRet
 	e.ProtoName = helpers.ProtoIntStr(e.Proto)
+	e.StatusFlags = e.Status.Flags()
+	if e.Proto == 6 {
+		e.TCPStateName = e.TCPState.String()
+	}
+	if s.config.CommunityID {
+		e.CommunityID = e.Event.CommunityID(s.config.CommunityIDSeed)
+	}
+
+	// The translated source of a flow is the destination of its reply
+	// direction, and the translated destination is the reply's source.
+	if e.SrcNAT {
+		e.NATSrcAddr = e.ReplyDstAddr
+		e.NATSrcPort = e.ReplyDstPort
+	}
+	if e.DstNAT {
+		e.NATDstAddr = e.ReplySrcAddr
+		e.NATDstPort = e.ReplySrcPort
+	}
 }
@@ -21,6 +21,8 @@ func (s *ElasticSink) installMappings(db string) error {
 		"mappings":{
 			"properties":{
 				"flow_id": { "type":"keyword" },
+				"flow_id64": { "type":"keyword" },
+				"community_id": { "type":"keyword" }, // Calculated field.
 				"bytes_orig": { "type":"long" },
 				"bytes_ret": { "type":"long" },
 				"bytes_total": { "type":"long" }, // Calculated field.
@@ -32,7 +34,30 @@ func (s *ElasticSink) installMappings(db string) error {
 				"src_port": { "type":"integer" },
 				"dst_addr": { "type":"ip" },
 				"dst_port": { "type":"integer" },
+				"icmp_type": { "type":"short" },
+				"icmp_code": { "type":"short" },
+				"icmp_id": { "type":"integer" },
 				"netns": { "type":"long" },
+				"family": { "type":"short" },
+				"status": { "type":"long" },
+				"status_flags": { "type":"keyword" }, // Calculated field.
+				"tcp_state": { "type":"short" },
+				"tcp_state_name": { "type":"keyword" }, // Calculated field.
+				"zone": { "type":"integer" },
+				"lost": { "type":"long" }, // Gap markers.
+				"buffer": { "type":"keyword" }, // Gap markers.
+				"cpu": { "type":"short" }, // Gap markers.
+				"reply_src_addr": { "type":"ip" },
+				"reply_src_port": { "type":"integer" },
+				"reply_dst_addr": { "type":"ip" },
+				"reply_dst_port": { "type":"integer" },
+				"src_nat": { "type":"boolean" },
+				"dst_nat": { "type":"boolean" },
+				"existing": { "type":"boolean" },
+				"nat_src_addr": { "type":"ip" }, // Calculated field.
+				"nat_src_port": { "type":"integer" }, // Calculated field.
+				"nat_dst_addr": { "type":"ip" }, // Calculated field.
+				"nat_dst_port": { "type":"integer" }, // Calculated field.
 				// Using normal (millisecond) date instead of date_nanos.
 				// Nanosecond-resolution unix timestamps cannot be ingested.
 				// https://github.com/elastic/elasticsearch/issues/43917
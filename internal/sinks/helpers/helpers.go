@@ -1,7 +1,7 @@
 package helpers
 
 // ProtoIntStr is a fast conversion of a protocol number into a string.
-// Only the types known in nf_conntrack_tuple_common.h are included.
+// Only the types known in nf_conntrack_tuple_common.h and ICMPv6 are included.
 func ProtoIntStr(i uint8) string {
 	switch i {
 	case 1:
@@ -14,8 +14,12 @@ func ProtoIntStr(i uint8) string {
 		return "dccp"
 	case 47:
 		return "gre"
+	case 58:
+		return "icmpv6"
 	case 132:
 		return "sctp"
+	case 136:
+		return "udplite"
 	}
 
 	return "unknown"
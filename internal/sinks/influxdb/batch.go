@@ -20,23 +20,25 @@ func (s *InfluxSink) newBatch() {
 	s.stats.SetBatchLength(0)
 }
 
-// addBatchPoint adds the given point to the current batch.
+// addBatchPoints adds the given points to the current batch.
 // If the operation causes the batch watermark to be reached,
 // the batch is flushed. Do not call while holding batchMu.
-func (s *InfluxSink) addBatchPoint(pt *influx.Point) {
+func (s *InfluxSink) addBatchPoints(pts ...*influx.Point) {
 
 	s.batchMu.Lock()
 
-	// Add the given point to the current batch.
-	s.batch.AddPoint(pt)
+	for _, pt := range pts {
+		// Add the given point to the current batch.
+		s.batch.AddPoint(pt)
 
-	// Record the current batch length.
-	batchLen := len(s.batch.Points())
-	s.stats.SetBatchLength(batchLen)
+		// Record the current batch length.
+		batchLen := len(s.batch.Points())
+		s.stats.SetBatchLength(batchLen)
 
-	// Flush the batch when the watermark is reached.
-	if batchLen >= int(s.config.BatchSize) {
-		s.flushBatch()
+		// Flush the batch when the watermark is reached.
+		if batchLen >= int(s.config.BatchSize) {
+			s.flushBatch()
+		}
 	}
 
 	s.batchMu.Unlock()
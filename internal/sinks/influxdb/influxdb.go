@@ -140,17 +140,74 @@ func (s *InfluxSink) PushDestroy(e bpf.Event) {
 	s.stats.IncrDestroyEventsPushed()
 }
 
+// PushUpdateBatch pushes a batch of update events into the buffer of the InfluxDB accounting sink.
+func (s *InfluxSink) PushUpdateBatch(es []bpf.Event) {
+	s.addBatchPoints(s.points(es)...)
+	for range es {
+		s.stats.IncrUpdateEventsPushed()
+	}
+}
+
+// PushDestroyBatch pushes a batch of destroy events into the buffer of the InfluxDB accounting sink.
+func (s *InfluxSink) PushDestroyBatch(es []bpf.Event) {
+	s.addBatchPoints(s.points(es)...)
+	for range es {
+		s.stats.IncrDestroyEventsPushed()
+	}
+}
+
 func (s *InfluxSink) push(e bpf.Event) {
+	s.addBatchPoints(s.point(e))
+}
+
+// points converts a list of events to InfluxDB points.
+func (s *InfluxSink) points(es []bpf.Event) []*influx.Point {
+	pts := make([]*influx.Point, 0, len(es))
+	for _, e := range es {
+		pts = append(pts, s.point(e))
+	}
+	return pts
+}
+
+// point converts an event to an InfluxDB point.
+func (s *InfluxSink) point(e bpf.Event) *influx.Point {
+
+	// Identify flows by their 64-bit flow ID if configured.
+	flowID := strconv.FormatUint(uint64(e.FlowID), 10)
+	if s.config.FlowID64 {
+		flowID = strconv.FormatUint(e.FlowID64, 10)
+	}
 
 	// Create a point and add to batch.
 	tags := map[string]string{
-		"flow_id":  strconv.FormatUint(uint64(e.FlowID), 10),
+		"flow_id":  flowID,
 		"src_addr": e.SrcAddr.String(),
 		"dst_addr": e.DstAddr.String(),
 		"dst_port": strconv.FormatUint(uint64(e.DstPort), 10),
 		"proto":    helpers.ProtoIntStr(e.Proto),
 		"connmark": strconv.FormatUint(uint64(e.Connmark), 16),
 		"netns":    strconv.FormatUint(uint64(e.NetNS), 10),
+		"zone":     strconv.FormatUint(uint64(e.Zone), 10),
+	}
+
+	// Tag values cannot be empty.
+	if e.Status != 0 {
+		tags["status"] = e.Status.String()
+	}
+
+	// Allow distinguishing half-open and failed TCP connections.
+	if e.Proto == 6 {
+		tags["tcp_state"] = e.TCPState.String()
+	}
+
+	// ICMP and ICMPv6 flows have no ports, tag their type and code instead.
+	// Like source ports, echo identifiers are random in most cases.
+	if e.Proto == 1 || e.Proto == 58 {
+		tags["icmp_type"] = strconv.FormatUint(uint64(e.ICMPType), 10)
+		tags["icmp_code"] = strconv.FormatUint(uint64(e.ICMPCode), 10)
+		if s.config.SourcePorts {
+			tags["icmp_id"] = strconv.FormatUint(uint64(e.ICMPID), 10)
+		}
 	}
 
 	// Optionally set flows' source ports (since they're random in most cases)
@@ -158,13 +215,27 @@ func (s *InfluxSink) push(e bpf.Event) {
 		tags["src_port"] = strconv.FormatUint(uint64(e.SrcPort), 10)
 	}
 
+	// Translated endpoints are only tagged when NAT was applied, since they
+	// would otherwise repeat the original tuple. The translated source is the
+	// reply direction's destination and vice versa.
+	if e.SrcNAT {
+		tags["nat_src_addr"] = e.ReplyDstAddr.String()
+		if s.config.SourcePorts {
+			tags["nat_src_port"] = strconv.FormatUint(uint64(e.ReplyDstPort), 10)
+		}
+	}
+	if e.DstNAT {
+		tags["nat_dst_addr"] = e.ReplySrcAddr.String()
+		tags["nat_dst_port"] = strconv.FormatUint(uint64(e.ReplySrcPort), 10)
+	}
+
 	// https://github.com/influxdata/influxdb/issues/7801
 	// The InfluxDB wire protocol and Go client supports uints and will mark them as such,
 	// though the current version (1.6) has this behind a build flag as it's not yet
 	// generally available. Only send signed ints for now until this is more widely deployed.
 	fields := map[string]interface{}{
 		// Include flow_id in both fields and tags so it can be used in both aggregations and selections.
-		"flow_id":       strconv.FormatUint(uint64(e.FlowID), 10),
+		"flow_id":       flowID,
 		"bytes_orig":    int64(e.BytesOrig),
 		"bytes_ret":     int64(e.BytesRet),
 		"bytes_total":   int64(e.BytesOrig + e.BytesRet),
@@ -173,6 +244,12 @@ func (s *InfluxSink) push(e bpf.Event) {
 		"packets_total": int64(e.PacketsOrig + e.PacketsRet),
 	}
 
+	// Community IDs are unique per flow, store them as a field to avoid
+	// high series cardinality.
+	if s.config.CommunityID {
+		fields["community_id"] = e.CommunityID(s.config.CommunityIDSeed)
+	}
+
 	// To obtain the absolute time stamp of an event in kernel space,
 	// we add its (monotonic) time stamp to the estimated boot time of the kernel.
 	ts := time.Unix(0, boottime.Absolute(int64(e.Timestamp)))
@@ -182,8 +259,28 @@ func (s *InfluxSink) push(e bpf.Event) {
 		panic(err.Error())
 	}
 
-	// Add the point to the batch.
-	s.addBatchPoint(pt)
+	return pt
+}
+
+// PushGap pushes a marker of lost events into the buffer of the InfluxDB
+// accounting sink, written to the 'ct_gap' measurement.
+func (s *InfluxSink) PushGap(l bpf.LostSamples) {
+
+	tags := map[string]string{
+		"buffer": l.Buffer.String(),
+		"cpu":    strconv.Itoa(l.CPU),
+	}
+
+	fields := map[string]interface{}{
+		"lost": int64(l.Count),
+	}
+
+	pt, err := influx.NewPoint("ct_gap", tags, fields, l.Time)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	s.addBatchPoints(pt)
 }
 
 // Name gets the name of the InfluxDB accounting sink.
@@ -35,6 +35,14 @@ type Sink interface {
 	PushUpdate(bpf.Event)
 	// Push a destroy event to the sink driver. Implementation must be thread-safe.
 	PushDestroy(bpf.Event)
+	// Push a batch of update events to the sink driver. Implementation must be thread-safe.
+	PushUpdateBatch([]bpf.Event)
+	// Push a batch of destroy events to the sink driver. Implementation must be thread-safe.
+	PushDestroyBatch([]bpf.Event)
+	// Push a marker of events lost in the kernel to the sink driver,
+	// so the affected time window can be recognized as incomplete.
+	// Implementation must be thread-safe.
+	PushGap(bpf.LostSamples)
 
 	// Get a snapshot copy of the sink's performance statistics.
 	Stats() types.SinkStats
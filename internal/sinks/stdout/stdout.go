@@ -27,6 +27,9 @@ type StdOut struct {
 	updates  chan bpf.Event
 	destroys chan bpf.Event
 
+	// Gap markers, rare enough to not need a large buffer.
+	gaps chan bpf.LostSamples
+
 	// Stdout/err writer.
 	writer *bufio.Writer
 }
@@ -60,6 +63,7 @@ func (s *StdOut) Init(sc config.SinkConfig) error {
 
 	s.updates = make(chan bpf.Event, sc.BatchSize)
 	s.destroys = make(chan bpf.Event, sc.BatchSize)
+	s.gaps = make(chan bpf.LostSamples, 16)
 	s.config = sc
 
 	go s.outWorker()
@@ -92,6 +96,29 @@ func (s *StdOut) PushDestroy(e bpf.Event) {
 	}
 }
 
+// PushUpdateBatch pushes a batch of update events into the buffer of the StdOut accounting sink.
+func (s *StdOut) PushUpdateBatch(es []bpf.Event) {
+	for _, e := range es {
+		s.PushUpdate(e)
+	}
+}
+
+// PushDestroyBatch pushes a batch of destroy events into the buffer of the StdOut accounting sink.
+func (s *StdOut) PushDestroyBatch(es []bpf.Event) {
+	for _, e := range es {
+		s.PushDestroy(e)
+	}
+}
+
+// PushGap pushes a marker of lost events into the buffer of the StdOut accounting sink.
+func (s *StdOut) PushGap(l bpf.LostSamples) {
+	// Non-blocking send on gap channel.
+	select {
+	case s.gaps <- l:
+	default:
+	}
+}
+
 // Name gets the name of the StdOut.
 func (s *StdOut) Name() string {
 	return s.config.Name
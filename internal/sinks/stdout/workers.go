@@ -18,9 +18,20 @@ func (s *StdOut) outWorker() {
 			_, _ = s.writer.WriteString("Update: ")
 		case e = <-s.destroys:
 			_, _ = s.writer.WriteString("Destroy: ")
+		case l := <-s.gaps:
+			_, _ = s.writer.WriteString("Gap: " + l.String() + "\n")
+			if err := s.writer.Flush(); err != nil {
+				log.Errorf("StdOut sink '%s': error flushing writer: %s", s.config.Name, err)
+			}
+			continue
+		}
+
+		out := e.String()
+		if s.config.CommunityID {
+			out += " CommunityID:" + e.CommunityID(s.config.CommunityIDSeed)
 		}
 
-		if _, err := s.writer.WriteString(e.String() + "\n"); err != nil {
+		if _, err := s.writer.WriteString(out + "\n"); err != nil {
 			s.stats.IncrBatchDropped()
 			log.Errorf("StdOut sink '%s': error writing: %s", s.config.Name, err)
 			continue
@@ -7,6 +7,17 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// Get returns the value of the given sysctl.
+func Get(ctl string) (string, error) {
+
+	v, err := sysctl.Get(ctl)
+	if err != nil {
+		return "", errors.Wrap(err, errSysctlGet)
+	}
+
+	return v, nil
+}
+
 // Apply sets a given map of sysctls on the machine.
 func Apply(ctls map[string]string, verbose bool) error {
 
@@ -24,6 +24,16 @@ const (
 	bpfAcctProbe     = "bpf/acct.c"
 )
 
+// bpfAcctVariants maps object name suffixes of the acct probe to the
+// preprocessor definitions they are built with. Suffixes need to match
+// the ones expected by pkg/bpf's probe selector.
+var bpfAcctVariants = map[string][]string{
+	// Perf event array transport, supported by all target kernels.
+	"": nil,
+	// BPF ring buffer transport, supported by kernels 5.8 and up.
+	"-ringbuf": {"-DACCT_RINGBUF"},
+}
+
 // Bpf is the namespace for all BPF-related build tasks.
 type Bpf mg.Namespace
 
@@ -71,33 +81,46 @@ func (Bpf) Build() error {
 
 	fmt.Println("Building eBPF programs ..")
 
-	// Build the acct probe against all Kernels defined in the kernel package.
+	// Build the acct probe against all Kernels defined in the kernel package,
+	// and a variant resolving kernel struct offsets from BTF at load time.
+	// Each kernel gets a perf event array and a ring buffer variant of the probe.
+	kernels := []kernel.Kernel{kernel.BTF}
 	for _, k := range kernel.Builds {
+		kernels = append(kernels, k)
+	}
 
-		// Name of the resulting BPF object file.
-		bpfObjectName := fmt.Sprintf("%s.o", k.Version)
+	for _, k := range kernels {
+		for suffix, defines := range bpfAcctVariants {
 
-		// Target path for the compiled BPF object.
-		bpfObjectPath := path.Join(bpfAcctBuildPath, bpfObjectName)
+			if k.BTF {
+				defines = append([]string{"-DACCT_BTF"}, defines...)
+			}
 
-		// Check if the acct probe source is newer than the probe's object in the build directory.
-		run, err := target.Path(bpfObjectPath, bpfAcctProbe)
-		if err != nil {
-			return err
-		}
+			// Name of the resulting BPF object file.
+			bpfObjectName := fmt.Sprintf("%s%s.o", k.Version, suffix)
 
-		// Skip this build if the object is newer than the source.
-		if !run {
-			fmt.Println("Acct probe is up-to-date:", bpfObjectPath)
-			continue
-		}
+			// Target path for the compiled BPF object.
+			bpfObjectPath := path.Join(bpfAcctBuildPath, bpfObjectName)
 
-		if err := buildProbe(bpfAcctProbe, bpfObjectPath, k.Directory()); err != nil {
-			fmt.Println("Failed to build probe against kernel", k.Version)
-			return err
-		}
+			// Check if the acct probe source is newer than the probe's object in the build directory.
+			run, err := target.Path(bpfObjectPath, bpfAcctProbe)
+			if err != nil {
+				return err
+			}
 
-		fmt.Println("Built acct probe", bpfObjectName)
+			// Skip this build if the object is newer than the source.
+			if !run {
+				fmt.Println("Acct probe is up-to-date:", bpfObjectPath)
+				continue
+			}
+
+			if err := buildProbe(bpfAcctProbe, bpfObjectPath, k.Directory(), defines...); err != nil {
+				fmt.Println("Failed to build probe against kernel", k.Version)
+				return err
+			}
+
+			fmt.Println("Built acct probe", bpfObjectName)
+		}
 	}
 
 	// Bundle the BPF objects into the binary using statik.
@@ -145,7 +168,8 @@ func (Bpf) Kernels() error {
 
 // buildProbe builds a BPF program given its source file, destination object file
 // and directory of the kernel source tree the program is to be built against.
-func buildProbe(srcFile, dstObj, kernelDir string) error {
+// Any extra arguments are passed to clang, eg. preprocessor definitions.
+func buildProbe(srcFile, dstObj, kernelDir string, extra ...string) error {
 
 	clangParams := []string{
 		"-D__KERNEL__", "-D__BPF_TRACING__",
@@ -177,6 +201,8 @@ func buildProbe(srcFile, dstObj, kernelDir string) error {
 		clangParams = append(clangParams, fmt.Sprintf(d, kernelDir))
 	}
 
+	clangParams = append(clangParams, extra...)
+
 	llcParams := []string{
 		"-march=bpf",
 		"-filetype=obj",
@@ -0,0 +1,232 @@
+package bpf
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Prefix of the names of all trace groups created by conntracct.
+const probeGroupPrefix = "conntracct_"
+
+var (
+	// Sequence number of the last trace group created by this process.
+	probeGroupSeq uint64
+
+	// Trace groups in use by Probes in this process.
+	liveGroupsMu sync.Mutex
+	liveGroups   = make(map[string]bool)
+)
+
+// pidNamespace returns the inode number of the calling process' pid namespace.
+func pidNamespace() uint64 {
+	var st unix.Stat_t
+	if err := unix.Stat("/proc/self/ns/pid", &st); err != nil {
+		return 0
+	}
+	return st.Ino
+}
+
+// probeGroup returns the name of a new trace group for a Probe to create its
+// kprobes in when falling back to tracefs, and marks it as live until it is
+// passed to releaseProbeGroup. Records the pid namespace and pid of the process
+// to allow other instances to detect orphaned groups, followed by a sequence
+// number to keep the kprobes of multiple Probes in one process apart.
+func probeGroup() string {
+
+	g := fmt.Sprintf("%s%d_%d_%d", probeGroupPrefix, pidNamespace(), os.Getpid(),
+		atomic.AddUint64(&probeGroupSeq, 1))
+
+	liveGroupsMu.Lock()
+	liveGroups[g] = true
+	liveGroupsMu.Unlock()
+
+	return g
+}
+
+// releaseProbeGroup marks a trace group returned by probeGroup as no longer
+// in use, allowing cleanupTraceGroups to remove it.
+func releaseProbeGroup(group string) {
+	liveGroupsMu.Lock()
+	delete(liveGroups, group)
+	liveGroupsMu.Unlock()
+}
+
+// parseProbeGroup extracts the pid namespace and pid from a trace group name
+// generated by probeGroup. The sequence number is optional, as it is absent
+// in groups created by older versions. ok is false if the name is not in the
+// expected format.
+func parseProbeGroup(group string) (pidns uint64, pid int, ok bool) {
+
+	f := strings.Split(strings.TrimPrefix(group, probeGroupPrefix), "_")
+	if len(f) != 2 && len(f) != 3 {
+		return 0, 0, false
+	}
+
+	if len(f) == 3 {
+		if _, err := strconv.ParseUint(f[2], 10, 64); err != nil {
+			return 0, 0, false
+		}
+	}
+
+	pidns, err := strconv.ParseUint(f[0], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	pid, err = strconv.Atoi(f[1])
+	if err != nil {
+		return 0, 0, false
+	}
+
+	return pidns, pid, true
+}
+
+// groupOwnerAlive returns true if the trace group was created by a process
+// that is still running. Only processes in the caller's pid namespace can be
+// checked, groups of other namespaces are reported as not alive. Groups
+// carrying the caller's own pid are only alive if they are in use by one of
+// its Probes, others were left behind by a previous process with the same pid.
+func groupOwnerAlive(group string) bool {
+
+	pidns, pid, ok := parseProbeGroup(group)
+	if !ok || pidns != pidNamespace() {
+		return false
+	}
+
+	if pid == os.Getpid() {
+		liveGroupsMu.Lock()
+		defer liveGroupsMu.Unlock()
+		return liveGroups[group]
+	}
+
+	// Signal 0 performs error checking only. EPERM means the process exists,
+	// but belongs to another user.
+	return unix.Kill(pid, 0) != unix.ESRCH
+}
+
+// readTraceGroups parses the kprobe_events file in the given tracefs mount
+// point and returns the names of the events in all conntracct trace groups,
+// indexed by group name.
+func readTraceGroups(tracefs string) (map[string][]string, error) {
+
+	f, err := os.Open(path.Join(tracefs, "kprobe_events"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	groups := make(map[string][]string)
+
+	// Lines look like 'p:<group>/<event> <symbol>'.
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		i := strings.IndexByte(fields[0], ':')
+		if i < 0 {
+			continue
+		}
+
+		ge := strings.SplitN(fields[0][i+1:], "/", 2)
+		if len(ge) != 2 || !strings.HasPrefix(ge[0], probeGroupPrefix) {
+			continue
+		}
+
+		groups[ge[0]] = append(groups[ge[0]], ge[1])
+	}
+
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return groups, nil
+}
+
+// removeTraceGroup removes all events of a trace group from kprobe_events.
+// Returns unix.EBUSY if an event is still in use by a running process.
+func removeTraceGroup(tracefs, group string, events []string) error {
+
+	traceEventsPath := path.Join(tracefs, "kprobe_events")
+
+	f, err := os.OpenFile(traceEventsPath, os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		return fmt.Errorf("cannot open %s: %v", traceEventsPath, err)
+	}
+	defer f.Close()
+
+	for _, e := range events {
+		pe := fmt.Sprintf("-:%s/%s", group, e)
+		if _, err = f.WriteString(pe); err != nil {
+			if perr, ok := err.(*os.PathError); ok && perr.Err == unix.EBUSY {
+				return unix.EBUSY
+			}
+			return fmt.Errorf("writing %q to kprobe_events: %v", pe, err)
+		}
+	}
+
+	return nil
+}
+
+// cleanupTraceGroups removes the conntracct trace groups from tracefs that
+// were left behind by processes that are no longer running. Returns the
+// names of the removed groups.
+func cleanupTraceGroups(tracefs string) ([]string, error) {
+
+	groups, err := readTraceGroups(tracefs)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading kprobe_events")
+	}
+
+	var removed []string
+	for g, events := range groups {
+		if groupOwnerAlive(g) {
+			continue
+		}
+
+		// The kernel refuses to remove events that are still attached to,
+		// which happens when the group's owner could not be determined
+		// and the group is in use by a process in another pid namespace.
+		err := removeTraceGroup(tracefs, g, events)
+		if err == unix.EBUSY {
+			continue
+		}
+		if err != nil {
+			return removed, errors.Wrapf(err, "removing trace group %s", g)
+		}
+
+		removed = append(removed, g)
+	}
+
+	return removed, nil
+}
+
+// CleanupKprobes removes orphaned kprobes left behind in tracefs by conntracct
+// processes that did not shut down cleanly, eg. when killed by SIGKILL. Kprobes
+// owned by running conntracct processes are left untouched. Returns the names
+// of the removed trace groups.
+//
+// Only kprobes created on kernels without a kprobe PMU need cleaning up,
+// those created on the kprobe PMU are removed by the kernel when their
+// owning process exits. Probe.Start calls this automatically before creating
+// kprobes in tracefs.
+func CleanupKprobes() ([]string, error) {
+
+	tracefs, err := tracefsPath()
+	if err != nil {
+		return nil, err
+	}
+
+	return cleanupTraceGroups(tracefs)
+}
@@ -0,0 +1,66 @@
+package bpf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseProbeGroup(t *testing.T) {
+
+	g := probeGroup()
+	defer releaseProbeGroup(g)
+
+	pidns, pid, ok := parseProbeGroup(g)
+	require.True(t, ok)
+	assert.Equal(t, pidNamespace(), pidns)
+	assert.Equal(t, os.Getpid(), pid)
+
+	// Each Probe gets its own group.
+	g2 := probeGroup()
+	assert.NotEqual(t, g, g2)
+
+	// Groups of older versions don't carry a sequence number.
+	_, oldPid, ok := parseProbeGroup("conntracct_1_2")
+	require.True(t, ok)
+	assert.Equal(t, 2, oldPid)
+
+	for _, g := range []string{"conntracct_1a2b3c4d", "conntracct_1_x", "conntracct_1_2_x", "conntracct_1_2_3_4"} {
+		_, _, ok := parseProbeGroup(g)
+		assert.False(t, ok, g)
+	}
+
+	// Groups carrying the calling process' pid are only alive while in use.
+	assert.True(t, groupOwnerAlive(g))
+	assert.True(t, groupOwnerAlive(g2))
+	releaseProbeGroup(g2)
+	assert.False(t, groupOwnerAlive(g2))
+	assert.False(t, groupOwnerAlive(fmt.Sprintf("%s%d_%d", probeGroupPrefix, pidns, pid)))
+}
+
+func TestReadTraceGroups(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "tracefs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	events := `p:conntracct_1_2/kprobe_nf_ct_delete nf_ct_delete
+r16:conntracct_1_2/kretprobe___nf_ct_refresh_acct __nf_ct_refresh_acct
+p:kprobes/p_do_sys_open do_sys_open
+p:conntracct_1a2b3c4d/kprobe_nf_ct_delete nf_ct_delete
+`
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "kprobe_events"), []byte(events), 0644))
+
+	groups, err := readTraceGroups(dir)
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string][]string{
+		"conntracct_1_2":      {"kprobe_nf_ct_delete", "kretprobe___nf_ct_refresh_acct"},
+		"conntracct_1a2b3c4d": {"kprobe_nf_ct_delete"},
+	}, groups)
+}
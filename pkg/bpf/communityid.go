@@ -0,0 +1,97 @@
+package bpf
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+
+	"golang.org/x/sys/unix"
+)
+
+// communityIDVersion is the version prefix of generated Community IDs.
+const communityIDVersion = "1:"
+
+// ICMP and ICMPv6 message types that have a counterpart in the opposite
+// direction, as defined by the Community ID specification. Messages of
+// these types are treated as two-way flows with the types acting as ports.
+var (
+	icmpCounterparts = map[uint8]uint8{
+		0: 8, 8: 0, // Echo Reply, Echo
+		9: 10, 10: 9, // Router Advertisement, Router Solicitation
+		13: 14, 14: 13, // Timestamp, Timestamp Reply
+		15: 16, 16: 15, // Information Request, Information Reply
+		17: 18, 18: 17, // Address Mask Request, Address Mask Reply
+	}
+
+	icmpv6Counterparts = map[uint8]uint8{
+		128: 129, 129: 128, // Echo Request, Echo Reply
+		130: 131, 131: 130, // Multicast Listener Query, Report
+		133: 134, 134: 133, // Router Solicitation, Router Advertisement
+		135: 136, 136: 135, // Neighbor Solicitation, Neighbor Advertisement
+		139: 140, 140: 139, // Node Information Query, Response
+		144: 145, 145: 144, // Home Agent Address Discovery Request, Reply
+	}
+)
+
+// CommunityID returns the Community ID (version 1) of the Event's flow,
+// computed with the given seed. Community IDs are a standardized flow hash,
+// allowing flows to be correlated with the logs of other monitoring tools
+// such as Zeek or Suricata. See https://github.com/corelight/community-id-spec.
+func (e *Event) CommunityID(seed uint16) string {
+
+	src, dst := e.SrcAddr, e.DstAddr
+	if e.Family == unix.AF_INET {
+		src, dst = src.To4(), dst.To4()
+	}
+
+	var sport, dport uint16
+	var ports, oneWay bool
+
+	switch e.Proto {
+	case unix.IPPROTO_TCP, unix.IPPROTO_UDP, unix.IPPROTO_SCTP:
+		sport, dport, ports = e.SrcPort, e.DstPort, true
+	case unix.IPPROTO_ICMP, unix.IPPROTO_ICMPV6:
+		cp := icmpCounterparts
+		if e.Proto == unix.IPPROTO_ICMPV6 {
+			cp = icmpv6Counterparts
+		}
+
+		// Two-way messages use their counterpart's type as the destination
+		// port, one-way messages use their code and are never reordered.
+		sport, ports = uint16(e.ICMPType), true
+		if t, ok := cp[e.ICMPType]; ok {
+			dport = uint16(t)
+		} else {
+			dport, oneWay = uint16(e.ICMPCode), true
+		}
+	}
+
+	// Order the endpoints so both directions of a flow hash the same.
+	if !oneWay {
+		c := bytes.Compare(src, dst)
+		if c > 0 || (c == 0 && sport > dport) {
+			src, dst = dst, src
+			sport, dport = dport, sport
+		}
+	}
+
+	h := sha1.New()
+	b := make([]byte, 4)
+
+	binary.BigEndian.PutUint16(b, seed)
+	_, _ = h.Write(b[:2])
+	_, _ = h.Write(src)
+	_, _ = h.Write(dst)
+
+	// Protocol followed by a padding byte.
+	_, _ = h.Write([]byte{e.Proto, 0})
+
+	if ports {
+		binary.BigEndian.PutUint16(b[0:2], sport)
+		binary.BigEndian.PutUint16(b[2:4], dport)
+		_, _ = h.Write(b)
+	}
+
+	return communityIDVersion + base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,57 @@
+package bpf
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestCommunityID(t *testing.T) {
+
+	tcp := Event{
+		Family:  unix.AF_INET,
+		SrcAddr: net.ParseIP("128.232.110.120"),
+		DstAddr: net.ParseIP("66.35.250.204"),
+		SrcPort: 34855,
+		DstPort: 80,
+		Proto:   unix.IPPROTO_TCP,
+	}
+
+	// Example from the Community ID specification.
+	assert.Equal(t, "1:LQU9qZlK+B5F3KDmev6m5PMibrg=", tcp.CommunityID(0))
+	assert.NotEqual(t, tcp.CommunityID(0), tcp.CommunityID(1))
+
+	// Both directions of a flow have the same ID.
+	rev := tcp
+	rev.SrcAddr, rev.DstAddr = tcp.DstAddr, tcp.SrcAddr
+	rev.SrcPort, rev.DstPort = tcp.DstPort, tcp.SrcPort
+	assert.Equal(t, tcp.CommunityID(0), rev.CommunityID(0))
+
+	// Echo requests and replies are two-way.
+	req := Event{
+		Family:   unix.AF_INET6,
+		SrcAddr:  net.ParseIP("2001:db8::1"),
+		DstAddr:  net.ParseIP("2001:db8::2"),
+		Proto:    unix.IPPROTO_ICMPV6,
+		ICMPType: 128,
+	}
+	rep := req
+	rep.SrcAddr, rep.DstAddr = req.DstAddr, req.SrcAddr
+	rep.ICMPType = 129
+	assert.Equal(t, req.CommunityID(0), rep.CommunityID(0))
+
+	// Destination unreachable is one-way, reversing it changes the ID.
+	unreach := Event{
+		Family:   unix.AF_INET,
+		SrcAddr:  net.ParseIP("192.0.2.2"),
+		DstAddr:  net.ParseIP("192.0.2.1"),
+		Proto:    unix.IPPROTO_ICMP,
+		ICMPType: 3,
+		ICMPCode: 1,
+	}
+	rev = unreach
+	rev.SrcAddr, rev.DstAddr = unreach.DstAddr, unreach.SrcAddr
+	assert.NotEqual(t, unreach.CommunityID(0), rev.CommunityID(0))
+}
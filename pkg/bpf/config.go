@@ -1,25 +1,77 @@
 package bpf
 
 import (
+	"math"
+	"os"
 	"time"
 
 	"github.com/pkg/errors"
 )
 
-var (
-	errCurve0Age = errors.New("Curve point 0's Age needs to be lower than point 1's and point 2's")
-	errCurve1Age = errors.New("Curve point 1's Age needs to be lower than point 2's")
-)
-
 // Config is a configuration object for the acct BPF probe.
 type Config struct {
-	// Curve* are curve points representing update intervals
+	// Curve is a list of curve points representing update intervals
 	// when flows reach a certain age. For example, when a flow
 	// is 0ms old, it will send an event every 20s. When it reaches
 	// an age of 1 minute, it will send an event every 60s, etc.
-	Curve0 CurvePoint
-	Curve1 CurvePoint
-	Curve2 CurvePoint
+	// Ages must be in increasing order. Holds up to curveMaxPoints points.
+	// Used for all flows not matched by any of the curves in Curves.
+	Curve []CurvePoint
+
+	// Curves are additional rate curves, selected by the protocol and
+	// destination port of a flow. Up to curveMaxCurves-1 curves can be
+	// configured, no two curves can match the same flow.
+	Curves []RateCurve
+
+	// Transport selects the mechanism used for delivering events from
+	// the kernel to userspace. Defaults to TransportAuto.
+	Transport Transport
+
+	// RingBufferSize is the size in bytes of the BPF ring buffer shared by
+	// all CPUs. Must be a power of two and a multiple of the page size.
+	RingBufferSize int
+
+	// PerfBufferSize is the size in bytes of each CPU's perf buffer,
+	// rounded up to the nearest multiple of the page size.
+	PerfBufferSize int
+
+	// FlowMapSize is the maximum amount of flows tracked by the probe for
+	// rate limiting. Flows that don't fit are not rate limited and generate
+	// an event for every packet. Defaults to the host's nf_conntrack_max,
+	// or defaultFlowMapSize if it cannot be read.
+	FlowMapSize int
+
+	// ReapHorizon is the time after which the entries a flow occupies in the
+	// flow tracking maps are removed if the flow stops generating events,
+	// eg. because the probe missed its destroy event. Flows are not checked
+	// against the conntrack table, so idle flows that still exist are removed
+	// as well. A flow's age is kept until it stopped generating events for
+	// twice the horizon. Should be longer than the rate curves' longest
+	// interval. Defaults to 6 hours.
+	ReapHorizon time.Duration
+
+	// SeedFlows dumps the host's conntrack table over netlink when the Probe
+	// is started. An update event marked as Existing is delivered for each
+	// flow, and the flows' start timestamps are used as their age when they
+	// are first seen by the probe, instead of guessing it. Requires the
+	// nf_conntrack_netlink kernel module.
+	SeedFlows bool
+
+	// DumpInterval is the interval at which a NetlinkSource dumps the
+	// conntrack table to read the counters of its flows. Update events are
+	// only generated by these dumps, so the intervals of the rate curves are
+	// rounded up to a multiple of it. Not used by the Probe.
+	// Defaults to 10 seconds.
+	DumpInterval time.Duration
+
+	// FlowIDKey is a secret used for keying the 64-bit flow IDs of Events,
+	// making them unpredictable to anyone not knowing the key. The flow IDs
+	// are unkeyed if empty. Cannot be changed after the Probe is created.
+	FlowIDKey string
+
+	// Filter decides which flows are ignored by the probe.
+	// Can be changed at runtime using Probe.SetFilter.
+	Filter Filter
 }
 
 // A CurvePoint represents an age/rate pair.
@@ -40,122 +92,200 @@ type configOffset uint32
 // Enum of indices in the probe's `config` BPF array.
 const (
 	configReady configOffset = iota
-)
-
-// curveOffset represents an offset in the probe's `curve` BPF array.
-// Needs to be a 4 bytes long to be able to be used as a map key.
-type curveOffset uint32
-
-// Enum of indices in the probe's `curve` BPF array.
-const (
-	curve0Age curveOffset = iota
-	curve0Rate
-	curve1Age
-	curve1Rate
-	curve2Age
-	curve2Rate
+	configCIDRInclude
+	configNetNSAllow
+	configProtoAllow
+	configMarkValue
+	configMarkMask
+	configCurveBank
 )
 
 // configure sets configuration values in the probe's config map.
+// The given Config is expected to have defaults applied and to be verified.
 func (ap *Probe) configure(cfg Config) error {
 
 	if ap.collection == nil {
 		panic("nil eBPF collection in probe")
 	}
 
-	// Set sane defaults on the configuration structure.
-	cfg.probeDefaults()
-
-	if err := probeConfigVerify(cfg); err != nil {
-		return errors.Wrap(err, "verifying probe configuration")
-	}
-
 	configMap, ok := ap.collection.Maps["config"]
 	if !ok {
 		return errors.New("map 'config' not found in eBPF collection")
 	}
 
-	curveMap, ok := ap.collection.Maps["config_ratecurve"]
-	if !ok {
-		return errors.New("map 'config_ratecurve' not found in eBPF collection")
+	ap.configMu.Lock()
+	err := ap.configureCurves(cfg.Curve, cfg.Curves)
+	ap.configMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	ap.filterMu.Lock()
+	err = ap.applyFilter(cfg.Filter)
+	ap.filterMu.Unlock()
+	if err != nil {
+		return errors.Wrap(err, "applying filter")
 	}
 
-	if err := curveMap.Put(curve0Age, cfg.Curve0.Age.Nanoseconds()); err != nil {
-		return errors.Wrap(err, "Curve0Age in config_ratecurve")
+	// Write kernel struct offsets for BTF-enabled probes before enabling them.
+	if err := ap.configureOffsets(); err != nil {
+		return err
 	}
 
-	if err := curveMap.Put(curve0Rate, cfg.Curve0.Rate.Nanoseconds()); err != nil {
-		return errors.Wrap(err, "Curve0Rate in config_ratecurve")
+	// Set the ready bit in the probe's config map to make it start sending traffic.
+	if err := configMap.Put(configReady, readyValue); err != nil {
+		return errors.Wrap(err, "configReady in config")
 	}
 
-	if err := curveMap.Put(curve1Age, cfg.Curve1.Age.Nanoseconds()); err != nil {
-		return errors.Wrap(err, "Curve1Age in config_ratecurve")
+	return nil
+}
+
+// Reconfigure replaces the rate curves and filter of a loaded Probe without
+// reloading its BPF program. The state the probe keeps about known flows
+// is preserved, so flows keep their age and current update interval.
+//
+// The new curves are written next to the active ones and swapped in at once,
+// so the probe never evaluates a partially-written curve. The filter is not
+// swapped atomically: its entries are updated one by one while the probe is
+// running, like with SetFilter. If Reconfigure fails, the previous filter and
+// curves are restored. The Probe's Transport, buffer and map sizes,
+// ReapHorizon and FlowIDKey cannot be changed after it is loaded, their
+// values in cfg are ignored.
+func (ap *Probe) Reconfigure(cfg Config) error {
+
+	ap.configMu.Lock()
+	defer ap.configMu.Unlock()
+
+	cfg.Transport = ap.config.Transport
+	cfg.RingBufferSize = ap.config.RingBufferSize
+	cfg.PerfBufferSize = ap.config.PerfBufferSize
+	cfg.FlowMapSize = ap.config.FlowMapSize
+	cfg.ReapHorizon = ap.config.ReapHorizon
+	cfg.FlowIDKey = ap.config.FlowIDKey
+
+	cfg.probeDefaults()
+
+	if err := probeConfigVerify(cfg); err != nil {
+		return errors.Wrap(err, "verifying probe configuration")
 	}
 
-	if err := curveMap.Put(curve1Rate, cfg.Curve1.Rate.Nanoseconds()); err != nil {
-		return errors.Wrap(err, "Curve1Rate in config_ratecurve")
+	// Check if the filter and curves fit before touching any of the probe's maps.
+	if err := ap.checkFilter(cfg.Filter); err != nil {
+		return err
 	}
 
-	if err := curveMap.Put(curve2Age, cfg.Curve2.Age.Nanoseconds()); err != nil {
-		return errors.Wrap(err, "Curve2Age in config_ratecurve")
+	if err := ap.checkCurves(cfg.Curve, cfg.Curves); err != nil {
+		return err
 	}
 
-	if err := curveMap.Put(curve2Rate, cfg.Curve2.Rate.Nanoseconds()); err != nil {
-		return errors.Wrap(err, "Curve2Rate in config_ratecurve")
+	ap.filterMu.Lock()
+	defer ap.filterMu.Unlock()
+
+	old := ap.filter
+
+	if err := ap.applyFilter(cfg.Filter); err != nil {
+		_ = ap.revertFilter(cfg.Filter)
+		return errors.Wrap(err, "applying filter")
 	}
 
-	// Set the ready bit in the probe's config map to make it start sending traffic.
-	if err := configMap.Put(configReady, readyValue); err != nil {
-		return errors.Wrap(err, "configReady in config")
+	// The active curves are unchanged if configuring them fails.
+	if err := ap.configureCurves(cfg.Curve, cfg.Curves); err != nil {
+		if ferr := ap.applyFilter(old); ferr != nil {
+			_ = ap.revertFilter(old)
+		}
+		return err
 	}
 
+	ap.config.Curve = cfg.Curve
+	ap.config.Curves = cfg.Curves
+
 	return nil
 }
 
+// Config returns the Probe's effective configuration,
+// including any changes made by Reconfigure and SetFilter.
+func (ap *Probe) Config() Config {
+
+	ap.configMu.Lock()
+	cfg := ap.config
+	ap.configMu.Unlock()
+
+	cfg.Filter = ap.Filter()
+
+	return cfg
+}
+
 // configureProbeDefaults manipulates the given Config to set it up with
 // default values.
 func (cfg *Config) probeDefaults() {
 
-	// Curve point 0.
-
-	// Don't touch Curve0.AgeMillis, it can remain 0.
-	// We allow the user to modify this if they want to ignore
-	// flows younger than a certain age.
+	// Curve point 0 starts at age 0, so all flows are sampled from the
+	// moment they are created. Users can raise the first point's Age
+	// if they want to ignore flows younger than a certain age.
+	if len(cfg.Curve) == 0 {
+		cfg.Curve = []CurvePoint{
+			{Age: 0, Rate: 20 * time.Second},
+			{Age: 60 * time.Second, Rate: 60 * time.Second},
+			{Age: 5 * time.Minute, Rate: 5 * time.Minute},
+		}
+	}
 
-	if cfg.Curve0.Rate == 0 {
-		cfg.Curve0.Rate = 20 * time.Second
+	// Event buffers.
+	if cfg.RingBufferSize == 0 {
+		cfg.RingBufferSize = 1 << 20
 	}
 
-	// Curve point 1.
-	if cfg.Curve1.Age == 0 {
-		cfg.Curve1.Age = 60 * time.Second
+	if cfg.PerfBufferSize == 0 {
+		cfg.PerfBufferSize = 4096
 	}
 
-	if cfg.Curve1.Rate == 0 {
-		cfg.Curve1.Rate = 60 * time.Second
+	// Flow tracking maps.
+	if cfg.ReapHorizon == 0 {
+		cfg.ReapHorizon = defaultReapHorizon
 	}
 
-	// Curve point 2.
-	if cfg.Curve2.Age == 0 {
-		cfg.Curve2.Age = 5 * time.Minute
+	if cfg.DumpInterval == 0 {
+		cfg.DumpInterval = defaultDumpInterval
 	}
 
-	if cfg.Curve2.Rate == 0 {
-		cfg.Curve2.Rate = 5 * time.Minute
+	if cfg.FlowMapSize == 0 {
+		cfg.FlowMapSize = defaultFlowMapSize
+		if max, err := conntrackMax(); err == nil && max > 0 {
+			cfg.FlowMapSize = max
+		}
 	}
 }
 
 func probeConfigVerify(cfg Config) error {
 
-	// Ensure curve0 lower than curve1 and curve2.
-	if cfg.Curve0.Age >= cfg.Curve1.Age ||
-		cfg.Curve0.Age >= cfg.Curve2.Age {
-		return errCurve0Age
+	if err := verifyCurve(cfg.Curve); err != nil {
+		return err
+	}
+
+	if err := verifyCurves(cfg.Curves); err != nil {
+		return err
+	}
+
+	// The kernel requires the ring buffer to be a power-of-2 multiple of the page size.
+	rs := cfg.RingBufferSize
+	if rs <= 0 || rs&(rs-1) != 0 || rs%os.Getpagesize() != 0 {
+		return errRingBufSize
+	}
+
+	if cfg.ReapHorizon < 0 {
+		return errReapHorizon
+	}
+
+	if cfg.DumpInterval < 0 {
+		return errDumpInterval
+	}
+
+	if cfg.FlowMapSize <= 0 || uint64(cfg.FlowMapSize) > math.MaxUint32 {
+		return errFlowMapSize
 	}
 
-	// Ensure curve1 between curve0 and curve2.
-	if cfg.Curve1.Age >= cfg.Curve2.Age {
-		return errCurve1Age
+	if err := cfg.Filter.verify(); err != nil {
+		return errors.Wrap(err, "verifying filter")
 	}
 
 	return nil
@@ -0,0 +1,106 @@
+package bpf
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProbeConfigVerifyRingBufferSize(t *testing.T) {
+
+	tests := []struct {
+		size int
+		err  error
+	}{
+		{size: 1 << 20},
+		{size: 4096},
+		{size: 0, err: errRingBufSize},
+		{size: 3 << 20, err: errRingBufSize},
+		{size: 1024, err: errRingBufSize},
+	}
+
+	for _, tt := range tests {
+		var cfg Config
+		cfg.probeDefaults()
+		cfg.RingBufferSize = tt.size
+
+		assert.Equal(t, tt.err, probeConfigVerify(cfg), "size %d", tt.size)
+	}
+}
+
+func TestProbeConfigVerifyFlowMapSize(t *testing.T) {
+
+	// The default is taken from the host, or falls back to a fixed size.
+	var cfg Config
+	cfg.probeDefaults()
+	assert.NotZero(t, cfg.FlowMapSize)
+	assert.NoError(t, probeConfigVerify(cfg))
+
+	cfg.FlowMapSize = -1
+	assert.Equal(t, errFlowMapSize, probeConfigVerify(cfg))
+}
+
+func TestPrepareFlowMaps(t *testing.T) {
+
+	spec := &ebpf.CollectionSpec{
+		Maps: map[string]*ebpf.MapSpec{
+			flowCooldownMap: {MaxEntries: defaultFlowMapSize},
+			flowOriginMap:   {MaxEntries: defaultFlowMapSize},
+		},
+	}
+
+	prepareFlowMaps(spec, 1<<20)
+
+	assert.EqualValues(t, 1<<20, spec.Maps[flowCooldownMap].MaxEntries)
+	assert.EqualValues(t, 1<<20, spec.Maps[flowOriginMap].MaxEntries)
+}
+
+func TestParseTransport(t *testing.T) {
+
+	for _, tr := range []Transport{TransportAuto, TransportRingBuf, TransportPerf} {
+		out, err := ParseTransport(tr.String())
+		assert.NoError(t, err)
+		assert.Equal(t, tr, out)
+	}
+
+	_, err := ParseTransport("carrier-pigeon")
+	assert.Error(t, err)
+}
+
+func TestVerifyCurve(t *testing.T) {
+
+	ms := time.Millisecond
+	long := make([]CurvePoint, curveMaxPoints+1)
+	for i := range long {
+		long[i] = CurvePoint{Age: time.Duration(i) * ms, Rate: ms}
+	}
+
+	tests := []struct {
+		name  string
+		curve []CurvePoint
+		err   bool
+	}{
+		{name: "single", curve: []CurvePoint{{Age: 0, Rate: ms}}},
+		{name: "increasing", curve: []CurvePoint{{Age: 0, Rate: ms}, {Age: ms, Rate: ms}, {Age: 2 * ms, Rate: 5 * ms}}},
+		{name: "max", curve: long[:curveMaxPoints]},
+		{name: "empty", err: true},
+		{name: "too long", curve: long, err: true},
+		{name: "equal ages", curve: []CurvePoint{{Age: ms, Rate: ms}, {Age: ms, Rate: ms}}, err: true},
+		{name: "decreasing", curve: []CurvePoint{{Age: 2 * ms, Rate: ms}, {Age: ms, Rate: ms}}, err: true},
+		{name: "negative age", curve: []CurvePoint{{Age: -ms, Rate: ms}}, err: true},
+		{name: "zero rate", curve: []CurvePoint{{Age: 0, Rate: 0}}, err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyCurve(tt.curve)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
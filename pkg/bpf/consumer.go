@@ -1,5 +1,10 @@
 package bpf
 
+import (
+	"sync"
+	"time"
+)
+
 // ConsumerMode defines whether the consumer
 // receives updates, destroys, or both.
 type ConsumerMode uint8
@@ -11,6 +16,40 @@ const (
 	ConsumerAll     ConsumerMode = (ConsumerUpdate | ConsumerDestroy)
 )
 
+// Backpressure decides what happens to events delivered to a Consumer
+// whose event channel is full.
+type Backpressure uint8
+
+// Backpressure policies of a Consumer.
+const (
+	// DropNewest drops the event being delivered. This is the default,
+	// suitable for consumers that prefer fresh data, eg. live dashboards.
+	DropNewest Backpressure = iota
+	// DropOldest drops the oldest event in the channel to make room
+	// for the event being delivered, like a ring buffer.
+	DropOldest
+	// Block waits for room in the channel for up to the Consumer's timeout
+	// before dropping the event. This slows down the Probe's readers, so
+	// events may be lost in the kernel instead, affecting all consumers.
+	Block
+)
+
+// defaultBlockTimeout is the block timeout of Consumers using the Block
+// policy that were created without a timeout.
+const defaultBlockTimeout = 100 * time.Millisecond
+
+// A ConsumerOption configures optional behaviour of a Consumer.
+type ConsumerOption func(*Consumer)
+
+// WithBackpressure sets the Consumer's Backpressure policy. timeout is the
+// maximum duration a delivery blocks when using Block, defaults to 100ms.
+func WithBackpressure(bp Backpressure, timeout time.Duration) ConsumerOption {
+	return func(ac *Consumer) {
+		ac.backpressure = bp
+		ac.timeout = timeout
+	}
+}
+
 // A Consumer of accounting events.
 type Consumer struct {
 	name   string
@@ -19,11 +58,28 @@ type Consumer struct {
 	// Kinds of events the consumer wants to receive. (update, destroy, all)
 	mode ConsumerMode
 
+	// Predicate deciding which events are delivered, nil delivers all.
+	filter func(Event) bool
+
+	// Policy when the event channel is full, and the timeout of Block.
+	backpressure Backpressure
+	timeout      time.Duration
+
+	// Batch delivery, only used by Consumers created with NewBatchConsumer.
+	batches   chan []Event
+	batchSize int
+	deadline  time.Duration
+	batchMu   sync.Mutex
+	pending   []Event
+	timer     *time.Timer
+	closed    bool
+
 	stats *ConsumerStats
 }
 
-// NewConsumer returns a new Consumer.
-func NewConsumer(name string, events chan Event, mode ConsumerMode) *Consumer {
+// NewConsumer returns a new Consumer. Without options, events are dropped
+// when the Consumer's event channel is full.
+func NewConsumer(name string, events chan Event, mode ConsumerMode, opts ...ConsumerOption) *Consumer {
 
 	if mode == 0 {
 		mode = ConsumerAll
@@ -36,6 +92,14 @@ func NewConsumer(name string, events chan Event, mode ConsumerMode) *Consumer {
 		stats:  &ConsumerStats{},
 	}
 
+	for _, opt := range opts {
+		opt(&ac)
+	}
+
+	if ac.backpressure == Block && ac.timeout <= 0 {
+		ac.timeout = defaultBlockTimeout
+	}
+
 	return &ac
 }
 
@@ -44,7 +108,7 @@ func (ac *Consumer) Name() string {
 	return ac.name
 }
 
-// Events returns the consumer's Event channel.
+// Events returns the consumer's Event channel. Nil for batch Consumers.
 func (ac *Consumer) Events() <-chan Event {
 	return ac.events
 }
@@ -66,51 +130,114 @@ func (ac *Consumer) WantDestroy() bool {
 	return (ac.mode & ConsumerDestroy) > 0
 }
 
-// RegisterConsumer registers an Consumer in an Probe.
-func (ap *Probe) RegisterConsumer(ac *Consumer) error {
+// send delivers an Event to the Consumer's event channel if it passes the
+// Consumer's filter, applying its Backpressure policy when the channel is full.
+func (ac *Consumer) send(ae Event) {
+
+	if ac.filter != nil && !ac.filter(ae) {
+		ac.stats.incrEventsFiltered()
+		return
+	}
+
+	if ac.batches != nil {
+		ac.addBatch(ae)
+		return
+	}
+
+	select {
+	case ac.events <- ae:
+		ac.delivered()
+		return
+	default:
+	}
+
+	// The channel is full.
+	switch ac.backpressure {
+	case DropOldest:
+		// Make room by discarding the oldest event. Another producer may
+		// claim the free slot first, in which case the new event is dropped.
+		select {
+		case <-ac.events:
+			ac.stats.incrEventsEvicted()
+		default:
+		}
+
+		select {
+		case ac.events <- ae:
+			ac.delivered()
+			return
+		default:
+		}
+
+	case Block:
+		start := time.Now()
+		t := time.NewTimer(ac.timeout)
+
+		select {
+		case ac.events <- ae:
+			t.Stop()
+			ac.stats.addBlocked(time.Since(start))
+			ac.delivered()
+			return
+		case <-t.C:
+			ac.stats.addBlocked(time.Since(start))
+		}
+	}
+
+	ac.stats.incrEventsLost()
+}
+
+// delivered records the successful delivery of an event.
+func (ac *Consumer) delivered() {
+	ac.stats.setQueueLength(len(ac.events))
+	ac.stats.incrEventsReceived()
+}
+
+// RegisterConsumer registers an Consumer in an event source.
+func (fo *fanout) RegisterConsumer(ac *Consumer) error {
 
 	if ac == nil {
 		return errConsumerNil
 	}
 
-	ap.consumerMu.Lock()
-	defer ap.consumerMu.Unlock()
+	fo.consumerMu.Lock()
+	defer fo.consumerMu.Unlock()
 
-	for _, c := range ap.consumers {
+	for _, c := range fo.consumers {
 		if c.name == ac.name {
 			return errDupConsumer
 		}
 	}
 
-	// Append the consumer to the probe's list of consumers.
-	ap.consumers = append(ap.consumers, ac)
+	// Append the consumer to the source's list of consumers.
+	fo.consumers = append(fo.consumers, ac)
 
 	return nil
 }
 
-// RemoveConsumer removes an Consumer from the Probe's consumer list.
-func (ap *Probe) RemoveConsumer(ac *Consumer) error {
+// RemoveConsumer removes an Consumer from the event source's consumer list.
+func (fo *fanout) RemoveConsumer(ac *Consumer) error {
 
 	if ac == nil {
 		return errConsumerNil
 	}
 
-	ap.consumerMu.Lock()
-	defer ap.consumerMu.Unlock()
+	fo.consumerMu.Lock()
+	defer fo.consumerMu.Unlock()
 
-	for i, c := range ap.consumers {
+	for i, c := range fo.consumers {
 		if c.name == ac.name {
 			// From https://github.com/golang/go/wiki/SliceTricks
 			// Avoid memory leaks since we're dealing with a slice of pointers.
 
 			// Swap the last element of the slice into the element we want to delete.
-			ap.consumers[i] = ap.consumers[len(ap.consumers)-1]
+			fo.consumers[i] = fo.consumers[len(fo.consumers)-1]
 			// Zero the last element of the slice.
-			ap.consumers[len(ap.consumers)-1] = nil
+			fo.consumers[len(fo.consumers)-1] = nil
 			// Shrink the slice by one element.
-			ap.consumers = ap.consumers[:len(ap.consumers)-1]
+			fo.consumers = fo.consumers[:len(fo.consumers)-1]
 
-			close(c.events)
+			c.close()
 
 			return nil
 		}
@@ -119,14 +246,14 @@ func (ap *Probe) RemoveConsumer(ac *Consumer) error {
 	return errNoConsumer
 }
 
-// GetConsumer looks up and returns an Consumer registered in an Probe
-// based on its name. Returns nil if consumer does not exist in probe.
-func (ap *Probe) GetConsumer(name string) *Consumer {
+// GetConsumer looks up and returns an Consumer registered in an event source
+// based on its name. Returns nil if consumer does not exist in the source.
+func (fo *fanout) GetConsumer(name string) *Consumer {
 
-	ap.consumerMu.RLock()
-	defer ap.consumerMu.RUnlock()
+	fo.consumerMu.RLock()
+	defer fo.consumerMu.RUnlock()
 
-	for _, c := range ap.consumers {
+	for _, c := range fo.consumers {
 		if c.name == name {
 			return c
 		}
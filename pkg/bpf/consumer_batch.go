@@ -0,0 +1,166 @@
+package bpf
+
+import (
+	"time"
+)
+
+// Defaults of batch Consumers created with zero values.
+const (
+	defaultBatchSize     = 256
+	defaultBatchDeadline = 10 * time.Millisecond
+)
+
+// NewBatchConsumer returns a new Consumer that delivers Events in batches
+// on the given channel, instead of one by one. A batch is delivered when it
+// holds size events, or when deadline expired since its first event was added,
+// whichever comes first. Size and deadline default to 256 and 10ms.
+//
+// Options apply to a batch Consumer like they do to a regular one, but
+// its Backpressure policy decides what happens to full batches.
+// Delivered batches are owned by the receiver.
+func NewBatchConsumer(name string, batches chan []Event, mode ConsumerMode,
+	size int, deadline time.Duration, opts ...ConsumerOption) *Consumer {
+
+	if size <= 0 {
+		size = defaultBatchSize
+	}
+	if deadline <= 0 {
+		deadline = defaultBatchDeadline
+	}
+
+	ac := NewConsumer(name, nil, mode, opts...)
+	ac.batches = batches
+	ac.batchSize = size
+	ac.deadline = deadline
+	ac.pending = make([]Event, 0, size)
+
+	return ac
+}
+
+// Batches returns the Consumer's batch channel. Nil if the Consumer
+// was not created using NewBatchConsumer.
+func (ac *Consumer) Batches() <-chan []Event {
+	return ac.batches
+}
+
+// addBatch adds an Event to the Consumer's pending batch, delivering the
+// batch if it is full. Starts the batch deadline timer on the first Event.
+func (ac *Consumer) addBatch(ae Event) {
+
+	ac.batchMu.Lock()
+	defer ac.batchMu.Unlock()
+
+	if ac.closed {
+		return
+	}
+
+	ac.pending = append(ac.pending, ae)
+
+	if len(ac.pending) >= ac.batchSize {
+		if ac.timer != nil {
+			ac.timer.Stop()
+		}
+		ac.flushBatch()
+		return
+	}
+
+	if len(ac.pending) == 1 {
+		if ac.timer == nil {
+			ac.timer = time.AfterFunc(ac.deadline, ac.flush)
+		} else {
+			ac.timer.Reset(ac.deadline)
+		}
+	}
+}
+
+// flush delivers the Consumer's pending batch, if any.
+func (ac *Consumer) flush() {
+
+	ac.batchMu.Lock()
+	defer ac.batchMu.Unlock()
+
+	if ac.closed {
+		return
+	}
+
+	ac.flushBatch()
+}
+
+// flushBatch delivers the pending batch according to the Consumer's
+// Backpressure policy and starts a new one. Must hold batchMu.
+func (ac *Consumer) flushBatch() {
+
+	b := ac.pending
+	if len(b) == 0 {
+		return
+	}
+	ac.pending = make([]Event, 0, ac.batchSize)
+
+	select {
+	case ac.batches <- b:
+		ac.deliveredBatch(b)
+		return
+	default:
+	}
+
+	// The channel is full.
+	switch ac.backpressure {
+	case DropOldest:
+		select {
+		case old := <-ac.batches:
+			ac.stats.addEventsEvicted(len(old))
+		default:
+		}
+
+		select {
+		case ac.batches <- b:
+			ac.deliveredBatch(b)
+			return
+		default:
+		}
+
+	case Block:
+		start := time.Now()
+		t := time.NewTimer(ac.timeout)
+
+		select {
+		case ac.batches <- b:
+			t.Stop()
+			ac.stats.addBlocked(time.Since(start))
+			ac.deliveredBatch(b)
+			return
+		case <-t.C:
+			ac.stats.addBlocked(time.Since(start))
+		}
+	}
+
+	ac.stats.addEventsLost(len(b))
+}
+
+// deliveredBatch records the successful delivery of a batch.
+func (ac *Consumer) deliveredBatch(b []Event) {
+	ac.stats.setQueueLength(len(ac.batches))
+	ac.stats.addEventsReceived(len(b))
+	ac.stats.incrBatchesReceived()
+}
+
+// close stops the Consumer's batch timer and closes its channel.
+// Pending events are discarded.
+func (ac *Consumer) close() {
+
+	if ac.batches == nil {
+		close(ac.events)
+		return
+	}
+
+	ac.batchMu.Lock()
+	defer ac.batchMu.Unlock()
+
+	if ac.timer != nil {
+		ac.timer.Stop()
+	}
+	ac.closed = true
+	ac.pending = nil
+
+	close(ac.batches)
+}
@@ -0,0 +1,109 @@
+package bpf
+
+import "net"
+
+// EventFilter holds the criteria a Consumer uses to decide which events it
+// receives. Unlike Filter, it is evaluated in userspace for each Consumer
+// separately. All non-empty criteria need to match for an event to be
+// delivered. A zero EventFilter matches all events.
+type EventFilter struct {
+	// Protocols is a list of layer 4 protocol numbers. When not empty,
+	// only events of flows with one of these protocols match.
+	Protocols []uint8
+
+	// CIDRs is a list of IPv4 and IPv6 prefixes. When not empty, only events
+	// of flows with a source or destination address within one of the
+	// prefixes match.
+	CIDRs []*net.IPNet
+
+	// Ports is a list of port ranges. When not empty, only events of flows
+	// with a source or destination port within one of the ranges match.
+	Ports []PortRange
+
+	// NetNS is a list of network namespace inode numbers. When not empty,
+	// only events of flows in one of these namespaces match.
+	NetNS []uint32
+
+	// When ConnmarkMask is non-zero, only events of flows with a connmark
+	// equal to ConnmarkValue after applying the mask match.
+	ConnmarkValue uint32
+	ConnmarkMask  uint32
+}
+
+// Match returns true if the Event matches all criteria of the EventFilter.
+func (f EventFilter) Match(e Event) bool {
+
+	if len(f.Protocols) != 0 && !matchProto(f.Protocols, e.Proto) {
+		return false
+	}
+
+	if len(f.CIDRs) != 0 && !matchCIDR(f.CIDRs, e.SrcAddr) && !matchCIDR(f.CIDRs, e.DstAddr) {
+		return false
+	}
+
+	if len(f.Ports) != 0 && !matchPort(f.Ports, e.SrcPort) && !matchPort(f.Ports, e.DstPort) {
+		return false
+	}
+
+	if len(f.NetNS) != 0 && !matchNetNS(f.NetNS, e.NetNS) {
+		return false
+	}
+
+	if f.ConnmarkMask != 0 && e.Connmark&f.ConnmarkMask != f.ConnmarkValue {
+		return false
+	}
+
+	return true
+}
+
+// WithFilter only delivers Events to the Consumer for which fn returns true.
+// fn is called from the Probe's read loops and needs to be fast.
+func WithFilter(fn func(Event) bool) ConsumerOption {
+	return func(ac *Consumer) {
+		ac.filter = fn
+	}
+}
+
+// WithEventFilter only delivers Events matching f to the Consumer.
+func WithEventFilter(f EventFilter) ConsumerOption {
+	return WithFilter(f.Match)
+}
+
+func matchProto(protos []uint8, p uint8) bool {
+	for _, v := range protos {
+		if v == p {
+			return true
+		}
+	}
+	return false
+}
+
+func matchCIDR(cidrs []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, c := range cidrs {
+		if c.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPort(ports []PortRange, p uint16) bool {
+	for _, pr := range ports {
+		if p >= pr.First && p <= pr.Last {
+			return true
+		}
+	}
+	return false
+}
+
+func matchNetNS(netns []uint32, ns uint32) bool {
+	for _, v := range netns {
+		if v == ns {
+			return true
+		}
+	}
+	return false
+}
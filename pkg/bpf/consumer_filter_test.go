@@ -0,0 +1,62 @@
+package bpf
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventFilterMatch(t *testing.T) {
+
+	_, lan, _ := net.ParseCIDR("10.0.0.0/8")
+
+	e := Event{
+		SrcAddr:  net.ParseIP("10.1.2.3"),
+		DstAddr:  net.ParseIP("192.0.2.1"),
+		SrcPort:  40000,
+		DstPort:  443,
+		Proto:    6,
+		NetNS:    4026531992,
+		Connmark: 0x1234,
+	}
+
+	tests := []struct {
+		name  string
+		f     EventFilter
+		match bool
+	}{
+		{name: "empty", match: true},
+		{name: "proto", f: EventFilter{Protocols: []uint8{17, 6}}, match: true},
+		{name: "proto mismatch", f: EventFilter{Protocols: []uint8{17}}},
+		{name: "cidr src", f: EventFilter{CIDRs: []*net.IPNet{lan}}, match: true},
+		{name: "port dst", f: EventFilter{Ports: []PortRange{{First: 443, Last: 443}}}, match: true},
+		{name: "port any range", f: EventFilter{Ports: []PortRange{{First: 1, Last: 1023}, {First: 8000, Last: 8080}}}, match: true},
+		{name: "port range miss", f: EventFilter{Ports: []PortRange{{First: 8000, Last: 8080}}}},
+		{name: "netns", f: EventFilter{NetNS: []uint32{4026531992}}, match: true},
+		{name: "netns mismatch", f: EventFilter{NetNS: []uint32{1}}},
+		{name: "connmark", f: EventFilter{ConnmarkValue: 0x34, ConnmarkMask: 0xff}, match: true},
+		{name: "connmark mismatch", f: EventFilter{ConnmarkValue: 0x12, ConnmarkMask: 0xff}},
+		{name: "all criteria must match", f: EventFilter{Protocols: []uint8{6}, NetNS: []uint32{1}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.match, tt.f.Match(e))
+		})
+	}
+}
+
+func TestConsumerFilter(t *testing.T) {
+
+	c := NewConsumer("udp", make(chan Event, 2), ConsumerAll,
+		WithEventFilter(EventFilter{Protocols: []uint8{17}}))
+
+	c.send(Event{Proto: 6})
+	c.send(Event{Proto: 17})
+
+	s := c.stats.Get()
+	assert.EqualValues(t, 1, s.EventsFiltered)
+	assert.EqualValues(t, 1, s.EventsReceived)
+	assert.EqualValues(t, 17, (<-c.events).Proto)
+}
@@ -1,6 +1,9 @@
 package bpf
 
-import "sync/atomic"
+import (
+	"sync/atomic"
+	"time"
+)
 
 // ConsumerStats holds various statistics and information about the
 // BPF consumer.
@@ -9,7 +12,17 @@ type ConsumerStats struct {
 	EventsReceived uint64 `json:"events_received"`
 	// amount of events that could not be received by the consumer
 	EventsLost uint64 `json:"events_lost"`
-	// length of the consumer's event queue
+	// amount of events not delivered because they didn't match the consumer's filter
+	EventsFiltered uint64 `json:"events_filtered"`
+	// amount of queued events dropped to make room for newer ones (DropOldest)
+	EventsEvicted uint64 `json:"events_evicted"`
+	// amount of deliveries that waited for room in the queue (Block),
+	// and the total time spent waiting in nanoseconds
+	EventsBlocked uint64 `json:"events_blocked"`
+	BlockedTime   uint64 `json:"blocked_time_ns"`
+	// amount of batches received by batch consumers
+	BatchesReceived uint64 `json:"batches_received"`
+	// length of the consumer's event (or batch) queue
 	EventQueueLength uint64 `json:"event_queue_length"`
 }
 
@@ -23,6 +36,42 @@ func (s *ConsumerStats) incrEventsLost() {
 	atomic.AddUint64(&s.EventsLost, 1)
 }
 
+// addEventsReceived atomically increases the events received counter by n.
+func (s *ConsumerStats) addEventsReceived(n int) {
+	atomic.AddUint64(&s.EventsReceived, uint64(n))
+}
+
+// addEventsLost atomically increases the events lost counter by n.
+func (s *ConsumerStats) addEventsLost(n int) {
+	atomic.AddUint64(&s.EventsLost, uint64(n))
+}
+
+// addEventsEvicted atomically increases the events evicted counter by n.
+func (s *ConsumerStats) addEventsEvicted(n int) {
+	atomic.AddUint64(&s.EventsEvicted, uint64(n))
+}
+
+// incrBatchesReceived atomically increases the batches received counter by one.
+func (s *ConsumerStats) incrBatchesReceived() {
+	atomic.AddUint64(&s.BatchesReceived, 1)
+}
+
+// incrEventsFiltered atomically increases the events filtered counter by one.
+func (s *ConsumerStats) incrEventsFiltered() {
+	atomic.AddUint64(&s.EventsFiltered, 1)
+}
+
+// incrEventsEvicted atomically increases the events evicted counter by one.
+func (s *ConsumerStats) incrEventsEvicted() {
+	atomic.AddUint64(&s.EventsEvicted, 1)
+}
+
+// addBlocked atomically records a delivery that blocked for duration d.
+func (s *ConsumerStats) addBlocked(d time.Duration) {
+	atomic.AddUint64(&s.EventsBlocked, 1)
+	atomic.AddUint64(&s.BlockedTime, uint64(d))
+}
+
 // setQueueLength atomically sets the queue length of the consumer.
 func (s *ConsumerStats) setQueueLength(l int) {
 	atomic.StoreUint64(&s.EventQueueLength, uint64(l))
@@ -35,6 +84,11 @@ func (s *ConsumerStats) Get() ConsumerStats {
 	return ConsumerStats{
 		EventsReceived:   atomic.LoadUint64(&s.EventsReceived),
 		EventsLost:       atomic.LoadUint64(&s.EventsLost),
+		EventsFiltered:   atomic.LoadUint64(&s.EventsFiltered),
+		EventsEvicted:    atomic.LoadUint64(&s.EventsEvicted),
+		EventsBlocked:    atomic.LoadUint64(&s.EventsBlocked),
+		BlockedTime:      atomic.LoadUint64(&s.BlockedTime),
+		BatchesReceived:  atomic.LoadUint64(&s.BatchesReceived),
 		EventQueueLength: atomic.LoadUint64(&s.EventQueueLength),
 	}
 }
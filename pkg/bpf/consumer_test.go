@@ -0,0 +1,146 @@
+package bpf
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsumerBackpressure(t *testing.T) {
+
+	ev := func(id uint32) Event { return Event{FlowID: id} }
+
+	// Default policy drops the newest event.
+	dn := NewConsumer("dn", make(chan Event, 1), ConsumerAll)
+	dn.send(ev(1))
+	dn.send(ev(2))
+	assert.EqualValues(t, 1, (<-dn.events).FlowID)
+	assert.EqualValues(t, 1, dn.stats.Get().EventsLost)
+
+	// DropOldest replaces the oldest event in the channel.
+	do := NewConsumer("do", make(chan Event, 1), ConsumerAll, WithBackpressure(DropOldest, 0))
+	do.send(ev(1))
+	do.send(ev(2))
+	assert.EqualValues(t, 2, (<-do.events).FlowID)
+	s := do.stats.Get()
+	assert.EqualValues(t, 1, s.EventsEvicted)
+	assert.EqualValues(t, 2, s.EventsReceived)
+	assert.EqualValues(t, 0, s.EventsLost)
+
+	// Block drops the event after the timeout expires.
+	bl := NewConsumer("bl", make(chan Event, 1), ConsumerAll, WithBackpressure(Block, 10*time.Millisecond))
+	bl.send(ev(1))
+	bl.send(ev(2))
+	s = bl.stats.Get()
+	assert.EqualValues(t, 1, s.EventsLost)
+	assert.EqualValues(t, 1, s.EventsBlocked)
+	assert.True(t, s.BlockedTime >= uint64(10*time.Millisecond))
+
+	// Block delivers the event once the channel is drained.
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		<-bl.events
+	}()
+	bl2 := NewConsumer("bl2", bl.events, ConsumerAll, WithBackpressure(Block, time.Second))
+	bl2.send(ev(3))
+	assert.EqualValues(t, 0, bl2.stats.Get().EventsLost)
+	assert.EqualValues(t, 3, (<-bl.events).FlowID)
+
+	// Block uses a default timeout.
+	assert.Equal(t, defaultBlockTimeout, NewConsumer("d", nil, 0, WithBackpressure(Block, 0)).timeout)
+}
+
+func TestBatchConsumer(t *testing.T) {
+
+	c := NewBatchConsumer("batch", make(chan []Event, 1), ConsumerAll, 3, 20*time.Millisecond)
+	assert.Nil(t, c.Events())
+
+	// Batches are delivered when full.
+	for i := uint32(1); i <= 3; i++ {
+		c.send(Event{FlowID: i})
+	}
+	b := <-c.Batches()
+	assert.Len(t, b, 3)
+	assert.EqualValues(t, 3, b[2].FlowID)
+
+	// Partial batches are delivered after the deadline.
+	c.send(Event{FlowID: 4})
+	select {
+	case b = <-c.Batches():
+		assert.Len(t, b, 1)
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for batch deadline")
+	}
+
+	s := c.stats.Get()
+	assert.EqualValues(t, 4, s.EventsReceived)
+	assert.EqualValues(t, 2, s.BatchesReceived)
+
+	// Full batches are dropped when the channel is full.
+	for i := 0; i < 6; i++ {
+		c.send(Event{})
+	}
+	assert.EqualValues(t, 3, c.stats.Get().EventsLost)
+
+	c.close()
+	_, ok := <-c.Batches()
+	assert.True(t, ok, "queued batch must be received before close")
+	_, ok = <-c.Batches()
+	assert.False(t, ok)
+
+	// Sends after close are ignored.
+	c.send(Event{})
+}
+
+// drain receives from the consumer's channel until it is closed.
+func drain(c *Consumer, done chan struct{}) {
+	if c.batches != nil {
+		for range c.batches {
+		}
+	} else {
+		for range c.events {
+		}
+	}
+	close(done)
+}
+
+func BenchmarkConsumerSend(b *testing.B) {
+
+	c := NewConsumer("bench", make(chan Event, 1024), ConsumerAll,
+		WithBackpressure(Block, time.Second))
+
+	done := make(chan struct{})
+	go drain(c, done)
+
+	var e Event
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		c.send(e)
+	}
+
+	c.close()
+	<-done
+}
+
+func BenchmarkConsumerSendBatch(b *testing.B) {
+
+	c := NewBatchConsumer("bench", make(chan []Event, 16), ConsumerAll, 256, time.Millisecond,
+		WithBackpressure(Block, time.Second))
+
+	done := make(chan struct{})
+	go drain(c, done)
+
+	var e Event
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		c.send(e)
+	}
+
+	c.close()
+	<-done
+}
@@ -0,0 +1,526 @@
+package bpf
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+
+	"github.com/cilium/ebpf"
+	"github.com/pkg/errors"
+)
+
+const (
+	curveMap       = "config_ratecurve"
+	curveSelectMap = "curve_select"
+
+	// Maximum amount of points in a rate curve.
+	// Must match CURVE_MAX in the BPF program.
+	curveMaxPoints = 16
+
+	// Maximum amount of rate curves, including the default curve.
+	// Must match CURVE_SLOTS in the BPF program.
+	curveMaxCurves = 8
+
+	// Maximum amount of entries in `curve_select` for a single bank.
+	// Must match CURVE_SELECT_MAX in the BPF program.
+	curveSelectMax = 1024
+
+	// Value of the age of unused points in the probe's `config_ratecurve` array.
+	curveUnused = int64(-1)
+)
+
+// RateCurve is a rate curve used for the flows of a layer 4 protocol,
+// optionally limited to a set of destination ports.
+type RateCurve struct {
+	// Name of the curve, used in error messages.
+	Name string
+
+	// Protocol is the layer 4 protocol number of the flows using this curve.
+	Protocol uint8
+
+	// Ports is a list of destination port ranges of the flows using this curve.
+	// When empty, the curve is used for all flows of Protocol that are not
+	// matched by a curve with Ports.
+	Ports []PortRange
+
+	// Curve is a list of curve points like Config.Curve.
+	Curve []CurvePoint
+}
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	First uint16
+	Last  uint16
+}
+
+// ParsePortRange parses a single port or a range of ports in the
+// form 'first-last' into a PortRange.
+func ParsePortRange(s string) (PortRange, error) {
+
+	fl := strings.SplitN(s, "-", 2)
+
+	first, err := strconv.ParseUint(strings.TrimSpace(fl[0]), 10, 16)
+	if err != nil {
+		return PortRange{}, errors.Errorf(errFmtPortRange, s)
+	}
+
+	last := first
+	if len(fl) == 2 {
+		last, err = strconv.ParseUint(strings.TrimSpace(fl[1]), 10, 16)
+		if err != nil {
+			return PortRange{}, errors.Errorf(errFmtPortRange, s)
+		}
+	}
+
+	pr := PortRange{First: uint16(first), Last: uint16(last)}
+	if pr.First > pr.Last {
+		return PortRange{}, errors.Errorf(errFmtPortRange, s)
+	}
+
+	return pr, nil
+}
+
+func (pr PortRange) String() string {
+	if pr.First == pr.Last {
+		return strconv.Itoa(int(pr.First))
+	}
+	return fmt.Sprintf("%d-%d", pr.First, pr.Last)
+}
+
+// overlaps returns true if the PortRange has any ports in common with o.
+func (pr PortRange) overlaps(o PortRange) bool {
+	return pr.First <= o.Last && o.First <= pr.Last
+}
+
+// portPrefix is a block of ports sharing their most significant bits.
+type portPrefix struct {
+	port uint16
+	bits uint8
+}
+
+// portPrefixes splits a PortRange into the smallest set of portPrefixes
+// covering exactly the same ports.
+func portPrefixes(pr PortRange) []portPrefix {
+
+	var out []portPrefix
+
+	// Use 32-bit integers to avoid overflowing at the top of the port range.
+	first, last := uint32(pr.First), uint32(pr.Last)
+
+	for first <= last {
+		// Find the largest block starting at first that fits within the range.
+		bits := uint8(16)
+		for bits > 0 {
+			size := uint32(1) << (16 - bits + 1)
+			if first&(size-1) != 0 || first+size-1 > last {
+				break
+			}
+			bits--
+		}
+
+		out = append(out, portPrefix{port: uint16(first), bits: bits})
+		first += uint32(1) << (16 - bits)
+	}
+
+	return out
+}
+
+// curveSelectKey is a key in the probe's `curve_select` map.
+type curveSelectKey struct {
+	// Length of the prefix, including the 16 bits of bank and proto.
+	prefixLen uint32
+	bank      uint8
+	proto     uint8
+	port      uint16
+}
+
+// MarshalBinary marshals the curveSelectKey into its in-kernel representation.
+// The port is stored in network byte order.
+func (k curveSelectKey) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 8)
+	*(*uint32)(unsafe.Pointer(&b[0])) = k.prefixLen
+	b[4] = k.bank
+	b[5] = k.proto
+	binary.BigEndian.PutUint16(b[6:], k.port)
+	return b, nil
+}
+
+// curveSelectKeys returns the `curve_select` entries selecting the given
+// curves in the given bank. The curve at index i occupies slot i+1,
+// slot 0 holds the default curve.
+func curveSelectKeys(curves []RateCurve, bank uint8) map[curveSelectKey]uint32 {
+
+	out := make(map[curveSelectKey]uint32)
+	for i, c := range curves {
+		slot := uint32(i + 1)
+
+		if len(c.Ports) == 0 {
+			out[curveSelectKey{prefixLen: 16, bank: bank, proto: c.Protocol}] = slot
+			continue
+		}
+
+		for _, pr := range c.Ports {
+			for _, pp := range portPrefixes(pr) {
+				k := curveSelectKey{
+					prefixLen: 16 + uint32(pp.bits),
+					bank:      bank,
+					proto:     c.Protocol,
+					port:      pp.port,
+				}
+				out[k] = slot
+			}
+		}
+	}
+
+	return out
+}
+
+// curveAge returns the index of the age of curve point i
+// in a curve of the probe's `config_ratecurve` BPF array.
+func curveAge(i int) uint32 {
+	return uint32(2 * i)
+}
+
+// curveRate returns the index of the rate of curve point i
+// in a curve of the probe's `config_ratecurve` BPF array.
+func curveRate(i int) uint32 {
+	return uint32(2*i + 1)
+}
+
+// verifyCurve checks the amount of points in the curve and ensures
+// their ages are in strictly increasing order.
+func verifyCurve(curve []CurvePoint) error {
+
+	if len(curve) == 0 || len(curve) > curveMaxPoints {
+		return errCurveLength
+	}
+
+	for i, p := range curve {
+		if p.Age < 0 {
+			return errors.Errorf(errFmtCurveAgeNegative, i)
+		}
+
+		if p.Rate <= 0 {
+			return errors.Errorf(errFmtCurveRate, i)
+		}
+
+		if i > 0 && p.Age <= curve[i-1].Age {
+			return errors.Errorf(errFmtCurveAge, i, i-1)
+		}
+	}
+
+	return nil
+}
+
+// verifyCurves checks a list of RateCurves for errors, and ensures
+// no flow can be matched by more than one of them.
+func verifyCurves(curves []RateCurve) error {
+
+	if len(curves) > curveMaxCurves-1 {
+		return errCurveCount
+	}
+
+	names := make(map[string]bool, len(curves))
+	for _, c := range curves {
+		if c.Name == "" {
+			return errCurveName
+		}
+		if names[c.Name] {
+			return errors.Errorf(errFmtCurveDupName, c.Name)
+		}
+		names[c.Name] = true
+
+		if c.Protocol == 0 {
+			return errors.Errorf(errFmtCurveProto, c.Name)
+		}
+
+		for _, pr := range c.Ports {
+			if pr.First > pr.Last {
+				return errors.Errorf(errFmtPortRange, pr)
+			}
+		}
+
+		if err := verifyCurve(c.Curve); err != nil {
+			return errors.Wrapf(err, "curve '%s'", c.Name)
+		}
+	}
+
+	for i, a := range curves {
+		for _, b := range curves[i+1:] {
+			if a.Protocol != b.Protocol {
+				continue
+			}
+
+			// Port-specific curves take precedence over those without ports.
+			if len(a.Ports) == 0 && len(b.Ports) == 0 {
+				return errors.Errorf(errFmtCurveOverlap, a.Name, b.Name)
+			}
+
+			for _, pa := range a.Ports {
+				for _, pb := range b.Ports {
+					if pa.overlaps(pb) {
+						return errors.Errorf(errFmtCurveOverlap, a.Name, b.Name)
+					}
+				}
+			}
+		}
+	}
+
+	if len(curveSelectKeys(curves, 0)) > curveSelectMax {
+		return errCurveSelectCount
+	}
+
+	return nil
+}
+
+// selectCurve returns the rate curve of flows with the given protocol and
+// destination port, like the probe's `curve_select` map. Curves with ports
+// take precedence over those without, def is used if no curve matches.
+func selectCurve(def []CurvePoint, curves []RateCurve, proto uint8, port uint16) []CurvePoint {
+
+	var out []CurvePoint
+	for _, c := range curves {
+		if c.Protocol != proto {
+			continue
+		}
+
+		if len(c.Ports) == 0 {
+			if out == nil {
+				out = c.Curve
+			}
+			continue
+		}
+
+		for _, pr := range c.Ports {
+			if port >= pr.First && port <= pr.Last {
+				return c.Curve
+			}
+		}
+	}
+
+	if out == nil {
+		return def
+	}
+
+	return out
+}
+
+// curveInterval returns the update interval of a flow of the given age,
+// the rate of the last curve point the flow has reached. Returns a negative
+// duration if the flow is younger than the curve's first point.
+func curveInterval(curve []CurvePoint, age time.Duration) time.Duration {
+
+	interval := time.Duration(-1)
+	for _, p := range curve {
+		if age < p.Age {
+			break
+		}
+		interval = p.Rate
+	}
+
+	return interval
+}
+
+// prepareCurveMaps adjusts the curve selector map in the CollectionSpec to the
+// features of the running kernel. On kernels without support for LPM trie
+// maps, it is replaced by a plain hash map, and only the default curve can be used.
+func prepareCurveMaps(spec *ebpf.CollectionSpec, curves []RateCurve) error {
+
+	if haveLPMTrie() == nil {
+		return nil
+	}
+
+	if len(curves) != 0 {
+		return errLPMTrieUnsupported
+	}
+
+	if m, ok := spec.Maps[curveSelectMap]; ok {
+		m.Type = ebpf.Hash
+	}
+
+	return nil
+}
+
+// curveLayout returns the amount of banks in the probe's `config_ratecurve`
+// map, the amount of curves in each bank, and the amount of points each curve
+// can hold.
+func (ap *Probe) curveLayout() (banks, curves, points int, err error) {
+
+	configMap, ok := ap.collection.Maps["config"]
+	if !ok {
+		return 0, 0, 0, errors.New("map 'config' not found in eBPF collection")
+	}
+
+	cm, ok := ap.collection.Maps[curveMap]
+	if !ok {
+		return 0, 0, 0, errors.Errorf("map '%s' not found in eBPF collection", curveMap)
+	}
+
+	// Probes built before the introduction of curve banks have
+	// a single bank, and cannot switch curves atomically.
+	banks = 1
+	if configMap.ABI().MaxEntries > uint32(configCurveBank) {
+		banks = 2
+	}
+
+	// Probes built without a curve selector only have the default curve.
+	curves = 1
+	if _, ok := ap.collection.Maps[curveSelectMap]; ok {
+		curves = curveMaxCurves
+	}
+
+	return banks, curves, int(cm.ABI().MaxEntries) / banks / curves / 2, nil
+}
+
+// checkCurves returns an error if the given default curve and RateCurves
+// do not fit in the probe's maps.
+func (ap *Probe) checkCurves(def []CurvePoint, curves []RateCurve) error {
+
+	_, slots, points, err := ap.curveLayout()
+	if err != nil {
+		return err
+	}
+
+	if len(curves) > slots-1 {
+		return errCurveSelectUnsupported
+	}
+
+	// Probes built before the introduction of variable-length
+	// curves only have room for three curve points.
+	if len(def) > points {
+		return errors.Errorf(errFmtCurveCapacity, len(def), points)
+	}
+	for _, c := range curves {
+		if len(c.Curve) > points {
+			return errors.Wrapf(errors.Errorf(errFmtCurveCapacity, len(c.Curve), points), "curve '%s'", c.Name)
+		}
+	}
+
+	// Selectors of a kernel without LPM trie support would never match.
+	if sm, ok := ap.collection.Maps[curveSelectMap]; ok && len(curves) != 0 && sm.ABI().Type != ebpf.LPMTrie {
+		return errLPMTrieUnsupported
+	}
+
+	return nil
+}
+
+// configureCurves writes the given default curve and RateCurves into the
+// inactive bank of the probe's `config_ratecurve` map along with their
+// selectors, and then makes it the active bank. Unused curves and points
+// are marked as unused. Selectors of the previously active bank are
+// removed last, the ones that cannot be removed are retried before the bank
+// is written to again. If an error is returned, the active curves are
+// unchanged.
+// Must be called with configMu held.
+func (ap *Probe) configureCurves(def []CurvePoint, curves []RateCurve) error {
+
+	if err := ap.checkCurves(def, curves); err != nil {
+		return err
+	}
+
+	banks, slots, points, err := ap.curveLayout()
+	if err != nil {
+		return err
+	}
+
+	bank := ap.curveBank
+	if banks > 1 {
+		bank ^= 1
+	}
+
+	// All curves of the bank, indexed by slot.
+	all := make([][]CurvePoint, slots)
+	all[0] = def
+	for i, c := range curves {
+		all[i+1] = c.Curve
+	}
+
+	cm := ap.collection.Maps[curveMap]
+	for s, curve := range all {
+		base := (bank*uint32(slots) + uint32(s)) * uint32(2*points)
+
+		for i := 0; i < points; i++ {
+			age, rate := curveUnused, curveUnused
+			if i < len(curve) {
+				age, rate = curve[i].Age.Nanoseconds(), curve[i].Rate.Nanoseconds()
+			}
+
+			if err := cm.Put(base+curveAge(i), age); err != nil {
+				return errors.Wrapf(err, "curve %d point %d age in %s", s, i, curveMap)
+			}
+
+			if err := cm.Put(base+curveRate(i), rate); err != nil {
+				return errors.Wrapf(err, "curve %d point %d rate in %s", s, i, curveMap)
+			}
+		}
+	}
+
+	sm, haveSelect := ap.collection.Maps[curveSelectMap]
+
+	// Insert the selectors of the new bank before switching to it.
+	keys := curveSelectKeys(curves, uint8(bank))
+	if haveSelect {
+		for k := range ap.curveStale {
+			if err := sm.Delete(k); err != nil {
+				return errors.Wrapf(err, "removing stale selector from %s", curveSelectMap)
+			}
+			delete(ap.curveStale, k)
+		}
+		inserted := make(map[curveSelectKey]uint32, len(keys))
+		for k, slot := range keys {
+			if err := sm.Put(k, slot); err != nil {
+				ap.staleSelectors(inserted)
+				return errors.Wrapf(err, "inserting selector in %s", curveSelectMap)
+			}
+			inserted[k] = slot
+		}
+	}
+
+	if banks > 1 {
+		if err := ap.collection.Maps["config"].Put(configCurveBank, uint64(bank)); err != nil {
+			if haveSelect {
+				ap.staleSelectors(keys)
+			}
+			return errors.Wrap(err, "configCurveBank in config")
+		}
+	}
+
+	old := ap.curveKeys
+	ap.curveBank = bank
+	ap.curveKeys = keys
+
+	// Remove the selectors of the previous bank. The new curves are already
+	// active, so selectors that cannot be removed are retried later.
+	if haveSelect {
+		for k, slot := range old {
+			if _, ok := keys[k]; ok {
+				continue
+			}
+			if err := sm.Delete(k); err != nil {
+				ap.staleSelectors(map[curveSelectKey]uint32{k: slot})
+			}
+		}
+	}
+
+	return nil
+}
+
+// staleSelectors marks the given selectors of the inactive bank as stale after
+// configuring the curves failed, so they are removed before the bank is written
+// to again. Selectors of the active curves are never marked stale.
+// Must be called with configMu held.
+func (ap *Probe) staleSelectors(keys map[curveSelectKey]uint32) {
+
+	for k, slot := range keys {
+		if _, ok := ap.curveKeys[k]; ok {
+			continue
+		}
+		if ap.curveStale == nil {
+			ap.curveStale = make(map[curveSelectKey]uint32)
+		}
+		ap.curveStale[k] = slot
+	}
+}
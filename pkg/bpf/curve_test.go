@@ -0,0 +1,143 @@
+package bpf
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePortRange(t *testing.T) {
+
+	tests := []struct {
+		in  string
+		out PortRange
+		err bool
+	}{
+		{in: "22", out: PortRange{22, 22}},
+		{in: "5432-5439", out: PortRange{5432, 5439}},
+		{in: "0-65535", out: PortRange{0, 65535}},
+		{in: "100-99", err: true},
+		{in: "65536", err: true},
+		{in: "ssh", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			pr, err := ParsePortRange(tt.in)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.out, pr)
+			assert.Equal(t, tt.in, pr.String())
+		})
+	}
+}
+
+func TestPortPrefixes(t *testing.T) {
+
+	tests := []struct {
+		pr  PortRange
+		out []portPrefix
+	}{
+		{pr: PortRange{22, 22}, out: []portPrefix{{22, 16}}},
+		{pr: PortRange{0, 65535}, out: []portPrefix{{0, 0}}},
+		{pr: PortRange{8080, 8087}, out: []portPrefix{{8080, 13}}},
+		{pr: PortRange{1023, 1025}, out: []portPrefix{{1023, 16}, {1024, 15}}},
+		{pr: PortRange{65535, 65535}, out: []portPrefix{{65535, 16}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pr.String(), func(t *testing.T) {
+			assert.Equal(t, tt.out, portPrefixes(tt.pr))
+		})
+	}
+
+	// Every port in a range needs to be covered exactly once.
+	pr := PortRange{1000, 31337}
+	var count int
+	for _, pp := range portPrefixes(pr) {
+		size := 1 << (16 - pp.bits)
+		assert.Zero(t, int(pp.port)%size, "unaligned prefix %v", pp)
+		count += size
+	}
+	assert.Equal(t, int(pr.Last-pr.First)+1, count)
+}
+
+func TestCurveSelectKey(t *testing.T) {
+
+	b, err := curveSelectKey{prefixLen: 32, bank: 1, proto: 6, port: 5432}.MarshalBinary()
+	require.NoError(t, err)
+	assert.Equal(t, []byte{1, 6, 0x15, 0x38}, b[4:])
+}
+
+func TestVerifyCurves(t *testing.T) {
+
+	curve := []CurvePoint{{Age: 0, Rate: time.Second}}
+
+	tests := []struct {
+		name   string
+		curves []RateCurve
+		err    bool
+	}{
+		{name: "none"},
+		{name: "protocol", curves: []RateCurve{{Name: "udp", Protocol: 17, Curve: curve}}},
+		{name: "ports over protocol", curves: []RateCurve{
+			{Name: "tcp", Protocol: 6, Curve: curve},
+			{Name: "db", Protocol: 6, Ports: []PortRange{{5432, 5432}, {3306, 3306}}, Curve: curve},
+		}},
+		{name: "same ports other protocol", curves: []RateCurve{
+			{Name: "dns-udp", Protocol: 17, Ports: []PortRange{{53, 53}}, Curve: curve},
+			{Name: "dns-tcp", Protocol: 6, Ports: []PortRange{{53, 53}}, Curve: curve},
+		}},
+		{name: "no name", curves: []RateCurve{{Protocol: 6, Curve: curve}}, err: true},
+		{name: "no protocol", curves: []RateCurve{{Name: "any", Curve: curve}}, err: true},
+		{name: "no points", curves: []RateCurve{{Name: "tcp", Protocol: 6}}, err: true},
+		{name: "duplicate name", curves: []RateCurve{
+			{Name: "a", Protocol: 6, Curve: curve},
+			{Name: "a", Protocol: 17, Curve: curve},
+		}, err: true},
+		{name: "overlapping ports", curves: []RateCurve{
+			{Name: "a", Protocol: 6, Ports: []PortRange{{8000, 8100}}, Curve: curve},
+			{Name: "b", Protocol: 6, Ports: []PortRange{{8080, 8080}}, Curve: curve},
+		}, err: true},
+		{name: "overlapping protocol", curves: []RateCurve{
+			{Name: "a", Protocol: 6, Curve: curve},
+			{Name: "b", Protocol: 6, Curve: curve},
+		}, err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyCurves(tt.curves)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestSelectCurve(t *testing.T) {
+
+	def := []CurvePoint{{Age: 0, Rate: time.Second}}
+	tcp := []CurvePoint{{Age: 0, Rate: 2 * time.Second}}
+	db := []CurvePoint{{Age: time.Minute, Rate: 3 * time.Second}}
+
+	curves := []RateCurve{
+		{Name: "tcp", Protocol: 6, Curve: tcp},
+		{Name: "db", Protocol: 6, Ports: []PortRange{{5432, 5432}, {3306, 3306}}, Curve: db},
+	}
+
+	assert.Equal(t, db, selectCurve(def, curves, 6, 3306))
+	assert.Equal(t, tcp, selectCurve(def, curves, 6, 443))
+	assert.Equal(t, def, selectCurve(def, curves, 17, 3306))
+
+	assert.Equal(t, 3*time.Second, curveInterval(db, time.Hour))
+	assert.True(t, curveInterval(db, time.Second) < 0, "flow younger than first point")
+	assert.Equal(t, time.Second, curveInterval(def, 0))
+}
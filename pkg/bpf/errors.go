@@ -1,10 +1,26 @@
 package bpf
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 const (
 	errFmtSymNotFound = "kernel symbol '%s' not found, conntrack kernel module not loaded"
 	errKernelRelease  = "invalid kernel release version '%s'"
+	errFmtTransport   = "unknown event transport '%v'"
+	errFmtCIDR        = "invalid IPv4 or IPv6 prefix '%s'"
+
+	errFmtNetNSAllowDeny = "network namespace %d both allowed and denied"
+
+	errFmtCurveAge         = "curve point %d's Age needs to be higher than point %d's"
+	errFmtCurveAgeNegative = "curve point %d's Age cannot be negative"
+	errFmtCurveRate        = "curve point %d's Rate needs to be higher than zero"
+	errFmtCurveCapacity    = "curve has %d points, selected probe supports up to %d"
+	errFmtCurveDupName     = "duplicate curve name '%s'"
+	errFmtCurveProto       = "curve '%s' needs a protocol"
+	errFmtCurveOverlap     = "curves '%s' and '%s' match the same flows"
+	errFmtPortRange        = "invalid port range '%s'"
 )
 
 var (
@@ -12,9 +28,60 @@ var (
 
 	errProbeStarted    = errors.New("probe already running")
 	errProbeNotStarted = errors.New("probe is not running")
+	errProbeClosed     = errors.New("probe was stopped or closed")
+	errProbeOutdated   = errors.New("embedded probe was built from outdated sources, rebuild it with 'mage bpf:build'")
 
 	errDupConsumer = errors.New("a Consumer with the same name is already registered")
 	errNoConsumer  = errors.New("could not find the Consumer to delete")
 
 	errConsumerNil = errors.New("given Consumer is nil")
+
+	errLostChanNil = errors.New("given lost sample channel is nil")
+	errDupLostSub  = errors.New("channel is already subscribed to lost samples")
+	errNoLostSub   = errors.New("channel is not subscribed to lost samples")
+
+	errRingBufUnsupported = errors.New("BPF ring buffer not supported by the running kernel (requires 5.8)")
+	errRingClosed         = errors.New("ring buffer reader closed")
+	errRingBufSize        = errors.New("RingBufferSize needs to be a power of two and a multiple of the page size")
+
+	errFlowMapSize  = errors.New("FlowMapSize needs to be between 1 and 2^32-1")
+	errReapHorizon  = errors.New("ReapHorizon cannot be negative")
+	errDumpInterval = errors.New("DumpInterval cannot be negative")
+
+	errCurveLength            = errors.New("rate curve needs between 1 and 16 points")
+	errCurveCount             = errors.New("too many rate curves, up to 7 are supported besides the default curve")
+	errCurveName              = errors.New("rate curve needs a name")
+	errCurveSelectCount       = errors.New("rate curve ports split into too many port prefixes")
+	errCurveSelectUnsupported = errors.New("selected probe was built without support for multiple rate curves")
+
+	errLPMTrieUnsupported = errors.New("CIDR filters need LPM trie maps, not supported by the running kernel (requires 4.11)")
+	errFilterUnsupported  = errors.New("selected probe was built without support for filters")
+	errCIDRCount          = errors.New("too many prefixes in CIDR filter")
+	errNetNSCount         = errors.New("too many network namespaces in filter")
+	errConnmarkMask       = errors.New("ConnmarkValue has bits set outside of ConnmarkMask")
+	errMapNotFound        = errors.New("map not found in eBPF collection")
 )
+
+// ReadError is sent on a Probe's error channel when reading events from one
+// of its buffers fails.
+type ReadError struct {
+	// Name of the map or socket the failing reader is attached to.
+	Map string
+	// Fatal is set when the Probe stopped reading from the map
+	// after too many consecutive failures.
+	Fatal bool
+
+	Err error
+}
+
+func (e *ReadError) Error() string {
+	if e.Fatal {
+		return fmt.Sprintf("reading from %s (giving up): %s", e.Map, e.Err)
+	}
+	return fmt.Sprintf("reading from %s: %s", e.Map, e.Err)
+}
+
+// Cause returns the underlying error, for use with errors.Cause.
+func (e *ReadError) Cause() error {
+	return e.Err
+}
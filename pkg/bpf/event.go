@@ -7,6 +7,7 @@ import (
 	"sync"
 	"unsafe"
 
+	"golang.org/x/sys/unix"
 	"lukechampine.com/blake3"
 )
 
@@ -17,8 +18,52 @@ var hashPool = sync.Pool{
 	},
 }
 
+// flowIDContext is the context string for deriving flow ID hash keys
+// from a user-supplied secret.
+const flowIDContext = "conntracct 2020-04-01 flow id"
+
+// newFlowIDPool returns a pool of 64-bit blake3 hashers for generating
+// FlowID64 values. The hashers are keyed if secret is not empty.
+func newFlowIDPool(secret string) *sync.Pool {
+
+	var key []byte
+	if secret != "" {
+		key = make([]byte, 32)
+		blake3.DeriveKey(key, flowIDContext, []byte(secret))
+	}
+
+	return &sync.Pool{
+		New: func() interface{} {
+			return blake3.New(8, key)
+		},
+	}
+}
+
+// flowID64 returns the FlowID64 of ae using a hasher from the given pool.
+func flowID64(p *sync.Pool, ae *Event) uint64 {
+
+	h := p.Get().(*blake3.Hasher)
+	id := ae.hashFlow64(h)
+	h.Reset()
+	p.Put(h)
+
+	return id
+}
+
 // EventLength is the length of the struct sent by BPF.
-const EventLength = 104
+const EventLength = 152
+
+// eventTypeOffset is the offset of the type tag in the struct sent by BPF.
+const eventTypeOffset = 101
+
+// eventType is the type tag set by the BPF program on each event.
+// Matches enum event_type in the BPF program.
+type eventType uint8
+
+const (
+	eventUpdate  eventType = 1
+	eventDestroy eventType = 2
+)
 
 // Event is an accounting event delivered to userspace from the Probe.
 type Event struct {
@@ -37,6 +82,43 @@ type Event struct {
 	NetNS       uint32 `json:"netns"`
 	Proto       uint8  `json:"proto"`
 
+	// Address family of the flow, AF_INET or AF_INET6.
+	Family uint8 `json:"family"`
+
+	// FlowID64 is a 64-bit flow identifier that also includes the flow's
+	// start timestamp, so it doesn't repeat when a later flow with the
+	// same tuple reuses a connection's memory. Keyed by Config.FlowIDKey.
+	FlowID64 uint64 `json:"flow_id64,string"`
+
+	// Type, code and echo identifier of ICMP and ICMPv6 flows.
+	ICMPType uint8  `json:"icmp_type"`
+	ICMPCode uint8  `json:"icmp_code"`
+	ICMPID   uint16 `json:"icmp_id"`
+
+	// Status bits of the conntrack entry.
+	Status ConnStatus `json:"status"`
+	// Conntrack state of TCP flows, zero for other protocols.
+	TCPState TCPState `json:"tcp_state"`
+	// Conntrack zone ID of the flow.
+	Zone uint16 `json:"zone"`
+
+	// Addresses and ports of the flow's reply direction. These are the
+	// original tuple reversed, unless NAT was applied to the flow.
+	ReplySrcAddr net.IP `json:"reply_src_addr"`
+	ReplyDstAddr net.IP `json:"reply_dst_addr"`
+	ReplySrcPort uint16 `json:"reply_src_port"`
+	ReplyDstPort uint16 `json:"reply_dst_port"`
+
+	// SrcNAT is set if the flow's source address or port was translated,
+	// DstNAT if its destination was translated.
+	SrcNAT bool `json:"src_nat"`
+	DstNAT bool `json:"dst_nat"`
+
+	// Existing is set on synthetic events of flows that already existed
+	// when the Probe or NetlinkSource was started, generated from a dump
+	// of the conntrack table. See Config.SeedFlows.
+	Existing bool `json:"existing"`
+
 	connPtr uint64
 }
 
@@ -52,21 +134,9 @@ func (e *Event) unmarshalBinary(b []byte) error {
 	e.Timestamp = *(*uint64)(unsafe.Pointer(&b[8]))
 	e.connPtr = *(*uint64)(unsafe.Pointer(&b[16]))
 
-	// Build an IPv4 address if only the first four bytes
-	// of the nf_inet_addr union are filled.
-	// Assigning 4 bytes directly into IP() is incorrect,
-	// an IPv4 is stored in the last 4 bytes of an IP().
-	if isIPv4(b[24:40]) {
-		e.SrcAddr = net.IPv4(b[24], b[25], b[26], b[27])
-	} else {
-		e.SrcAddr = net.IP(b[24:40])
-	}
-
-	if isIPv4(b[40:56]) {
-		e.DstAddr = net.IPv4(b[40], b[41], b[42], b[43])
-	} else {
-		e.DstAddr = net.IP(b[40:56])
-	}
+	e.Family = b[103]
+	e.SrcAddr = inetAddr(e.Family, b[24:40])
+	e.DstAddr = inetAddr(e.Family, b[40:56])
 
 	e.PacketsOrig = *(*uint64)(unsafe.Pointer(&b[56]))
 	e.BytesOrig = *(*uint64)(unsafe.Pointer(&b[64]))
@@ -76,12 +146,32 @@ func (e *Event) unmarshalBinary(b []byte) error {
 	e.Connmark = *(*uint32)(unsafe.Pointer(&b[88]))
 	e.NetNS = *(*uint32)(unsafe.Pointer(&b[92]))
 
-	// Only extract ports for UDP and TCP.
+	// The tuple's port fields hold the ports of protocols that have them,
+	// and the echo identifier, type and code of ICMP flows.
 	e.Proto = b[100]
-	if e.Proto == 6 || e.Proto == 17 {
+	if hasPorts(e.Proto) {
 		e.SrcPort = binary.BigEndian.Uint16(b[96:98])
 		e.DstPort = binary.BigEndian.Uint16(b[98:100])
 	}
+	if isICMP(e.Proto) {
+		e.ICMPID = binary.BigEndian.Uint16(b[96:98])
+		e.ICMPType = b[98]
+		e.ICMPCode = b[99]
+	}
+
+	e.TCPState = TCPState(b[102])
+	e.Status = ConnStatus(*(*uint32)(unsafe.Pointer(&b[104])))
+	e.Zone = *(*uint16)(unsafe.Pointer(&b[108]))
+
+	e.ReplySrcAddr = inetAddr(e.Family, b[112:128])
+	e.ReplyDstAddr = inetAddr(e.Family, b[128:144])
+	if hasPorts(e.Proto) {
+		e.ReplySrcPort = binary.BigEndian.Uint16(b[144:146])
+		e.ReplyDstPort = binary.BigEndian.Uint16(b[146:148])
+	}
+
+	e.SrcNAT = e.Status&StatusSrcNAT != 0
+	e.DstNAT = e.Status&StatusDstNAT != 0
 
 	// Generate and set the Event's FlowID.
 	e.FlowID = e.hashFlow()
@@ -89,8 +179,9 @@ func (e *Event) unmarshalBinary(b []byte) error {
 	return nil
 }
 
-// hashFlow calculates a flow hash base on the the Event's
-// source and destination address, ports, protocol and connection ID.
+// hashFlow calculates a flow hash base on the the Event's source and
+// destination address, ports, protocol, ICMP type, code and identifier
+// and connection ID.
 func (e *Event) hashFlow() uint32 {
 
 	// Get a Hasher from the pool.
@@ -113,6 +204,12 @@ func (e *Event) hashFlow() uint32 {
 	// Protocol.
 	_, _ = h.Write([]byte{e.Proto})
 
+	// ICMP flows have no ports, tell them apart by their type, code and id.
+	if isICMP(e.Proto) {
+		binary.BigEndian.PutUint16(b, e.ICMPID)
+		_, _ = h.Write([]byte{e.ICMPType, e.ICMPCode, b[0], b[1]})
+	}
+
 	// nf_conn struct kernel pointer.
 	b = make([]byte, 8)
 	binary.LittleEndian.PutUint64(b, e.connPtr)
@@ -130,19 +227,70 @@ func (e *Event) hashFlow() uint32 {
 	return out
 }
 
+// hashFlow64 calculates a 64-bit flow hash over the fields of hashFlow and
+// the flow's start timestamp using the given Hasher. The Hasher is not reset.
+func (e *Event) hashFlow64(h *blake3.Hasher) uint64 {
+
+	b := make([]byte, 8)
+
+	// Family and addresses. The family is written first so IPv4 addresses
+	// cannot collide with IPv6 addresses that have the same bytes.
+	_, _ = h.Write([]byte{e.Family})
+	_, _ = h.Write(e.SrcAddr)
+	_, _ = h.Write(e.DstAddr)
+
+	// Ports, protocol, ICMP type, code and identifier.
+	binary.BigEndian.PutUint16(b[0:2], e.SrcPort)
+	binary.BigEndian.PutUint16(b[2:4], e.DstPort)
+	binary.BigEndian.PutUint16(b[4:6], e.ICMPID)
+	_, _ = h.Write(b[:6])
+	_, _ = h.Write([]byte{e.Proto, e.ICMPType, e.ICMPCode})
+
+	// nf_conn struct kernel pointer.
+	binary.LittleEndian.PutUint64(b, e.connPtr)
+	_, _ = h.Write(b)
+
+	// Flow start timestamp.
+	binary.LittleEndian.PutUint64(b, e.Start)
+	_, _ = h.Write(b)
+
+	return binary.LittleEndian.Uint64(h.Sum(nil))
+}
+
 // String returns a readable string representation of the Event.
 func (e *Event) String() string {
 	return fmt.Sprintf("%+v", *e)
 }
 
-// isIPv4 checks if everything but the first 4 bytes of a bytearray
-// are zero. The nf_inet_addr C struct holds an IPv4 address in the
-// first 4 bytes followed by zeroes. Does not execute a bounds check.
-func isIPv4(s []byte) bool {
-	for _, v := range s[4:] {
-		if v != 0 {
-			return false
-		}
+// hasPorts returns true if flows of the given layer 4 protocol
+// are identified by source and destination ports.
+func hasPorts(proto uint8) bool {
+	switch proto {
+	case unix.IPPROTO_TCP, unix.IPPROTO_UDP, unix.IPPROTO_DCCP,
+		unix.IPPROTO_SCTP, unix.IPPROTO_UDPLITE:
+		return true
 	}
-	return true
+	return false
+}
+
+// isICMP returns true if the given layer 4 protocol is ICMP or ICMPv6.
+func isICMP(proto uint8) bool {
+	return proto == unix.IPPROTO_ICMP || proto == unix.IPPROTO_ICMPV6
+}
+
+// inetAddr builds a net.IP from the 16 bytes of an nf_inet_addr union,
+// interpreted according to the given address family. Returns nil if the
+// family is unknown.
+func inetAddr(family uint8, b []byte) net.IP {
+	switch family {
+	case unix.AF_INET:
+		// An IPv4 address occupies the first four bytes of the union.
+		// Assigning 4 bytes directly into IP() is incorrect,
+		// an IPv4 is stored in the last 4 bytes of an IP().
+		return net.IPv4(b[0], b[1], b[2], b[3])
+	case unix.AF_INET6:
+		return net.IP(b[:net.IPv6len])
+	}
+
+	return nil
 }
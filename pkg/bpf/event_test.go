@@ -2,9 +2,14 @@ package bpf
 
 import (
 	"net"
+	"sync"
 	"testing"
+	"unsafe"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+	"lukechampine.com/blake3"
 )
 
 func TestHashFlow(t *testing.T) {
@@ -20,3 +25,193 @@ func TestHashFlow(t *testing.T) {
 
 	assert.Equal(t, uint32(0x97c684), e.hashFlow())
 }
+
+func TestHashFlow64(t *testing.T) {
+
+	e := Event{
+		Start:   1585699200000000000,
+		Family:  unix.AF_INET,
+		SrcAddr: net.ParseIP("1.2.3.4"),
+		DstAddr: net.ParseIP("5.6.7.8"),
+		SrcPort: 1234,
+		DstPort: 5678,
+		Proto:   6,
+		connPtr: 11111111111111111111,
+	}
+
+	hash := func(p *sync.Pool, e Event) uint64 {
+		h := p.Get().(*blake3.Hasher)
+		defer func() {
+			h.Reset()
+			p.Put(h)
+		}()
+		return e.hashFlow64(h)
+	}
+
+	unkeyed := newFlowIDPool("")
+	id := hash(unkeyed, e)
+
+	// Hashers are reset before being returned to the pool.
+	assert.Equal(t, id, hash(unkeyed, e))
+
+	// Keys must change the ID.
+	keyed := hash(newFlowIDPool("secret"), e)
+	assert.NotEqual(t, id, keyed)
+	assert.Equal(t, keyed, hash(newFlowIDPool("secret"), e))
+	assert.NotEqual(t, keyed, hash(newFlowIDPool("other"), e))
+
+	// A later flow reusing the same nf_conn with the same tuple.
+	later := e
+	later.Start++
+	assert.NotEqual(t, id, hash(unkeyed, later))
+}
+
+func TestHashFlowICMP(t *testing.T) {
+
+	e := Event{
+		SrcAddr:  net.ParseIP("1.2.3.4"),
+		DstAddr:  net.ParseIP("5.6.7.8"),
+		Proto:    1,
+		ICMPType: 8,
+		ICMPID:   1000,
+		connPtr:  11111111111111111111,
+	}
+
+	// Echo requests with different identifiers must not share a FlowID.
+	h := e.hashFlow()
+	e.ICMPID = 1001
+	assert.NotEqual(t, h, e.hashFlow())
+}
+
+func TestUnmarshalProtoFields(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		proto    uint8
+		src, dst uint16
+		icmpType uint8
+		icmpCode uint8
+		icmpID   uint16
+	}{
+		{name: "tcp", proto: unix.IPPROTO_TCP, src: 0x04d2, dst: 0x0050},
+		{name: "udplite", proto: unix.IPPROTO_UDPLITE, src: 0x04d2, dst: 0x0035},
+		{name: "dccp", proto: unix.IPPROTO_DCCP, src: 0x04d2, dst: 0x1389},
+		{name: "sctp", proto: unix.IPPROTO_SCTP, src: 0x0b59, dst: 0x0b59},
+		{name: "icmp", proto: unix.IPPROTO_ICMP, icmpID: 0x04d2, icmpType: 8, icmpCode: 0},
+		{name: "icmpv6", proto: unix.IPPROTO_ICMPV6, icmpID: 0x04d2, icmpType: 128, icmpCode: 0},
+		{name: "gre", proto: unix.IPPROTO_GRE},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := make([]byte, EventLength)
+			b[96], b[97], b[98], b[99] = 0x04, 0xd2, 0x00, 0x50
+			if tt.src != 0 {
+				b[96], b[97] = byte(tt.src>>8), byte(tt.src)
+				b[98], b[99] = byte(tt.dst>>8), byte(tt.dst)
+			}
+			if tt.icmpID != 0 {
+				b[98], b[99] = tt.icmpType, tt.icmpCode
+			}
+			b[100] = tt.proto
+
+			var e Event
+			require.NoError(t, e.unmarshalBinary(b))
+
+			assert.Equal(t, tt.src, e.SrcPort)
+			assert.Equal(t, tt.dst, e.DstPort)
+			assert.Equal(t, tt.icmpID, e.ICMPID)
+			assert.Equal(t, tt.icmpType, e.ICMPType)
+			assert.Equal(t, tt.icmpCode, e.ICMPCode)
+		})
+	}
+}
+
+func TestUnmarshalState(t *testing.T) {
+
+	b := make([]byte, EventLength)
+	b[100] = 6 // TCP
+	b[102] = uint8(TCPStateSynSent)
+	*(*uint32)(unsafe.Pointer(&b[104])) = uint32(StatusConfirmed | StatusSrcNAT)
+	*(*uint16)(unsafe.Pointer(&b[108])) = 42
+
+	var e Event
+	require.NoError(t, e.unmarshalBinary(b))
+
+	assert.Equal(t, TCPStateSynSent, e.TCPState)
+	assert.Equal(t, StatusConfirmed|StatusSrcNAT, e.Status)
+	assert.NotZero(t, e.Status&StatusNAT)
+	assert.EqualValues(t, 42, e.Zone)
+
+	assert.Error(t, e.unmarshalBinary(b[:EventLength-8]))
+}
+
+func TestUnmarshalReplyTuple(t *testing.T) {
+
+	b := make([]byte, EventLength)
+	copy(b[24:], net.ParseIP("10.0.0.5").To4())
+	copy(b[40:], net.ParseIP("8.8.8.8").To4())
+	b[96], b[97] = 0x04, 0xd2 // 1234
+	b[98], b[99] = 0x00, 0x35 // 53
+	b[100] = 17               // UDP
+	b[103] = unix.AF_INET
+	*(*uint32)(unsafe.Pointer(&b[104])) = uint32(StatusConfirmed | StatusSrcNAT)
+
+	// Reply direction, source-translated to 192.0.2.1:40000.
+	copy(b[112:], net.ParseIP("8.8.8.8").To4())
+	copy(b[128:], net.ParseIP("192.0.2.1").To4())
+	b[144], b[145] = 0x00, 0x35 // 53
+	b[146], b[147] = 0x9c, 0x40 // 40000
+
+	var e Event
+	require.NoError(t, e.unmarshalBinary(b))
+
+	assert.Equal(t, "8.8.8.8", e.ReplySrcAddr.String())
+	assert.Equal(t, "192.0.2.1", e.ReplyDstAddr.String())
+	assert.EqualValues(t, 53, e.ReplySrcPort)
+	assert.EqualValues(t, 40000, e.ReplyDstPort)
+	assert.True(t, e.SrcNAT)
+	assert.False(t, e.DstNAT)
+}
+
+func TestUnmarshalFamily(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		family   uint8
+		src, dst string
+	}{
+		{name: "ipv4", family: unix.AF_INET, src: "10.1.2.3", dst: "192.0.2.1"},
+		{name: "ipv6", family: unix.AF_INET6, src: "2001:db8:1::5", dst: "fd00::1"},
+		// Only the first four bytes of these IPv6 addresses are non-zero,
+		// they would be mistaken for IPv4 addresses without the family.
+		{name: "ipv6 trailing zeros", family: unix.AF_INET6, src: "2001:db8::", dst: "fe80::"},
+		{name: "ipv6 unspecified", family: unix.AF_INET6, src: "::", dst: "2001:db8::"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := make([]byte, EventLength)
+			b[103] = tt.family
+
+			src, dst := net.ParseIP(tt.src), net.ParseIP(tt.dst)
+			if tt.family == unix.AF_INET {
+				src, dst = src.To4(), dst.To4()
+			}
+			copy(b[24:40], src)
+			copy(b[40:56], dst)
+
+			var e Event
+			require.NoError(t, e.unmarshalBinary(b))
+
+			assert.Equal(t, tt.family, e.Family)
+			assert.Equal(t, tt.src, e.SrcAddr.String())
+			assert.Equal(t, tt.dst, e.DstAddr.String())
+		})
+	}
+
+	// Addresses of an unknown family are not decoded.
+	var e Event
+	require.NoError(t, e.unmarshalBinary(make([]byte, EventLength)))
+	assert.Nil(t, e.SrcAddr)
+}
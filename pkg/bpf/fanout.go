@@ -0,0 +1,49 @@
+package bpf
+
+import "sync"
+
+// fanout holds the Consumers and lost sample subscribers of an event source,
+// and delivers events and notifications to them.
+type fanout struct {
+	// List of event consumers of the source.
+	consumerMu sync.RWMutex
+	consumers  []*Consumer
+
+	// Subscribers to notifications of lost samples.
+	lostMu   sync.RWMutex
+	lostSubs []chan LostSamples
+}
+
+// fanoutEvent sends the given Event to all registered consumers.
+// The update flag specifies whether the event is an update (true) or destroy
+// (false) event.
+func (fo *fanout) fanoutEvent(ae Event, update bool) {
+
+	// Take a read lock on the consumers so we don't send to closed or already
+	// unregistered consumer channels.
+	fo.consumerMu.RLock()
+
+	for _, c := range fo.consumers {
+		// Require the update/destroy condition of the event to match
+		// the requested event type of the consumer.
+		if (update && c.WantUpdate()) || (!update && c.WantDestroy()) {
+			// Deliver according to the consumer's backpressure policy.
+			c.send(ae)
+		}
+	}
+
+	fo.consumerMu.RUnlock()
+}
+
+// flushConsumers delivers the events pending in all registered batch consumers.
+func (fo *fanout) flushConsumers() {
+
+	fo.consumerMu.RLock()
+	defer fo.consumerMu.RUnlock()
+
+	for _, c := range fo.consumers {
+		if c.batches != nil {
+			c.flush()
+		}
+	}
+}
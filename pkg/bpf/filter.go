@@ -0,0 +1,558 @@
+package bpf
+
+import (
+	"net"
+	"unsafe"
+
+	"github.com/cilium/ebpf"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	filterCIDRIncludeMap = "filter_cidr_include"
+	filterCIDRExcludeMap = "filter_cidr_exclude"
+	filterNetNSMap       = "filter_netns"
+	filterProtoMap       = "filter_proto"
+	filterStatsMap       = "filter_stats"
+
+	// Maximum amount of prefixes in each CIDR filter map.
+	filterCIDRMax = 1024
+	// Maximum amount of network namespaces in the netns filter map.
+	filterNetNSMax = 1024
+)
+
+// filterStat represents an index in the probe's `filter_stats` BPF array.
+type filterStat uint32
+
+// Enum of indices in the probe's `filter_stats` BPF array.
+const (
+	filterStatCIDRInclude filterStat = iota
+	filterStatCIDRExclude
+	filterStatNetNS
+	filterStatProto
+	filterStatConnmark
+)
+
+// Values of the entries in the probe's `filter_netns` map.
+const (
+	filterAllow uint8 = 1
+	filterDeny  uint8 = 2
+)
+
+// Filter holds the criteria the probe uses to decide which flows to ignore.
+// Filters are evaluated in the kernel, ignored flows never generate events.
+// A zero Filter lets all flows through.
+type Filter struct {
+	// CIDRInclude is a list of IPv4 and IPv6 prefixes. When not empty, only
+	// flows with a source or destination address within one of the prefixes
+	// are sampled. Requires Linux 4.11.
+	CIDRInclude []*net.IPNet
+
+	// CIDRExclude is a list of IPv4 and IPv6 prefixes. Flows with a source or
+	// destination address within one of the prefixes are never sampled.
+	CIDRExclude []*net.IPNet
+
+	// NetNSAllow is a list of network namespace inode numbers. When not empty,
+	// only flows in one of these namespaces are sampled.
+	NetNSAllow []uint32
+
+	// NetNSDeny is a list of network namespace inode numbers.
+	// Flows in these namespaces are never sampled.
+	NetNSDeny []uint32
+
+	// Protocols is a list of layer 4 protocol numbers. When not empty, only
+	// flows of these protocols are sampled.
+	Protocols []uint8
+
+	// When ConnmarkMask is non-zero, only flows with a connmark equal to
+	// ConnmarkValue after applying the mask are sampled.
+	ConnmarkValue uint32
+	ConnmarkMask  uint32
+}
+
+// empty returns true if the Filter does not ignore any flows.
+func (f Filter) empty() bool {
+	return len(f.CIDRInclude) == 0 && len(f.CIDRExclude) == 0 &&
+		len(f.NetNSAllow) == 0 && len(f.NetNSDeny) == 0 &&
+		len(f.Protocols) == 0 && f.ConnmarkMask == 0
+}
+
+// matchEvent returns true if the Event's flow is not ignored by the Filter.
+// Used for events that were not generated by the BPF program.
+func (f Filter) matchEvent(e Event) bool {
+
+	if len(f.NetNSAllow) != 0 && !matchNetNS(f.NetNSAllow, e.NetNS) {
+		return false
+	}
+	if matchNetNS(f.NetNSDeny, e.NetNS) {
+		return false
+	}
+
+	if len(f.Protocols) != 0 && !matchProto(f.Protocols, e.Proto) {
+		return false
+	}
+
+	if f.ConnmarkMask != 0 && e.Connmark&f.ConnmarkMask != f.ConnmarkValue {
+		return false
+	}
+
+	if len(f.CIDRInclude) != 0 && !matchCIDR(f.CIDRInclude, e.SrcAddr) && !matchCIDR(f.CIDRInclude, e.DstAddr) {
+		return false
+	}
+	if matchCIDR(f.CIDRExclude, e.SrcAddr) || matchCIDR(f.CIDRExclude, e.DstAddr) {
+		return false
+	}
+
+	return true
+}
+
+// verify checks the Filter for errors.
+func (f Filter) verify() error {
+
+	if len(f.CIDRInclude) > filterCIDRMax || len(f.CIDRExclude) > filterCIDRMax {
+		return errCIDRCount
+	}
+
+	for _, n := range append(f.CIDRInclude, f.CIDRExclude...) {
+		if _, err := newCIDRKey(n); err != nil {
+			return err
+		}
+	}
+
+	if len(f.netns()) > filterNetNSMax {
+		return errNetNSCount
+	}
+
+	for _, a := range f.NetNSAllow {
+		for _, d := range f.NetNSDeny {
+			if a == d {
+				return errors.Errorf(errFmtNetNSAllowDeny, a)
+			}
+		}
+	}
+
+	// Bits set outside of the mask would cause the filter to never match.
+	if f.ConnmarkValue&^f.ConnmarkMask != 0 {
+		return errConnmarkMask
+	}
+
+	return nil
+}
+
+// netns returns the Filter's network namespaces and their verdicts.
+func (f Filter) netns() map[uint32]uint8 {
+	out := make(map[uint32]uint8, len(f.NetNSAllow)+len(f.NetNSDeny))
+	for _, ns := range f.NetNSAllow {
+		out[ns] = filterAllow
+	}
+	for _, ns := range f.NetNSDeny {
+		out[ns] = filterDeny
+	}
+	return out
+}
+
+// cidrKey is a key in the probe's CIDR filter maps.
+type cidrKey struct {
+	// Length of the prefix, including the 32 bits of the address family.
+	prefixLen uint32
+	family    uint32
+	addr      [16]byte
+}
+
+// newCIDRKey returns the cidrKey of the given prefix.
+func newCIDRKey(n *net.IPNet) (cidrKey, error) {
+
+	ones, bits := n.Mask.Size()
+
+	var k cidrKey
+	switch {
+	case bits == 8*net.IPv4len && n.IP.To4() != nil:
+		k.family = unix.AF_INET
+		copy(k.addr[:], n.IP.To4())
+	case bits == 8*net.IPv6len && n.IP.To4() == nil:
+		k.family = unix.AF_INET6
+		copy(k.addr[:], n.IP.To16())
+	default:
+		return cidrKey{}, errors.Errorf(errFmtCIDR, n)
+	}
+
+	k.prefixLen = uint32(32 + ones)
+
+	return k, nil
+}
+
+// MarshalBinary marshals the cidrKey into its in-kernel representation.
+func (k cidrKey) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 24)
+	*(*uint32)(unsafe.Pointer(&b[0])) = k.prefixLen
+	*(*uint32)(unsafe.Pointer(&b[4])) = k.family
+	copy(b[8:], k.addr[:])
+	return b, nil
+}
+
+// cidrKeys returns the set of cidrKeys of a list of prefixes.
+// The prefixes are expected to be verified.
+func cidrKeys(cidrs []*net.IPNet) map[cidrKey]bool {
+	out := make(map[cidrKey]bool, len(cidrs))
+	for _, n := range cidrs {
+		k, _ := newCIDRKey(n)
+		out[k] = true
+	}
+	return out
+}
+
+// haveLPMTrie returns nil if the running kernel supports LPM trie maps.
+func haveLPMTrie() error {
+
+	m, err := ebpf.NewMap(&ebpf.MapSpec{
+		Type:       ebpf.LPMTrie,
+		KeySize:    8,
+		ValueSize:  1,
+		MaxEntries: 1,
+		Flags:      unix.BPF_F_NO_PREALLOC,
+	})
+	if err != nil {
+		return errLPMTrieUnsupported
+	}
+
+	return m.Close()
+}
+
+// prepareFilterMaps adjusts the CIDR filter maps in the CollectionSpec to the
+// features of the running kernel. On kernels without support for LPM trie
+// maps, they are replaced by plain hash maps, and no prefixes can be configured.
+func prepareFilterMaps(spec *ebpf.CollectionSpec, f Filter) error {
+
+	if haveLPMTrie() == nil {
+		return nil
+	}
+
+	if len(f.CIDRInclude) != 0 || len(f.CIDRExclude) != 0 {
+		return errLPMTrieUnsupported
+	}
+
+	for _, name := range []string{filterCIDRIncludeMap, filterCIDRExcludeMap} {
+		if m, ok := spec.Maps[name]; ok {
+			m.Type = ebpf.Hash
+		}
+	}
+
+	return nil
+}
+
+// SetFilter replaces the Probe's Filter. Takes effect immediately,
+// without reloading the probe. Flows that were ignored by the previous
+// Filter are sampled starting from their next update. Unlike rate curves,
+// the Filter is not swapped in atomically, its map entries are updated one
+// by one. If SetFilter fails, the previous Filter is restored.
+func (ap *Probe) SetFilter(f Filter) error {
+
+	if err := f.verify(); err != nil {
+		return errors.Wrap(err, "verifying filter")
+	}
+
+	if err := ap.checkFilter(f); err != nil {
+		return err
+	}
+
+	ap.filterMu.Lock()
+	defer ap.filterMu.Unlock()
+
+	if err := ap.applyFilter(f); err != nil {
+		_ = ap.revertFilter(f)
+		return err
+	}
+
+	return nil
+}
+
+// Filter returns the Probe's current Filter.
+func (ap *Probe) Filter() Filter {
+	ap.filterMu.Lock()
+	defer ap.filterMu.Unlock()
+
+	return ap.filter
+}
+
+// checkFilter returns an error if the given Filter cannot be applied to the probe.
+func (ap *Probe) checkFilter(f Filter) error {
+
+	if (len(f.CIDRInclude) != 0 || len(f.CIDRExclude) != 0) && haveLPMTrie() != nil {
+		return errLPMTrieUnsupported
+	}
+
+	// Probes built without filter support can only run without filters.
+	if _, ok := ap.collection.Maps[filterStatsMap]; !ok && !f.empty() {
+		return errFilterUnsupported
+	}
+
+	return nil
+}
+
+// applyFilter writes the given Filter into the probe's filter maps, replacing
+// the current one. New entries are inserted before the filters are enabled,
+// and entries of the previous Filter are removed last, so flows are never
+// evaluated against an incomplete set of entries.
+// Must be called with filterMu held.
+func (ap *Probe) applyFilter(f Filter) error {
+
+	// Probes built without filter support can only run without filters.
+	if _, ok := ap.collection.Maps[filterStatsMap]; !ok {
+		if !f.empty() {
+			return errFilterUnsupported
+		}
+		return nil
+	}
+
+	old := ap.filter
+
+	include, oldInclude := cidrKeys(f.CIDRInclude), cidrKeys(old.CIDRInclude)
+	exclude, oldExclude := cidrKeys(f.CIDRExclude), cidrKeys(old.CIDRExclude)
+	netns, oldNetNS := f.netns(), old.netns()
+
+	// Insert new entries.
+	if err := putCIDRs(ap.collection.Maps[filterCIDRIncludeMap], include); err != nil {
+		return errors.Wrap(err, filterCIDRIncludeMap)
+	}
+	if err := putCIDRs(ap.collection.Maps[filterCIDRExcludeMap], exclude); err != nil {
+		return errors.Wrap(err, filterCIDRExcludeMap)
+	}
+	if err := putNetNS(ap.collection.Maps[filterNetNSMap], netns); err != nil {
+		return errors.Wrap(err, filterNetNSMap)
+	}
+	if err := putProtos(ap.collection.Maps[filterProtoMap], f.Protocols, 1); err != nil {
+		return errors.Wrap(err, filterProtoMap)
+	}
+
+	// Enable or disable the filters. The connmark filter is disabled while
+	// its value is changed, its mask is written last to enable it.
+	type flag struct {
+		offset configOffset
+		value  uint64
+	}
+
+	flags := []flag{
+		{configCIDRInclude, boolValue(len(f.CIDRInclude) != 0)},
+		{configNetNSAllow, boolValue(len(f.NetNSAllow) != 0)},
+		{configProtoAllow, boolValue(len(f.Protocols) != 0)},
+	}
+	if f.ConnmarkValue != old.ConnmarkValue {
+		flags = append(flags, flag{configMarkMask, 0})
+	}
+	flags = append(flags,
+		flag{configMarkValue, uint64(f.ConnmarkValue)},
+		flag{configMarkMask, uint64(f.ConnmarkMask)},
+	)
+
+	configMap := ap.collection.Maps["config"]
+	for _, fl := range flags {
+		if err := configMap.Put(fl.offset, fl.value); err != nil {
+			return errors.Wrapf(err, "offset %d in config", fl.offset)
+		}
+	}
+
+	// Remove entries of the previous Filter.
+	if err := deleteCIDRs(ap.collection.Maps[filterCIDRIncludeMap], include, oldInclude); err != nil {
+		return errors.Wrap(err, filterCIDRIncludeMap)
+	}
+	if err := deleteCIDRs(ap.collection.Maps[filterCIDRExcludeMap], exclude, oldExclude); err != nil {
+		return errors.Wrap(err, filterCIDRExcludeMap)
+	}
+	if err := deleteNetNS(ap.collection.Maps[filterNetNSMap], netns, oldNetNS); err != nil {
+		return errors.Wrap(err, filterNetNSMap)
+	}
+	if err := putProtos(ap.collection.Maps[filterProtoMap], removedProtos(f.Protocols, old.Protocols), 0); err != nil {
+		return errors.Wrap(err, filterProtoMap)
+	}
+
+	ap.filter = f
+
+	return nil
+}
+
+// revertFilter restores the probe's current Filter in its filter maps after
+// applyFilter failed to apply Filter f part-way. Entries of f that are not part
+// of the current Filter are removed, skipping those that were never inserted.
+// Must be called with filterMu held.
+func (ap *Probe) revertFilter(f Filter) error {
+
+	if _, ok := ap.collection.Maps[filterStatsMap]; !ok {
+		return nil
+	}
+
+	cur := ap.filter
+
+	// Remove new entries, ignoring errors of entries that don't exist.
+	type cidrs struct {
+		m        string
+		cur, new []*net.IPNet
+	}
+	for _, c := range []cidrs{
+		{filterCIDRIncludeMap, cur.CIDRInclude, f.CIDRInclude},
+		{filterCIDRExcludeMap, cur.CIDRExclude, f.CIDRExclude},
+	} {
+		keep := cidrKeys(c.cur)
+		for k := range cidrKeys(c.new) {
+			if !keep[k] {
+				_ = ap.collection.Maps[c.m].Delete(k)
+			}
+		}
+	}
+
+	keep := cur.netns()
+	for ns := range f.netns() {
+		if _, ok := keep[ns]; !ok {
+			_ = ap.collection.Maps[filterNetNSMap].Delete(ns)
+		}
+	}
+	if err := putProtos(ap.collection.Maps[filterProtoMap], removedProtos(cur.Protocols, f.Protocols), 0); err != nil {
+		return errors.Wrap(err, filterProtoMap)
+	}
+
+	// Rewrite the current Filter's entries and flags.
+	return ap.applyFilter(cur)
+}
+
+// boolValue converts a bool into a value for the `config` map.
+func boolValue(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// putCIDRs inserts the given CIDR keys into a CIDR filter map.
+func putCIDRs(m *ebpf.Map, keys map[cidrKey]bool) error {
+
+	if m == nil {
+		return errMapNotFound
+	}
+
+	for k := range keys {
+		if err := m.Put(k, uint8(1)); err != nil {
+			return errors.Wrap(err, "inserting prefix")
+		}
+	}
+
+	return nil
+}
+
+// deleteCIDRs removes the CIDR keys in old that are not in cur from a CIDR filter map.
+func deleteCIDRs(m *ebpf.Map, cur, old map[cidrKey]bool) error {
+
+	if m == nil {
+		return errMapNotFound
+	}
+
+	for k := range old {
+		if cur[k] {
+			continue
+		}
+		if err := m.Delete(k); err != nil {
+			return errors.Wrap(err, "removing prefix")
+		}
+	}
+
+	return nil
+}
+
+// putNetNS inserts the given network namespaces and their verdicts
+// into the netns filter map.
+func putNetNS(m *ebpf.Map, netns map[uint32]uint8) error {
+
+	if m == nil {
+		return errMapNotFound
+	}
+
+	for ns, v := range netns {
+		if err := m.Put(ns, v); err != nil {
+			return errors.Wrapf(err, "inserting netns %d", ns)
+		}
+	}
+
+	return nil
+}
+
+// deleteNetNS removes the network namespaces in old that are not in cur
+// from the netns filter map.
+func deleteNetNS(m *ebpf.Map, cur, old map[uint32]uint8) error {
+
+	if m == nil {
+		return errMapNotFound
+	}
+
+	for ns := range old {
+		if _, ok := cur[ns]; ok {
+			continue
+		}
+		if err := m.Delete(ns); err != nil {
+			return errors.Wrapf(err, "removing netns %d", ns)
+		}
+	}
+
+	return nil
+}
+
+// putProtos sets the entries of the given protocols in the protocol filter map to v.
+func putProtos(m *ebpf.Map, protos []uint8, v uint8) error {
+
+	if m == nil {
+		return errMapNotFound
+	}
+
+	for _, p := range protos {
+		if err := m.Put(uint32(p), v); err != nil {
+			return errors.Wrapf(err, "setting protocol %d", p)
+		}
+	}
+
+	return nil
+}
+
+// removedProtos returns the protocols in old that are not in cur.
+func removedProtos(cur, old []uint8) []uint8 {
+
+	var keep [256]bool
+	for _, p := range cur {
+		keep[p] = true
+	}
+
+	var out []uint8
+	for _, p := range old {
+		if !keep[p] {
+			out = append(out, p)
+		}
+	}
+
+	return out
+}
+
+// filterStats sets the amount of flows ignored by each of the probe's
+// filters on s, summed across all CPUs. Counters that cannot be read
+// are left at zero.
+func (ap *Probe) filterStats(s *ProbeStats) {
+
+	m, ok := ap.collection.Maps[filterStatsMap]
+	if !ok {
+		return
+	}
+
+	sum := func(fs filterStat) uint64 {
+		var out uint64
+		var vals []uint64
+		if err := m.Lookup(uint32(fs), &vals); err != nil {
+			return 0
+		}
+		for _, v := range vals {
+			out += v
+		}
+		return out
+	}
+
+	s.FilteredCIDRInclude = sum(filterStatCIDRInclude)
+	s.FilteredCIDRExclude = sum(filterStatCIDRExclude)
+	s.FilteredNetNS = sum(filterStatNetNS)
+	s.FilteredProto = sum(filterStatProto)
+	s.FilteredConnmark = sum(filterStatConnmark)
+}
@@ -0,0 +1,87 @@
+package bpf
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestCIDRKey(t *testing.T) {
+
+	tests := []struct {
+		cidr   string
+		family uint32
+		plen   uint32
+		addr   []byte
+	}{
+		{cidr: "10.0.0.0/8", family: unix.AF_INET, plen: 40, addr: []byte{10, 0, 0, 0}},
+		{cidr: "192.168.1.1/32", family: unix.AF_INET, plen: 64, addr: []byte{192, 168, 1, 1}},
+		{cidr: "fd00::/8", family: unix.AF_INET6, plen: 40, addr: net.ParseIP("fd00::")},
+		{cidr: "::1/128", family: unix.AF_INET6, plen: 160, addr: net.ParseIP("::1")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.cidr, func(t *testing.T) {
+			_, n, err := net.ParseCIDR(tt.cidr)
+			require.NoError(t, err)
+
+			k, err := newCIDRKey(n)
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.family, k.family)
+			assert.Equal(t, tt.plen, k.prefixLen)
+
+			var addr [16]byte
+			copy(addr[:], tt.addr)
+			assert.Equal(t, addr, k.addr)
+
+			b, err := k.MarshalBinary()
+			require.NoError(t, err)
+			assert.Len(t, b, 24)
+		})
+	}
+
+	// IPv4 address with an IPv6 mask.
+	_, err := newCIDRKey(&net.IPNet{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(104, 128)})
+	assert.Error(t, err)
+}
+
+func TestFilterVerify(t *testing.T) {
+
+	_, n, err := net.ParseCIDR("10.0.0.0/8")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name string
+		f    Filter
+		err  bool
+	}{
+		{name: "empty"},
+		{name: "all", f: Filter{
+			CIDRInclude: []*net.IPNet{n}, NetNSAllow: []uint32{1}, NetNSDeny: []uint32{2},
+			Protocols: []uint8{6, 17}, ConnmarkValue: 0x10, ConnmarkMask: 0xf0,
+		}},
+		{name: "netns allow and deny", f: Filter{NetNSAllow: []uint32{1, 2}, NetNSDeny: []uint32{2}}, err: true},
+		{name: "connmark value outside mask", f: Filter{ConnmarkValue: 0x1, ConnmarkMask: 0xf0}, err: true},
+		{name: "too many prefixes", f: Filter{CIDRExclude: make([]*net.IPNet, filterCIDRMax+1)}, err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.f.verify()
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestRemovedProtos(t *testing.T) {
+	assert.Equal(t, []uint8{1, 58}, removedProtos([]uint8{6, 17}, []uint8{1, 6, 17, 58}))
+	assert.Nil(t, removedProtos([]uint8{6}, nil))
+}
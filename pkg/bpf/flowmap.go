@@ -0,0 +1,116 @@
+package bpf
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/cilium/ebpf"
+)
+
+const (
+	flowCooldownMap = "flow_cooldown"
+	flowOriginMap   = "flow_origin"
+	flowStatsMap    = "flow_stats"
+
+	// Size of the flow tracking maps if the host's
+	// nf_conntrack_max cannot be read.
+	defaultFlowMapSize = 65535
+
+	// flowMapSampleInterval is the interval at which the occupancy
+	// of the flow tracking maps is sampled.
+	flowMapSampleInterval = 10 * time.Second
+)
+
+// flowStat represents an index in the probe's `flow_stats` BPF array.
+type flowStat uint32
+
+// Enum of indices in the probe's `flow_stats` BPF array.
+const (
+	flowStatCooldownFull flowStat = iota
+	flowStatOriginFull
+)
+
+// prepareFlowMaps sizes the flow tracking and seed maps in spec to hold size entries.
+func prepareFlowMaps(spec *ebpf.CollectionSpec, size int) {
+	for _, name := range []string{flowCooldownMap, flowOriginMap, flowSeedMap} {
+		if m, ok := spec.Maps[name]; ok {
+			m.MaxEntries = uint32(size)
+		}
+	}
+}
+
+// flowMapWorker periodically counts the entries in the flow tracking maps
+// and records them in the Probe's stats. Exits when the Probe is stopped.
+func (ap *Probe) flowMapWorker() {
+
+	defer ap.workers.Done()
+
+	t := time.NewTicker(flowMapSampleInterval)
+	defer t.Stop()
+
+	for {
+		ap.sampleFlowMaps()
+
+		select {
+		case <-ap.done:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// sampleFlowMaps records the amount of entries in the flow tracking maps.
+func (ap *Probe) sampleFlowMaps() {
+	if m, ok := ap.collection.Maps[flowCooldownMap]; ok {
+		atomic.StoreUint64(&ap.stats.FlowCooldownEntries, mapEntries(m))
+	}
+	if m, ok := ap.collection.Maps[flowOriginMap]; ok {
+		atomic.StoreUint64(&ap.stats.FlowOriginEntries, mapEntries(m))
+	}
+}
+
+// mapEntries returns the amount of entries in a flow tracking map. The map is
+// modified by the BPF program while it is being iterated, so the result is an
+// approximation and may count entries twice. It is capped at the map's size.
+func mapEntries(m *ebpf.Map) uint64 {
+
+	var k, v uint64
+	var n uint64
+
+	it := m.Iterate()
+	for it.Next(&k, &v) {
+		n++
+	}
+
+	// Entries counted twice could make a full map appear to overflow.
+	if max := uint64(m.ABI().MaxEntries); n > max {
+		n = max
+	}
+
+	return n
+}
+
+// flowStats sets the amount of failed inserts into the flow tracking maps on s,
+// summed across all CPUs. Counters that cannot be read are left at zero.
+func (ap *Probe) flowStats(s *ProbeStats) {
+
+	m, ok := ap.collection.Maps[flowStatsMap]
+	if !ok {
+		return
+	}
+
+	sum := func(fs flowStat) uint64 {
+		var out uint64
+		var vals []uint64
+		if err := m.Lookup(uint32(fs), &vals); err != nil {
+			return 0
+		}
+		for _, v := range vals {
+			out += v
+		}
+		return out
+	}
+
+	s.FlowCooldownFull = sum(flowStatCooldownFull)
+	s.FlowOriginFull = sum(flowStatOriginFull)
+}
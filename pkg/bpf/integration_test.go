@@ -43,17 +43,10 @@ func TestMain(m *testing.M) {
 	var err error
 
 	cfg := Config{
-		Curve0: CurvePoint{
-			Age:  0 * time.Millisecond,
-			Rate: 10 * time.Millisecond,
-		},
-		Curve1: CurvePoint{
-			Age:  50 * time.Millisecond,
-			Rate: 25 * time.Millisecond,
-		},
-		Curve2: CurvePoint{
-			Age:  100 * time.Millisecond,
-			Rate: 50 * time.Millisecond,
+		Curve: []CurvePoint{
+			{Age: 0 * time.Millisecond, Rate: 10 * time.Millisecond},
+			{Age: 50 * time.Millisecond, Rate: 25 * time.Millisecond},
+			{Age: 100 * time.Millisecond, Rate: 50 * time.Millisecond},
 		},
 	}
 
@@ -265,6 +258,12 @@ func TestProbeVerify(t *testing.T) {
 	// Connmark (default 0)
 	assert.EqualValues(t, 0, ev.Connmark, ev.String())
 
+	// Conntrack state. The first event is sent when the flow is confirmed.
+	// TCP state is only set for TCP flows, zone defaults to 0.
+	assert.NotZero(t, ev.Status&StatusConfirmed, ev.String())
+	assert.Equal(t, TCPStateNone, ev.TCPState, ev.String())
+	assert.EqualValues(t, 0, ev.Zone, ev.String())
+
 	// Accounting
 	assert.EqualValues(t, 1, ev.PacketsOrig, ev.String())
 	assert.EqualValues(t, 31, ev.BytesOrig, ev.String())
@@ -277,6 +276,14 @@ func TestProbeVerify(t *testing.T) {
 	assert.EqualValues(t, net.IPv4(127, 0, 1, 1), ev.SrcAddr, ev.String())
 	assert.EqualValues(t, net.IPv4(127, 0, 1, 1), ev.DstAddr, ev.String())
 	assert.EqualValues(t, 17, ev.Proto, ev.String())
+	assert.EqualValues(t, unix.AF_INET, ev.Family, ev.String())
+
+	// Reply tuple is the original tuple reversed, no NAT applied.
+	assert.EqualValues(t, udpServ, ev.ReplySrcPort, ev.String())
+	assert.EqualValues(t, mc.ClientPort(), ev.ReplyDstPort, ev.String())
+	assert.EqualValues(t, ev.DstAddr, ev.ReplySrcAddr, ev.String())
+	assert.EqualValues(t, ev.SrcAddr, ev.ReplyDstAddr, ev.String())
+	assert.False(t, ev.SrcNAT || ev.DstNAT, ev.String())
 
 	start := ev.Start
 	ts := ev.Timestamp
@@ -297,6 +304,50 @@ func TestProbeVerify(t *testing.T) {
 	require.NoError(t, acctProbe.RemoveConsumer(ac))
 }
 
+// Replace the curve of the running probe with one that ignores young flows,
+// and check that it takes effect immediately and can be reverted.
+func TestProbeReconfigure(t *testing.T) {
+
+	orig := acctProbe.Config()
+	defer func() {
+		require.NoError(t, acctProbe.Reconfigure(orig))
+	}()
+
+	// Create and register consumer.
+	ac, in := newUpdateConsumer(t)
+
+	mc, _, cfn, err := prepareNetNS(udpServ)
+	require.NoError(t, err, "preparing netns")
+	defer cfn()
+
+	out := filterSourcePort(in, mc.ClientPort())
+
+	cfg := orig
+	cfg.Curve = []CurvePoint{{Age: time.Hour, Rate: time.Hour}}
+	require.NoError(t, acctProbe.Reconfigure(cfg))
+	assert.Equal(t, cfg.Curve, acctProbe.Config().Curve)
+
+	// Flows younger than an hour are ignored.
+	mc.Ping(1)
+	_, err = readTimeout(out, 5)
+	assert.EqualError(t, err, "timeout")
+
+	// An invalid curve is rejected and leaves the active curve untouched.
+	cfg.Curve = []CurvePoint{{Age: time.Hour, Rate: time.Hour}, {Age: 0, Rate: time.Second}}
+	require.Error(t, acctProbe.Reconfigure(cfg))
+	assert.Equal(t, time.Hour, acctProbe.Config().Curve[0].Age)
+
+	require.NoError(t, acctProbe.Reconfigure(orig))
+
+	// The flow's age was preserved across reconfigurations, so it is now
+	// sampled according to the original curve.
+	mc.Ping(1)
+	_, err = readTimeout(out, 5)
+	require.NoError(t, err)
+
+	require.NoError(t, acctProbe.RemoveConsumer(ac))
+}
+
 // filterSourcePort returns an unbuffered channel of Events
 // that has its event stream filtered by the given source port.
 func filterSourcePort(in chan Event, port uint16) chan Event {
@@ -0,0 +1,319 @@
+package bpf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/ti-mo/conntracct/pkg/kernel"
+)
+
+const (
+	// Sysfs directory of the kprobe PMU (Performance Monitoring Unit),
+	// available on Linux 4.17 and later.
+	kprobePMUPath = "/sys/bus/event_source/devices/kprobe"
+)
+
+var (
+	// Mount points of tracefs, in order of preference. Only used on kernels
+	// without a kprobe PMU. tracefs is mounted at /sys/kernel/tracing since
+	// Linux 4.1, and is automounted in debugfs for backwards compatibility.
+	tracefsPaths = []string{"/sys/kernel/tracing", "/sys/kernel/debug/tracing"}
+
+	errInvalidProbeKind = errors.New("only kprobe and kretprobe probes are supported")
+	errNoTracefs        = errors.New("tracefs not found in " + strings.Join(tracefsPaths, ", "))
+)
+
+func probeName(kind, symbol string) string {
+	return kind + "_" + symbol
+}
+
+func probeEventEntry(group, kind, symbol string) string {
+
+	k := "p"
+	if kind == "kretprobe" {
+		k = "r"
+	}
+	return fmt.Sprintf("%s:%s/%s %s", k, group, probeName(kind, symbol), symbol)
+}
+
+// kprobePMUType returns the dynamic type of the kprobe PMU, to be used as the
+// type of perf events created on it. Returns an error satisfying os.IsNotExist
+// if the running kernel does not have a kprobe PMU.
+func kprobePMUType() (uint32, error) {
+
+	fb, err := ioutil.ReadFile(path.Join(kprobePMUPath, "type"))
+	if err != nil {
+		return 0, err
+	}
+
+	t, err := strconv.ParseUint(strings.TrimSpace(string(fb)), 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid kprobe PMU type: %v", err)
+	}
+
+	return uint32(t), nil
+}
+
+// kprobePMURetBit returns the bit in the perf event's config field that needs
+// to be set to create a kretprobe on the kprobe PMU.
+func kprobePMURetBit() (uint64, error) {
+
+	fb, err := ioutil.ReadFile(path.Join(kprobePMUPath, "format", "retprobe"))
+	if err != nil {
+		return 0, err
+	}
+
+	// The file contains the location of the flag, eg. 'config:0'.
+	var bit uint64
+	if _, err := fmt.Sscanf(strings.TrimSpace(string(fb)), "config:%d", &bit); err != nil {
+		return 0, fmt.Errorf("invalid kprobe PMU retprobe format: %v", err)
+	}
+
+	return bit, nil
+}
+
+// openKprobePMU creates a perf event for the given kernel symbol on the kprobe
+// PMU. The kprobe is owned by the returned file descriptor and is removed
+// by the kernel when it is closed, including when the process exits.
+func openKprobePMU(pmuType uint32, kind, symbol string) (int, error) {
+
+	var config uint64
+	if kind == "kretprobe" {
+		bit, err := kprobePMURetBit()
+		if err != nil {
+			return 0, err
+		}
+		config |= 1 << bit
+	}
+
+	sp, err := unix.BytePtrFromString(symbol)
+	if err != nil {
+		return 0, err
+	}
+
+	attr := unix.PerfEventAttr{
+		Type:        pmuType,
+		Config:      config,
+		Sample_type: unix.PERF_SAMPLE_RAW,
+		Sample:      1,
+		Wakeup:      1,
+		// config1 holds a pointer to the name of the kernel symbol,
+		// config2 the offset into the symbol.
+		Ext1: uint64(uintptr(unsafe.Pointer(sp))),
+		Ext2: 0,
+	}
+	attr.Size = uint32(unsafe.Sizeof(attr))
+
+	efd, err := unix.PerfEventOpen(&attr, -1, 0, -1, unix.PERF_FLAG_FD_CLOEXEC)
+	runtime.KeepAlive(sp)
+	if err != nil {
+		return 0, fmt.Errorf("perf_event_open error: %v", err)
+	}
+
+	return efd, nil
+}
+
+// tracefsPath returns the first mount point of tracefs in tracefsPaths.
+func tracefsPath() (string, error) {
+	for _, p := range tracefsPaths {
+		if _, err := os.Stat(path.Join(p, "kprobe_events")); err == nil {
+			return p, nil
+		}
+	}
+	return "", errNoTracefs
+}
+
+func getTraceEventID(tracefs, group, name string) (int, error) {
+
+	fname := path.Join(tracefs, "events", group, name, "id")
+	fb, err := ioutil.ReadFile(fname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, err
+		}
+		return 0, fmt.Errorf("cannot read kprobe id: %v", err)
+	}
+
+	tid, err := strconv.Atoi(strings.TrimSpace(string(fb)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid kprobe id: %v", err)
+	}
+
+	return tid, nil
+}
+
+func openTraceEvent(tracefs, group, kind, symbol string) (int, error) {
+
+	traceEventsPath := path.Join(tracefs, "kprobe_events")
+
+	f, err := os.OpenFile(traceEventsPath, os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		return 0, fmt.Errorf("cannot open %s: %v", traceEventsPath, err)
+	}
+	defer f.Close()
+
+	pe := probeEventEntry(group, kind, symbol)
+	if _, err = f.WriteString(pe); err != nil {
+		return 0, fmt.Errorf("writing %q to kprobe_events: %v", pe, err)
+	}
+
+	tid, err := getTraceEventID(tracefs, group, probeName(kind, symbol))
+	if err != nil {
+		return 0, fmt.Errorf("getting trace event ID: %s", err)
+	}
+
+	return tid, nil
+}
+
+// openTracefsKprobe creates a kprobe for the given kernel symbol in tracefs
+// and opens a perf event on the resulting trace event. The kprobe persists
+// until it is explicitly removed from tracefs' kprobe_events.
+func openTracefsKprobe(tracefs, group, kind, symbol string) (int, error) {
+
+	tid, err := openTraceEvent(tracefs, group, kind, symbol)
+	if err != nil {
+		return 0, err
+	}
+
+	attr := unix.PerfEventAttr{
+		Type:        unix.PERF_TYPE_TRACEPOINT,
+		Sample_type: unix.PERF_SAMPLE_RAW,
+		Sample:      1,
+		Wakeup:      1,
+		Config:      uint64(tid),
+	}
+
+	// Create a perf event that fires each time the given tracepoint
+	// (kernel symbol) is hit.
+	efd, err := unix.PerfEventOpen(&attr, -1, 0, -1, unix.PERF_FLAG_FD_CLOEXEC)
+	if err != nil {
+		return 0, fmt.Errorf("perf_event_open error: %v", err)
+	}
+
+	return efd, nil
+}
+
+// openKprobe creates a perf event that fires each time the given kernel
+// symbol is hit. Uses the kprobe PMU if the kernel supports it, and falls
+// back to creating the kprobe in tracefs otherwise. Kprobes created in
+// tracefs are recorded in the Probe for removal in closeTraceEvents.
+func (ap *Probe) openKprobe(p kernel.Probe) (int, error) {
+
+	if p.Kind != "kprobe" && p.Kind != "kretprobe" {
+		return 0, errInvalidProbeKind
+	}
+
+	pmuType, err := kprobePMUType()
+	if err == nil {
+		return openKprobePMU(pmuType, p.Kind, p.Name)
+	}
+	if !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	// Kernel doesn't have a kprobe PMU, fall back to tracefs.
+	tracefs, err := tracefsPath()
+	if err != nil {
+		return 0, err
+	}
+
+	// Remove kprobes left behind by conntracct processes that did not
+	// shut down cleanly before creating the first kprobe in tracefs.
+	if ap.traceGroup == "" {
+		ap.tracefs = tracefs
+		ap.traceGroup = probeGroup()
+		if _, err := cleanupTraceGroups(tracefs); err != nil {
+			return 0, errors.Wrap(err, "removing stale kprobes")
+		}
+	}
+
+	efd, err := openTracefsKprobe(ap.tracefs, ap.traceGroup, p.Kind, p.Name)
+	if err != nil {
+		return 0, err
+	}
+
+	ap.traceEvents = append(ap.traceEvents, p)
+
+	return efd, nil
+}
+
+// closeTraceEvents removes all kprobes the Probe created in tracefs
+// and releases its trace group.
+func (ap *Probe) closeTraceEvents() error {
+
+	if ap.traceGroup == "" {
+		return nil
+	}
+
+	traceEventsPath := path.Join(ap.tracefs, "kprobe_events")
+
+	f, err := os.OpenFile(traceEventsPath, os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		return fmt.Errorf("cannot open %s: %v", traceEventsPath, err)
+	}
+	defer f.Close()
+
+	for _, p := range ap.traceEvents {
+		pe := fmt.Sprintf("-:%s/%s", ap.traceGroup, probeName(p.Kind, p.Name))
+		if _, err = f.WriteString(pe); err != nil {
+			return fmt.Errorf("writing %q to kprobe_events: %v", pe, err)
+		}
+	}
+
+	ap.traceEvents = nil
+
+	releaseProbeGroup(ap.traceGroup)
+	ap.traceGroup = ""
+
+	return nil
+}
+
+// perfEventOpenAttach creates a new perf event for the kernel symbol
+// described by p and binds a BPF program's progFd to it.
+func (ap *Probe) perfEventOpenAttach(p kernel.Probe, progFd int) error {
+
+	efd, err := ap.openKprobe(p)
+	if err != nil {
+		return err
+	}
+
+	// Store the FD for later teardown.
+	ap.perfEventFds = append(ap.perfEventFds, efd)
+
+	// Enable the perf event.
+	if err := unix.IoctlSetInt(efd, unix.PERF_EVENT_IOC_ENABLE, 0); err != nil {
+		return fmt.Errorf("enabling perf event: %v", err)
+	}
+
+	// Set the BPF program to execute each time the perf event fires.
+	if err := unix.IoctlSetInt(efd, unix.PERF_EVENT_IOC_SET_BPF, progFd); err != nil {
+		return fmt.Errorf("attaching bpf program to perf event: %v", err)
+	}
+
+	return nil
+}
+
+// perfEventDisable disables and closes all perf event efds stored in the Probe.
+func (ap *Probe) disablePerfEvents() error {
+	for _, efd := range ap.perfEventFds {
+		if err := unix.IoctlSetInt(efd, unix.PERF_EVENT_IOC_DISABLE, 0); err != nil {
+			return fmt.Errorf("disabling perf event: %v", err)
+		}
+
+		if err := unix.Close(efd); err != nil {
+			return fmt.Errorf("closing perf event fd: %v", err)
+		}
+	}
+	ap.perfEventFds = nil
+
+	return nil
+}
@@ -0,0 +1,180 @@
+package bpf
+
+import (
+	"fmt"
+	"time"
+)
+
+// ringBufLostInterval is the interval at which the BPF program's
+// lost sample counters are checked when using the ring buffer transport.
+const ringBufLostInterval = time.Second
+
+// BufferKind identifies the kernel buffer samples were lost from.
+type BufferKind uint8
+
+// Kinds of buffers used for delivering events to userspace.
+const (
+	BufferPerfUpdate BufferKind = iota + 1
+	BufferPerfDestroy
+	BufferRing
+	BufferNetlink
+)
+
+func (b BufferKind) String() string {
+	switch b {
+	case BufferPerfUpdate:
+		return "perf_update"
+	case BufferPerfDestroy:
+		return "perf_destroy"
+	case BufferRing:
+		return "ringbuf"
+	case BufferNetlink:
+		return "netlink"
+	}
+	return "unknown"
+}
+
+// LostSamples is a notification of samples lost by one of an event source's
+// buffers, usually because userspace didn't read them quickly enough.
+// Events of the affected flows are missing from the event stream.
+type LostSamples struct {
+	// Amount of samples lost. Zero if unknown, netlink
+	// sockets don't report the amount of events lost.
+	Count uint64
+	// Buffer the samples were lost from.
+	Buffer BufferKind
+	// CPU whose buffer lost the samples.
+	CPU int
+	// Time the loss was detected. Ring buffer losses are detected
+	// up to one second after they occurred.
+	Time time.Time
+}
+
+func (l LostSamples) String() string {
+	return fmt.Sprintf("%d samples lost from %s buffer on CPU %d at %s",
+		l.Count, l.Buffer, l.CPU, l.Time.Format(time.RFC3339Nano))
+}
+
+// SubscribeLost registers ch to receive a notification for every batch of
+// samples lost by the event source. Sends are non-blocking, notifications are
+// dropped when ch is full.
+func (fo *fanout) SubscribeLost(ch chan LostSamples) error {
+
+	if ch == nil {
+		return errLostChanNil
+	}
+
+	fo.lostMu.Lock()
+	defer fo.lostMu.Unlock()
+
+	for _, c := range fo.lostSubs {
+		if c == ch {
+			return errDupLostSub
+		}
+	}
+
+	fo.lostSubs = append(fo.lostSubs, ch)
+
+	return nil
+}
+
+// UnsubscribeLost removes ch from the event source's lost sample subscribers
+// and closes it.
+func (fo *fanout) UnsubscribeLost(ch chan LostSamples) error {
+
+	fo.lostMu.Lock()
+	defer fo.lostMu.Unlock()
+
+	for i, c := range fo.lostSubs {
+		if c == ch {
+			fo.lostSubs = append(fo.lostSubs[:i], fo.lostSubs[i+1:]...)
+			close(c)
+			return nil
+		}
+	}
+
+	return errNoLostSub
+}
+
+// notifyLost sends l to all of the event source's lost sample subscribers.
+func (fo *fanout) notifyLost(l LostSamples) {
+
+	fo.lostMu.RLock()
+	defer fo.lostMu.RUnlock()
+
+	for _, c := range fo.lostSubs {
+		select {
+		case c <- l:
+		default:
+		}
+	}
+}
+
+// ringBufLostWorker periodically checks the BPF program's counters of samples
+// that didn't fit into the ring buffer, and notifies subscribers of any
+// samples lost since the previous check. Exits when the Probe is stopped.
+func (ap *Probe) ringBufLostWorker() {
+
+	defer ap.workers.Done()
+
+	t := time.NewTicker(ringBufLostInterval)
+	defer t.Stop()
+
+	prev := ap.ringBufLostCPU()
+
+	for {
+		select {
+		case <-ap.done:
+			return
+		case <-t.C:
+		}
+
+		cur := ap.ringBufLostCPU()
+		now := time.Now()
+
+		for cpu := range cur {
+			if cpu >= len(prev) || cur[cpu] <= prev[cpu] {
+				continue
+			}
+
+			ap.notifyLost(LostSamples{
+				Count:  cur[cpu] - prev[cpu],
+				Buffer: BufferRing,
+				CPU:    cpu,
+				Time:   now,
+			})
+		}
+
+		prev = cur
+	}
+}
+
+// ringBufLostCPU returns the amount of events of any type the BPF program
+// failed to write to the ring buffer, indexed by CPU. Returns nil if the
+// counters cannot be read.
+func (ap *Probe) ringBufLostCPU() []uint64 {
+
+	m, ok := ap.collection.Maps[ringBufLostMap]
+	if !ok {
+		return nil
+	}
+
+	var out []uint64
+	for _, et := range []eventType{eventUpdate, eventDestroy} {
+		var vals []uint64
+		if err := m.Lookup(uint32(et), &vals); err != nil {
+			return nil
+		}
+
+		if out == nil {
+			out = make([]uint64, len(vals))
+		}
+		for cpu, v := range vals {
+			if cpu < len(out) {
+				out[cpu] += v
+			}
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,34 @@
+package bpf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubscribeLost(t *testing.T) {
+
+	var ap Probe
+
+	assert.Error(t, ap.SubscribeLost(nil))
+
+	ch := make(chan LostSamples, 1)
+	require.NoError(t, ap.SubscribeLost(ch))
+	assert.Error(t, ap.SubscribeLost(ch))
+
+	l := LostSamples{Count: 42, Buffer: BufferPerfUpdate, CPU: 3}
+	ap.notifyLost(l)
+
+	// Notifications are dropped when the channel is full.
+	ap.notifyLost(LostSamples{Count: 1})
+
+	assert.Equal(t, l, <-ch)
+	assert.Len(t, ch, 0)
+
+	require.NoError(t, ap.UnsubscribeLost(ch))
+	assert.Error(t, ap.UnsubscribeLost(ch))
+
+	_, ok := <-ch
+	assert.False(t, ok, "channel must be closed")
+}
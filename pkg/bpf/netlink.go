@@ -0,0 +1,563 @@
+package bpf
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/ti-mo/conntracct/pkg/ctnetlink"
+)
+
+const (
+	// defaultDumpInterval is the default interval at which a NetlinkSource
+	// dumps the conntrack table.
+	defaultDumpInterval = 10 * time.Second
+
+	// netlinkReadBufferSize is the size in bytes of the receive buffer of
+	// a NetlinkSource's event socket. Capped by net.core.rmem_max.
+	netlinkReadBufferSize = 8 << 20
+
+	// Names of a NetlinkSource's sockets in ReadErrors.
+	netlinkEvents = "ctnetlink events"
+	netlinkDump   = "ctnetlink dump"
+
+	// transportNetlink is the transport reported in a NetlinkSource's stats.
+	transportNetlink = "netlink"
+)
+
+// NetlinkSource generates the same Events as a Probe from the kernel's
+// conntrack netlink interface (ctnetlink), for hosts that don't permit loading
+// BPF programs or creating kprobes. It needs the nf_conntrack_netlink kernel
+// module, and its Events are less accurate than those of a Probe:
+//
+// Update events are generated by periodically dumping the conntrack table,
+// since ctnetlink only includes counters and start timestamps in destroy
+// events. Rate curves are applied at the granularity of Config.DumpInterval,
+// and new flows are first reported by the dump following their creation.
+//
+// Only flows in the caller's network namespace are seen. Events are lost
+// when the receive buffer of the event socket overruns, which is reported
+// as LostSamples with an unknown Count.
+type NetlinkSource struct {
+
+	// Sockets receiving conntrack events and dumping the conntrack table.
+	events *ctnetlink.Conn
+	dumps  *ctnetlink.Conn
+
+	// Configuration the source was created with, defaults applied.
+	// Curves and Filter are updated by Reconfigure and SetFilter.
+	configMu sync.Mutex
+	config   Config
+
+	// Pool of (optionally keyed) hashers generating Events' FlowID64.
+	flowIDs *sync.Pool
+
+	// Inode number of the network namespace of the source's sockets.
+	netns uint32
+
+	// Rate limiting state of known flows, indexed by their conntrack ID.
+	// generation is incremented by every dump of the conntrack table.
+	flowsMu    sync.Mutex
+	flows      map[uint32]*netlinkFlow
+	generation uint64
+
+	// Event consumers and subscribers to notifications of lost samples.
+	fanout
+
+	// Closed when the NetlinkSource is stopped.
+	done chan struct{}
+
+	// Errors encountered by the workers, and a WaitGroup tracking them.
+	errors  chan error
+	workers sync.WaitGroup
+
+	// Started status of the source. A closed source has released
+	// its sockets and cannot be started again.
+	startMu sync.Mutex
+	started bool
+	closed  bool
+
+	stats *ProbeStats
+}
+
+// netlinkFlow is the rate limiting state of a flow known to a NetlinkSource.
+type netlinkFlow struct {
+	// Time the flow was created and the time it may send its next update
+	// event, in nanoseconds since boot.
+	origin uint64
+	next   uint64
+
+	// Dump generation the flow was last seen in.
+	generation uint64
+}
+
+// NewNetlinkSource instantiates a NetlinkSource using the given Config, and
+// subscribes to conntrack events. Events are not delivered until it is started.
+// The Config's Transport and buffer sizes are ignored.
+func NewNetlinkSource(cfg Config) (*NetlinkSource, error) {
+
+	cfg.probeDefaults()
+
+	if err := probeConfigVerify(cfg); err != nil {
+		return nil, errors.Wrap(err, "verifying probe configuration")
+	}
+
+	netns, err := selfNetNS()
+	if err != nil {
+		return nil, err
+	}
+
+	ns := NetlinkSource{
+		config:  cfg,
+		flowIDs: newFlowIDPool(cfg.FlowIDKey),
+		netns:   netns,
+		flows:   make(map[uint32]*netlinkFlow),
+		errors:  make(chan error, errorsBufferSize),
+		stats: &ProbeStats{
+			Transport:   transportNetlink,
+			BufferSize:  netlinkReadBufferSize,
+			FlowMapSize: uint64(cfg.FlowMapSize),
+		},
+	}
+
+	if err := ns.open(); err != nil {
+		ns.close()
+		return nil, err
+	}
+
+	return &ns, nil
+}
+
+// open opens the NetlinkSource's sockets and subscribes to conntrack events.
+func (ns *NetlinkSource) open() error {
+
+	c, err := ctnetlink.Dial()
+	if err != nil {
+		return err
+	}
+	ns.events = c
+
+	// The kernel caps the buffer at net.core.rmem_max,
+	// run with a smaller buffer if it cannot be set.
+	_ = c.SetReadBuffer(netlinkReadBufferSize)
+
+	if err := c.Subscribe(ctnetlink.GroupNew, ctnetlink.GroupUpdate, ctnetlink.GroupDestroy); err != nil {
+		return errors.Wrap(err, "subscribing to conntrack events")
+	}
+
+	c, err = ctnetlink.Dial()
+	if err != nil {
+		return err
+	}
+	ns.dumps = c
+
+	return nil
+}
+
+// close closes the NetlinkSource's sockets.
+func (ns *NetlinkSource) close() error {
+
+	var err error
+	for _, c := range []*ctnetlink.Conn{ns.events, ns.dumps} {
+		if c == nil {
+			continue
+		}
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
+
+// Start starts receiving conntrack events and dumping the conntrack table.
+// Flows found in the first dump are reported with their Existing flag set.
+func (ns *NetlinkSource) Start() error {
+
+	ns.startMu.Lock()
+	defer ns.startMu.Unlock()
+
+	if ns.started {
+		return errProbeStarted
+	}
+
+	if ns.closed {
+		return errProbeClosed
+	}
+
+	ns.done = make(chan struct{})
+
+	ns.workers.Add(2)
+	go ns.eventWorker()
+	go ns.dumpWorker()
+
+	ns.started = true
+
+	return nil
+}
+
+// Stop stops the NetlinkSource's workers and closes its sockets.
+// Closes the source's error channel. Can only be called after Start(),
+// a stopped NetlinkSource cannot be started again.
+func (ns *NetlinkSource) Stop() error {
+
+	ns.startMu.Lock()
+	defer ns.startMu.Unlock()
+
+	if !ns.started {
+		return errProbeNotStarted
+	}
+
+	ns.started = false
+	ns.closed = true
+
+	close(ns.done)
+
+	// Unblock the event worker waiting for the next event. If the deadline
+	// cannot be set, the worker exits after receiving its next event.
+	err := ns.events.SetReadDeadline(time.Now())
+	if err != nil {
+		err = errors.Wrap(err, "unblocking event worker")
+	}
+
+	// Wait for the workers to exit before closing the error channel
+	// they are writing to.
+	ns.workers.Wait()
+	close(ns.errors)
+
+	// Deliver events still pending in batch consumers.
+	ns.flushConsumers()
+
+	if cerr := ns.close(); cerr != nil && err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// Errors returns a channel receiving errors encountered while receiving
+// events or dumping the conntrack table, usually a *ReadError. Errors are
+// dropped if the channel is not drained. A Fatal ReadError means the source
+// stopped receiving events and needs to be replaced. The channel is closed
+// by Stop.
+func (ns *NetlinkSource) Errors() <-chan error {
+	return ns.errors
+}
+
+// Stats returns a snapshot copy of the NetlinkSource's statistics.
+func (ns *NetlinkSource) Stats() ProbeStats {
+
+	s := ns.stats.Get()
+
+	// Messages that could not be decoded are counted by the sockets.
+	s.PerfEventsMalformed = ns.events.Skipped() + ns.dumps.Skipped()
+
+	return s
+}
+
+// Config returns the NetlinkSource's effective configuration,
+// including any changes made by Reconfigure and SetFilter.
+func (ns *NetlinkSource) Config() Config {
+
+	ns.configMu.Lock()
+	defer ns.configMu.Unlock()
+
+	return ns.config
+}
+
+// Filter returns the Filter currently applied by the NetlinkSource.
+func (ns *NetlinkSource) Filter() Filter {
+
+	ns.configMu.Lock()
+	defer ns.configMu.Unlock()
+
+	return ns.config.Filter
+}
+
+// SetFilter replaces the NetlinkSource's Filter. Flows that are no longer
+// matched by the Filter stop generating events.
+func (ns *NetlinkSource) SetFilter(f Filter) error {
+
+	if err := f.verify(); err != nil {
+		return errors.Wrap(err, "verifying filter")
+	}
+
+	ns.configMu.Lock()
+	defer ns.configMu.Unlock()
+
+	ns.config.Filter = f
+
+	return nil
+}
+
+// Reconfigure replaces the rate curves and filter of the NetlinkSource.
+// Known flows keep their age and current update interval. The source's
+// map size, DumpInterval and FlowIDKey cannot be changed after it is
+// created, their values in cfg are ignored.
+func (ns *NetlinkSource) Reconfigure(cfg Config) error {
+
+	ns.configMu.Lock()
+	defer ns.configMu.Unlock()
+
+	cfg.Transport = ns.config.Transport
+	cfg.RingBufferSize = ns.config.RingBufferSize
+	cfg.PerfBufferSize = ns.config.PerfBufferSize
+	cfg.FlowMapSize = ns.config.FlowMapSize
+	cfg.ReapHorizon = ns.config.ReapHorizon
+	cfg.DumpInterval = ns.config.DumpInterval
+	cfg.FlowIDKey = ns.config.FlowIDKey
+
+	cfg.probeDefaults()
+
+	if err := probeConfigVerify(cfg); err != nil {
+		return errors.Wrap(err, "verifying probe configuration")
+	}
+
+	ns.config = cfg
+
+	return nil
+}
+
+// eventWorker receives conntrack events, converts them into Events and sends
+// them on all registered consumers' event channels. Exits when the
+// NetlinkSource is stopped.
+func (ns *NetlinkSource) eventWorker() {
+
+	defer ns.workers.Done()
+
+	var failed int
+	for {
+		evs, err := ns.events.Receive()
+		if err != nil {
+			select {
+			case <-ns.done:
+				return
+			default:
+			}
+
+			// The socket's buffer overran, notify subscribers
+			// and keep receiving.
+			if ctnetlink.IsOverrun(err) {
+				atomic.AddUint64(&ns.stats.NetlinkOverruns, 1)
+				ns.notifyLost(LostSamples{
+					Buffer: BufferNetlink,
+					Time:   time.Now(),
+				})
+				continue
+			}
+
+			if ns.readFailed(netlinkEvents, err, &failed) {
+				return
+			}
+			continue
+		}
+		failed = 0
+
+		ts, err := ktime()
+		if err != nil {
+			continue
+		}
+
+		for _, ev := range evs {
+			ns.handleEvent(ev, ts)
+		}
+	}
+}
+
+// handleEvent processes a conntrack event received at ts. Destroyed flows
+// generate a destroy event. New and updated flows are only tracked, their
+// events lack the flow's start timestamp and would get a different Start and
+// FlowID64 than the flow's later events. The next dump samples them instead.
+func (ns *NetlinkSource) handleEvent(ev ctnetlink.Event, ts uint64) {
+
+	if ev.Type == ctnetlink.EventDestroy {
+		ns.flowsMu.Lock()
+		delete(ns.flows, ev.Flow.ID)
+		ns.flowsMu.Unlock()
+
+		if ae, ok := ns.event(ev.Flow, ts); ok {
+			atomic.AddUint64(&ns.stats.PerfEventsDestroy, 1)
+			atomic.AddUint64(&ns.stats.PerfEventsTotal, 1)
+			ns.fanoutEvent(ae, false)
+		}
+		return
+	}
+
+	if _, ok := ns.event(ev.Flow, ts); !ok {
+		return
+	}
+
+	ns.flowsMu.Lock()
+	ns.track(ev.Flow.ID, ts)
+	ns.flowsMu.Unlock()
+}
+
+// dumpWorker periodically dumps the conntrack table and generates update
+// events for the flows whose rate curve allows it. The first dump happens
+// immediately. Exits when the NetlinkSource is stopped.
+func (ns *NetlinkSource) dumpWorker() {
+
+	defer ns.workers.Done()
+
+	t := time.NewTicker(ns.Config().DumpInterval)
+	defer t.Stop()
+
+	existing := true
+	var failed int
+	for {
+		flows, err := ns.dumps.Dump()
+		if err != nil {
+			if ns.readFailed(netlinkDump, err, &failed) {
+				return
+			}
+		} else {
+			failed = 0
+			ns.dumpFlows(flows, existing)
+			existing = false
+		}
+
+		select {
+		case <-ns.done:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// dumpFlows generates update events for the dumped flows whose rate curve
+// allows it, and forgets flows that are no longer in the conntrack table, eg.
+// because their destroy events were lost. Flows that are not yet known are
+// tracked using their start timestamp as their origin, if available.
+func (ns *NetlinkSource) dumpFlows(flows []ctnetlink.Flow, existing bool) {
+
+	mono, err := ktime()
+	if err != nil {
+		return
+	}
+	wall := uint64(time.Now().UnixNano())
+
+	ns.flowsMu.Lock()
+	ns.generation++
+	gen := ns.generation
+	ns.flowsMu.Unlock()
+
+	for _, f := range flows {
+		ae, ok := ns.event(f, mono)
+		if !ok {
+			continue
+		}
+		ae.Existing = existing
+
+		origin, ok := flowOrigin(f, mono, wall)
+		if !ok {
+			origin = mono
+		}
+
+		ns.flowsMu.Lock()
+		fl := ns.track(f.ID, origin)
+		send := ns.sample(fl, &ae, mono)
+		ns.flowsMu.Unlock()
+
+		if send {
+			atomic.AddUint64(&ns.stats.PerfEventsUpdate, 1)
+			atomic.AddUint64(&ns.stats.PerfEventsTotal, 1)
+			ns.fanoutEvent(ae, true)
+		}
+	}
+
+	// Flows tracked while the table was being dumped are part of
+	// the current generation and are kept.
+	ns.flowsMu.Lock()
+	for id, fl := range ns.flows {
+		if fl.generation < gen {
+			delete(ns.flows, id)
+		}
+	}
+	atomic.StoreUint64(&ns.stats.FlowOriginEntries, uint64(len(ns.flows)))
+	ns.flowsMu.Unlock()
+}
+
+// track returns the state of the flow with the given conntrack ID, tracking
+// it using the given origin if it is not yet known. If the source already
+// tracks FlowMapSize flows, returns state that is not stored, so the flow is
+// not rate limited. Must be called with flowsMu held.
+func (ns *NetlinkSource) track(id uint32, origin uint64) *netlinkFlow {
+
+	if fl, ok := ns.flows[id]; ok {
+		fl.generation = ns.generation
+		return fl
+	}
+
+	fl := &netlinkFlow{origin: origin, generation: ns.generation}
+
+	if uint64(len(ns.flows)) >= ns.stats.FlowMapSize {
+		atomic.AddUint64(&ns.stats.FlowOriginFull, 1)
+		return fl
+	}
+
+	ns.flows[id] = fl
+
+	return fl
+}
+
+// sample returns true if the flow with the given state may generate an
+// update event at ts, and starts its next cooldown period. The rate curve
+// is selected using the protocol and destination port of ae.
+// Must be called with flowsMu held.
+func (ns *NetlinkSource) sample(fl *netlinkFlow, ae *Event, ts uint64) bool {
+
+	if ts < fl.next {
+		return false
+	}
+
+	ns.configMu.Lock()
+	curve := selectCurve(ns.config.Curve, ns.config.Curves, ae.Proto, ae.DstPort)
+	ns.configMu.Unlock()
+
+	var age time.Duration
+	if ts > fl.origin {
+		age = time.Duration(ts - fl.origin)
+	}
+
+	// Flows younger than the curve's first point are ignored.
+	interval := curveInterval(curve, age)
+	if interval < 0 {
+		return false
+	}
+
+	fl.next = ts + uint64(interval)
+
+	return true
+}
+
+// event converts a flow into an Event at time ts. Returns false if the
+// flow is ignored by the NetlinkSource's Filter.
+func (ns *NetlinkSource) event(f ctnetlink.Flow, ts uint64) (Event, bool) {
+
+	ae := EventFromFlow(f, ns.netns, ts)
+	if !ns.Filter().matchEvent(ae) {
+		return Event{}, false
+	}
+
+	ae.FlowID64 = flowID64(ns.flowIDs, &ae)
+
+	return ae, true
+}
+
+// readFailed delivers a ReadError for a failed read from the socket named s
+// on the NetlinkSource's error channel, like Probe.readFailed.
+func (ns *NetlinkSource) readFailed(s string, err error, failed *int) bool {
+
+	*failed++
+	fatal := *failed >= readErrorLimit
+
+	// Never block the worker, drop the error if nobody is receiving.
+	select {
+	case ns.errors <- &ReadError{Map: s, Err: err, Fatal: fatal}:
+	default:
+	}
+
+	return fatal
+}
@@ -0,0 +1,83 @@
+package bpf
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+
+	"github.com/ti-mo/conntracct/pkg/ctnetlink"
+)
+
+func TestNetlinkSourceEvents(t *testing.T) {
+
+	cfg := Config{Curve: []CurvePoint{{Age: 0, Rate: 20 * time.Second}}, FlowMapSize: 2}
+	ns := NetlinkSource{
+		config:  cfg,
+		flowIDs: newFlowIDPool(""),
+		flows:   make(map[uint32]*netlinkFlow),
+		stats:   &ProbeStats{FlowMapSize: 2},
+	}
+
+	c := NewConsumer("test", make(chan Event, 16), ConsumerAll)
+	require.NoError(t, ns.RegisterConsumer(c))
+
+	flow := func(id uint32) ctnetlink.Flow {
+		return ctnetlink.Flow{
+			Family: unix.AF_INET,
+			ID:     id,
+			Orig: ctnetlink.Tuple{
+				SrcAddr: net.IP{10, 0, 0, 1},
+				DstAddr: net.IP{10, 0, 0, 2},
+				Proto:   unix.IPPROTO_UDP,
+				SrcPort: 40000,
+				DstPort: 53,
+			},
+		}
+	}
+
+	// Dumps are timestamped using the current time.
+	now, err := ktime()
+	require.NoError(t, err)
+
+	// New and updated flows are only tracked.
+	ns.handleEvent(ctnetlink.Event{Type: ctnetlink.EventNew, Flow: flow(1)}, now)
+	ns.handleEvent(ctnetlink.Event{Type: ctnetlink.EventUpdate, Flow: flow(2)}, now)
+	assert.Empty(t, c.events)
+	assert.Len(t, ns.flows, 2)
+
+	// Tracked flows are sampled by the next dump, flow 3 doesn't fit
+	// and is not rate limited.
+	ns.dumpFlows([]ctnetlink.Flow{flow(1), flow(2), flow(3)}, true)
+	require.Len(t, c.events, 3)
+	for i := 0; i < 3; i++ {
+		e := <-c.events
+		assert.True(t, e.Existing)
+		assert.NotZero(t, e.FlowID64)
+	}
+	assert.EqualValues(t, 1, ns.stats.FlowOriginFull)
+	assert.EqualValues(t, 3, ns.stats.PerfEventsUpdate)
+
+	// Flows are rate limited by their curve.
+	ns.dumpFlows([]ctnetlink.Flow{flow(1), flow(2)}, false)
+	assert.Empty(t, c.events)
+
+	// Flows missing from a dump are forgotten.
+	ns.dumpFlows([]ctnetlink.Flow{flow(1)}, false)
+	assert.Len(t, ns.flows, 1)
+
+	// Destroyed flows generate a destroy event and are forgotten.
+	ns.handleEvent(ctnetlink.Event{Type: ctnetlink.EventDestroy, Flow: flow(1)}, now)
+	require.Len(t, c.events, 1)
+	assert.EqualValues(t, 1, (<-c.events).connPtr)
+	assert.Empty(t, ns.flows)
+
+	// Filtered flows are ignored.
+	ns.config.Filter = Filter{Protocols: []uint8{unix.IPPROTO_TCP}}
+	ns.handleEvent(ctnetlink.Event{Type: ctnetlink.EventNew, Flow: flow(4)}, now)
+	assert.Empty(t, c.events)
+	assert.Empty(t, ns.flows)
+}
@@ -0,0 +1,142 @@
+package bpf
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/ti-mo/conntracct/pkg/btf"
+)
+
+const offsetsMap = "config_offsets"
+
+// Indices of the `config_offsets` map of the BTF-enabled probe.
+// Must match enum o_offset in the BPF program.
+const (
+	offsetConnStatus uint32 = iota
+	offsetConnExt
+	offsetConnNet
+	offsetConnMark
+	offsetConnTupleOrig
+	offsetTupleSrcAddr
+	offsetTupleSrcPort
+	offsetTupleDstAddr
+	offsetTupleDstPort
+	offsetTupleProto
+	offsetExtOffset
+	offsetExtIDAcct
+	offsetExtIDTstamp
+	offsetAcctCounter
+	offsetTstampStart
+	offsetNetInum
+	offsetTupleL3Num
+	offsetConnTCPState
+	offsetConnZone
+	offsetConnTupleReply
+	offsetMax
+)
+
+// offsetNone is the value of optional offsets missing from the running kernel.
+// Must match OFFSET_NONE in the BPF program.
+const offsetNone = ^uint64(0)
+
+// kernelOffset describes how to obtain the value of an entry in the
+// `config_offsets` map from the kernel's BTF. Either a struct member's
+// offset (Struct and Member), or the value of an enumerator (Enum).
+// Optional offsets depend on kernel configuration and are set to
+// offsetNone when missing from the running kernel.
+type kernelOffset struct {
+	Struct   string
+	Member   string
+	Enum     string
+	Optional bool
+}
+
+// kernelOffsets lists the struct member offsets and enum values needed by
+// the BTF-enabled probe, indexed by their position in `config_offsets`.
+var kernelOffsets = [offsetMax]kernelOffset{
+	offsetConnStatus:     {Struct: "nf_conn", Member: "status"},
+	offsetConnExt:        {Struct: "nf_conn", Member: "ext"},
+	offsetConnNet:        {Struct: "nf_conn", Member: "ct_net"},
+	offsetConnMark:       {Struct: "nf_conn", Member: "mark"},
+	offsetConnTupleOrig:  {Struct: "nf_conn", Member: "tuplehash[0].tuple"},
+	offsetTupleSrcAddr:   {Struct: "nf_conntrack_tuple", Member: "src.u3"},
+	offsetTupleSrcPort:   {Struct: "nf_conntrack_tuple", Member: "src.u.all"},
+	offsetTupleDstAddr:   {Struct: "nf_conntrack_tuple", Member: "dst.u3"},
+	offsetTupleDstPort:   {Struct: "nf_conntrack_tuple", Member: "dst.u.all"},
+	offsetTupleProto:     {Struct: "nf_conntrack_tuple", Member: "dst.protonum"},
+	offsetExtOffset:      {Struct: "nf_ct_ext", Member: "offset"},
+	offsetExtIDAcct:      {Enum: "NF_CT_EXT_ACCT"},
+	offsetExtIDTstamp:    {Enum: "NF_CT_EXT_TSTAMP"},
+	offsetAcctCounter:    {Struct: "nf_conn_acct", Member: "counter"},
+	offsetTstampStart:    {Struct: "nf_conn_tstamp", Member: "start"},
+	offsetNetInum:        {Struct: "net", Member: "ns.inum"},
+	offsetTupleL3Num:     {Struct: "nf_conntrack_tuple", Member: "src.l3num"},
+	offsetConnTCPState:   {Struct: "nf_conn", Member: "proto.tcp.state"},
+	offsetConnZone:       {Struct: "nf_conn", Member: "zone.id", Optional: true},
+	offsetConnTupleReply: {Struct: "nf_conn", Member: "tuplehash[1].tuple"},
+}
+
+// btfModules are the kernel modules whose split BTF is consulted in addition
+// to vmlinux when nf_conntrack is not built into the kernel.
+var btfModules = []string{"nf_conntrack"}
+
+// resolveOffsets looks up all kernelOffsets in the BTF of the running kernel.
+func resolveOffsets() ([]uint64, error) {
+
+	spec, err := btf.LoadKernelSpec(btfModules...)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading kernel BTF")
+	}
+
+	return resolveOffsetsSpec(spec)
+}
+
+// resolveOffsetsSpec looks up all kernelOffsets in the given btf.Spec.
+func resolveOffsetsSpec(spec *btf.Spec) ([]uint64, error) {
+
+	out := make([]uint64, len(kernelOffsets))
+
+	for i, ko := range kernelOffsets {
+		if ko.Enum != "" {
+			v, err := spec.EnumValue(ko.Enum)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = uint64(v)
+			continue
+		}
+
+		off, err := spec.Offset(ko.Struct, ko.Member)
+		if err != nil && ko.Optional {
+			out[i] = offsetNone
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		out[i] = uint64(off)
+	}
+
+	return out, nil
+}
+
+// configureOffsets writes the Probe's resolved kernel offsets into the
+// `config_offsets` map. No-op for probes that were not built with BTF support.
+func (ap *Probe) configureOffsets() error {
+
+	if !ap.kernel.BTF {
+		return nil
+	}
+
+	m, ok := ap.collection.Maps[offsetsMap]
+	if !ok {
+		return errors.Errorf("map '%s' not found in eBPF collection", offsetsMap)
+	}
+
+	for i, v := range ap.offsets {
+		if err := m.Put(uint32(i), v); err != nil {
+			return errors.Wrapf(err, "offset %d in %s", i, offsetsMap)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,27 @@
+package bpf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ti-mo/conntracct/pkg/btf"
+)
+
+func TestResolveOffsets(t *testing.T) {
+
+	if !btf.Available() {
+		t.Skip("kernel does not expose BTF")
+	}
+
+	offsets, err := resolveOffsets()
+	if err != nil {
+		// nf_conntrack might not be loaded in the test environment.
+		t.Skipf("resolving offsets from kernel BTF: %s", err)
+	}
+
+	require.Len(t, offsets, int(offsetMax))
+
+	// The acct and tstamp extensions cannot share an ID.
+	require.NotEqual(t, offsets[offsetExtIDAcct], offsets[offsetExtIDTstamp])
+}
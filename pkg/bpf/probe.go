@@ -2,40 +2,28 @@ package bpf
 
 import (
 	"bytes"
-	"crypto/rand"
 	"fmt"
-	"io/ioutil"
-	"os"
-	"strconv"
-	"strings"
 	"sync"
+	"time"
 
 	"github.com/cilium/ebpf"
 	"github.com/cilium/ebpf/perf"
 	"github.com/pkg/errors"
-	"golang.org/x/sys/unix"
 
 	"github.com/ti-mo/conntracct/pkg/kernel"
 )
 
-var (
-	// Pseudorandom number for generating a 'unique' group name for the
-	// tracing events created for the kernel symbols we want to trace.
-	traceGroupSuffix string
-
-	traceEventsPath = "/sys/kernel/debug/tracing/kprobe_events"
-
-	errInvalidProbeKind = errors.New("only kprobe and kretprobe probes are supported")
-)
-
-func init() {
-	b := make([]byte, 4)
-	_, _ = rand.Read(b)
-	traceGroupSuffix = fmt.Sprintf("%x", b)
-}
-
 const perfUpdateMap = "perf_acct_update"
 const perfDestroyMap = "perf_acct_end"
+const ringBufMap = "ringbuf_acct"
+const ringBufLostMap = "ringbuf_lost"
+
+// errorsBufferSize is the capacity of the Probe's error channel.
+const errorsBufferSize = 16
+
+// readErrorLimit is the amount of consecutive failed reads after which
+// a read loop gives up on its reader.
+const readErrorLimit = 10
 
 // Probe is an instance of a BPF probe running in the kernel.
 type Probe struct {
@@ -44,23 +32,74 @@ type Probe struct {
 	collection    *ebpf.Collection
 	updateReader  *perf.Reader
 	destroyReader *perf.Reader
+	ringReader    *ringReader
+
+	// Configuration the probe was created with, defaults applied.
+	// Curve is updated by Reconfigure, Filter is tracked separately.
+	configMu sync.Mutex
+	config   Config
+
+	// Bank of the `config_ratecurve` map holding the active rate curves,
+	// and the entries of `curve_select` selecting them. curveStale holds
+	// selectors of the inactive bank that could not be removed.
+	curveBank  uint32
+	curveKeys  map[curveSelectKey]uint32
+	curveStale map[curveSelectKey]uint32
+
+	// Event transport used by the loaded probe.
+	transport Transport
+
+	// Pool of (optionally keyed) hashers generating Events' FlowID64.
+	flowIDs *sync.Pool
 
 	// File descriptors of perf events opened for this probe.
 	perfEventFds []int
 
+	// Kprobes created in tracefs on kernels without a kprobe PMU,
+	// and the tracefs mount point and trace group they were created in.
+	tracefs     string
+	traceGroup  string
+	traceEvents kernel.Probes
+
 	// Target kernel of the loaded probe.
 	kernel kernel.Kernel
 
-	// List of event consumers of the probe.
-	consumerMu sync.RWMutex
-	consumers  []*Consumer
+	// Filter currently applied to the probe's filter maps.
+	filterMu sync.Mutex
+	filter   Filter
 
-	// Channel for receiving IDs of lost perf events.
-	lost chan uint64
+	// Kernel struct offsets resolved from BTF, indexed by their position
+	// in the probe's `config_offsets` map. Only set for BTF-enabled probes.
+	offsets []uint64
 
-	// Started status of the probe.
+	// Event consumers and subscribers to notifications of lost samples.
+	fanout
+
+	// Closed when the Probe is stopped.
+	done chan struct{}
+
+	// Time the probe's `flow_seed` map was populated, if SeedFlows is set.
+	seeded time.Time
+
+	// Flows in the `flow_origin` map found without a cooldown entry by the
+	// reaper, and the time they were first found. Only used by the reaper.
+	orphans map[uint64]uint64
+
+	// Flow IDs of the synthetic events of seeded flows, given to the probe's
+	// events of the same flows. seedCount holds the amount of seeded flows.
+	seedMu    sync.RWMutex
+	seedIDs   map[seededFlow]seededIDs
+	seedCount uint32
+
+	// Errors encountered by the read loops, and a WaitGroup tracking them.
+	errors  chan error
+	workers sync.WaitGroup
+
+	// Started status of the probe. A closed probe has released
+	// its resources and cannot be started again.
 	startMu sync.Mutex
 	started bool
+	closed  bool
 
 	stats *ProbeStats
 }
@@ -69,21 +108,56 @@ type Probe struct {
 // Loads the BPF program into the kernel but does not attach its kprobes yet.
 func NewProbe(cfg Config) (*Probe, error) {
 
+	// Set sane defaults on the configuration structure.
+	cfg.probeDefaults()
+
+	if err := probeConfigVerify(cfg); err != nil {
+		return nil, errors.Wrap(err, "verifying probe configuration")
+	}
+
 	kr, err := kernelRelease()
 	if err != nil {
 		return nil, err
 	}
 
+	// Pick the event transport based on the configuration
+	// and the features of the running kernel.
+	t, err := resolveTransport(cfg.Transport)
+	if err != nil {
+		return nil, errors.Wrap(err, "selecting event transport")
+	}
+
 	// Select the correct BPF probe from the library.
-	br, k, err := Select(kr)
+	// Prefers the BTF-enabled probe if the running kernel supports it.
+	br, k, offsets, err := selectProbe(kr, t)
+	if err != nil && cfg.Transport == TransportAuto && t != TransportPerf {
+		// Fall back to perf event arrays if the library does not contain
+		// the ring buffer variant of the probe.
+		t = TransportPerf
+		br, k, offsets, err = selectProbe(kr, t)
+	}
 	if err != nil {
 		return nil, errors.Wrap(err, "selecting probe version")
 	}
 
+	bs := cfg.PerfBufferSize
+	if t == TransportRingBuf {
+		bs = cfg.RingBufferSize
+	}
+
 	// Instantiate Probe with selected target kernel struct.
 	ap := Probe{
-		kernel: k,
-		stats:  &ProbeStats{},
+		kernel:    k,
+		offsets:   offsets,
+		config:    cfg,
+		transport: t,
+		flowIDs:   newFlowIDPool(cfg.FlowIDKey),
+		errors:    make(chan error, errorsBufferSize),
+		stats: &ProbeStats{
+			Transport:   t.String(),
+			BufferSize:  uint64(bs),
+			FlowMapSize: uint64(cfg.FlowMapSize),
+		},
 	}
 
 	// Scan kallsyms before attempting BPF load to avoid arcane error output from eBPF attach.
@@ -97,6 +171,7 @@ func NewProbe(cfg Config) (*Probe, error) {
 
 	// Apply probe configuration.
 	if err := ap.configure(cfg); err != nil {
+		ap.collection.Close()
 		return nil, errors.Wrap(err, "configuring probe")
 	}
 
@@ -110,201 +185,177 @@ func (ap *Probe) load(br *bytes.Reader) error {
 		return errors.Wrap(err, "loading collection spec")
 	}
 
-	coll, err := ebpf.NewCollection(spec)
-	if err != nil {
-		return errors.Wrap(err, "creating collection")
+	if err := checkProbeSpec(spec); err != nil {
+		return err
 	}
-	ap.collection = coll
-
-	return nil
-}
-
-func probeName(kind, symbol string) string {
-	return kind + "_" + symbol
-}
 
-func probeGroup() string {
-	return "conntracct_" + traceGroupSuffix
-}
-
-func probeEventEntry(group, kind, symbol string) string {
-
-	k := "p"
-	if kind == "kretprobe" {
-		k = "r"
+	// Fall back to hash maps if the kernel can't create LPM tries.
+	if err := prepareFilterMaps(spec, ap.config.Filter); err != nil {
+		return err
 	}
-	return fmt.Sprintf("%s:%s/%s %s", k, group, probeName(kind, symbol), symbol)
-}
 
-func getTraceEventID(group, name string) (int, error) {
+	// Fall back to a hash map for the curve selector if needed.
+	if err := prepareCurveMaps(spec, ap.config.Curves); err != nil {
+		return err
+	}
 
-	fname := fmt.Sprintf("/sys/kernel/debug/tracing/events/%s/%s/id", group, name)
-	fb, err := ioutil.ReadFile(fname)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return 0, err
-		}
-		return 0, fmt.Errorf("cannot read kprobe id: %v", err)
+	// Size the ring buffer according to the configuration.
+	if rb, ok := spec.Maps[ringBufMap]; ok {
+		rb.MaxEntries = uint32(ap.config.RingBufferSize)
 	}
 
-	tid, err := strconv.Atoi(strings.TrimSpace(string(fb)))
+	// Size the flow tracking maps according to the configuration.
+	prepareFlowMaps(spec, ap.config.FlowMapSize)
+
+	coll, err := ebpf.NewCollection(spec)
 	if err != nil {
-		return 0, fmt.Errorf("invalid kprobe id: %v", err)
+		return errors.Wrap(err, "creating collection")
 	}
+	ap.collection = coll
 
-	return tid, nil
+	return nil
 }
 
-func openTraceEvent(group, kind, symbol string) (int, error) {
-
-	if kind != "kprobe" && kind != "kretprobe" {
-		return 0, errInvalidProbeKind
+// checkProbeSpec returns errProbeOutdated if spec lacks maps that are defined
+// by all variants of the acct probe. Probes built from older sources emit
+// events in a different format, which would all be rejected as malformed.
+func checkProbeSpec(spec *ebpf.CollectionSpec) error {
+	for _, m := range []string{flowSeedMap, flowStatsMap} {
+		if _, ok := spec.Maps[m]; !ok {
+			return errProbeOutdated
+		}
 	}
+	return nil
+}
 
-	f, err := os.OpenFile(traceEventsPath, os.O_APPEND|os.O_WRONLY, 0666)
-	if err != nil {
-		return 0, fmt.Errorf("cannot open %s: %v", traceEventsPath, err)
-	}
-	defer f.Close()
+// Start attaches the BPF program's kprobes and starts polling the perf ring buffer.
+func (ap *Probe) Start() error {
 
-	pe := probeEventEntry(group, kind, symbol)
-	if _, err = f.WriteString(pe); err != nil {
-		return 0, fmt.Errorf("writing %q to kprobe_events: %v", pe, err)
-	}
+	ap.startMu.Lock()
+	defer ap.startMu.Unlock()
 
-	tid, err := getTraceEventID(group, probeName(kind, symbol))
-	if err != nil {
-		return 0, fmt.Errorf("getting trace event ID: %s", err)
+	if ap.started {
+		return errProbeStarted
 	}
 
-	return tid, nil
-}
-
-// closeTraceEvents closes all trace events (kprobe_events) of the Probe.
-func (ap *Probe) closeTraceEvents() error {
+	if ap.closed {
+		return errProbeClosed
+	}
 
-	f, err := os.OpenFile(traceEventsPath, os.O_APPEND|os.O_WRONLY, 0666)
-	if err != nil {
-		return fmt.Errorf("cannot open %s: %v", traceEventsPath, err)
+	// Seed the flows in the conntrack table before attaching the kprobes,
+	// so the probe knows their age when it first sees them.
+	var seeds []Event
+	var seedErr error
+	if ap.config.SeedFlows {
+		seeds, seedErr = ap.seedFlows()
+		ap.seeded = time.Now()
+		ap.setSeededIDs(seeds)
 	}
-	defer f.Close()
 
 	for _, p := range ap.kernel.Probes {
-		pe := fmt.Sprintf("-:%s/%s", probeGroup(), probeName(p.Kind, p.Name))
-		if _, err = f.WriteString(pe); err != nil {
-			return fmt.Errorf("writing %q to kprobe_events: %v", pe, err)
+		prog, ok := ap.collection.Programs[p.ProgramName()]
+		if !ok {
+			// Release the kprobes that were already attached.
+			_ = ap.disablePerfEvents()
+			_ = ap.closeTraceEvents()
+			return fmt.Errorf("looking up program '%s' in BPF collection", p.ProgramName())
 		}
-	}
 
-	return nil
-}
+		// Create a perf event for each of the kernel symbols we want to hook,
+		// and attach a BPF program to it.
+		if err := ap.perfEventOpenAttach(p, prog.FD()); err != nil {
+			// Release the kprobes that were already attached.
+			_ = ap.disablePerfEvents()
+			_ = ap.closeTraceEvents()
+			return fmt.Errorf("opening perf event: %v", err)
+		}
+	}
 
-// perfEventOpenAttach creates a new perf event on tracepoint tid and binds a
-// BPF program's progFd to it.
-func (ap *Probe) perfEventOpenAttach(tid int, progFd int) error {
+	ap.done = make(chan struct{})
 
-	attrs := &unix.PerfEventAttr{
-		Type:        unix.PERF_TYPE_TRACEPOINT,
-		Sample_type: unix.PERF_SAMPLE_RAW,
-		Sample:      1,
-		Wakeup:      1,
-		Config:      uint64(tid),
+	var err error
+	if ap.transport == TransportRingBuf {
+		err = ap.startRingBuf()
+	} else {
+		err = ap.startPerf()
 	}
-
-	// Create a perf event that fires each time the given tracepoint
-	// (kernel symbol) is hit.
-	efd, err := unix.PerfEventOpen(attrs, -1, 0, -1, unix.PERF_FLAG_FD_CLOEXEC)
 	if err != nil {
-		return fmt.Errorf("perf_event_open error: %v", err)
+		// Release the kprobes, no events can be read from the probe.
+		_ = ap.disablePerfEvents()
+		_ = ap.closeTraceEvents()
+		return err
 	}
 
-	// Enable the perf event.
-	if err := unix.IoctlSetInt(efd, unix.PERF_EVENT_IOC_ENABLE, 0); err != nil {
-		return fmt.Errorf("enabling perf event: %v", err)
-	}
+	// Start sampling the occupancy of the flow tracking maps
+	// and removing their orphaned entries.
+	ap.workers.Add(2)
+	go ap.flowMapWorker()
+	go ap.reapWorker()
 
-	// Set the BPF program to execute each time the perf event fires.
-	if err := unix.IoctlSetInt(efd, unix.PERF_EVENT_IOC_SET_BPF, progFd); err != nil {
-		return fmt.Errorf("attaching bpf program to perf event: %v", err)
+	// Deliver events of the flows found in the conntrack table.
+	// Failing to seed them doesn't prevent the probe from working.
+	if seedErr != nil {
+		// Never block, the read loops may have filled the channel already.
+		select {
+		case ap.errors <- errors.Wrap(seedErr, "seeding existing flows"):
+		default:
+		}
+	} else if len(seeds) != 0 {
+		ap.workers.Add(1)
+		go ap.seedWorker(seeds)
 	}
 
-	// Store the FD for later teardown.
-	ap.perfEventFds = append(ap.perfEventFds, efd)
-
-	return nil
-}
-
-// perfEventDisable disables and closes all perf event efds stored in the Probe.
-func (ap *Probe) disablePerfEvents() error {
-	for _, efd := range ap.perfEventFds {
-		if err := unix.IoctlSetInt(efd, unix.PERF_EVENT_IOC_DISABLE, 0); err != nil {
-			return fmt.Errorf("disabling perf event: %v", err)
-		}
+	ap.started = true
 
-		if err := unix.Close(efd); err != nil {
-			return fmt.Errorf("closing perf event fd: %v", err)
-		}
-	}
 	return nil
 }
 
-// Start attaches the BPF program's kprobes and starts polling the perf ring buffer.
-func (ap *Probe) Start() error {
-
-	ap.startMu.Lock()
-	defer ap.startMu.Unlock()
+// startRingBuf sets up a reader for the probe's ring buffer
+// and starts its event decoder/fanout worker.
+func (ap *Probe) startRingBuf() error {
 
-	if ap.started {
-		return errProbeStarted
+	rr, err := newRingReader(ap.collection.Maps[ringBufMap], ap.config.RingBufferSize)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("newRingReader for %s", ringBufMap))
 	}
+	ap.ringReader = rr
 
-	for _, p := range ap.kernel.Probes {
-		// Open a trace event for each of the kernel symbols we want to hook.
-		// These events can be routed to the perf subsystem, where BPF programs
-		// can be attached to them.
-		tid, err := openTraceEvent(probeGroup(), p.Kind, p.Name)
-		if err != nil {
-			return err
-		}
+	ap.workers.Add(2)
+	go ap.ringBufWorker()
+	go ap.ringBufLostWorker()
 
-		prog, ok := ap.collection.Programs[p.ProgramName()]
-		if !ok {
-			return fmt.Errorf("looking up program '%s' in BPF collection", p.ProgramName())
-		}
-
-		// Create a perf event using the trace event opened above, and attach
-		// a BPF program to it.
-		if err := ap.perfEventOpenAttach(tid, prog.FD()); err != nil {
-			return fmt.Errorf("opening perf event: %v", err)
-		}
-	}
+	return nil
+}
 
-	ap.lost = make(chan uint64)
+// startPerf sets up Readers for the probe's perf event arrays
+// and starts their event decoder/fanout workers.
+func (ap *Probe) startPerf() error {
 
 	// Set up Readers for reading events from the perf ring buffers.
-	r, err := perf.NewReader(ap.collection.Maps[perfUpdateMap], 4096)
+	r, err := perf.NewReader(ap.collection.Maps[perfUpdateMap], ap.config.PerfBufferSize)
 	if err != nil {
 		return errors.Wrap(err, fmt.Sprintf("NewReader for %s", perfUpdateMap))
 	}
 	ap.updateReader = r
 
-	r, err = perf.NewReader(ap.collection.Maps[perfDestroyMap], 4096)
+	r, err = perf.NewReader(ap.collection.Maps[perfDestroyMap], ap.config.PerfBufferSize)
 	if err != nil {
+		_ = ap.updateReader.Close()
 		return errors.Wrap(err, fmt.Sprintf("NewReader for %s", perfDestroyMap))
 	}
 	ap.destroyReader = r
 
 	// Start event decoder/fanout workers.
+	ap.workers.Add(2)
 	go ap.updateWorker()
 	go ap.destroyWorker()
 
-	ap.started = true
-
 	return nil
 }
 
 // Stop stops the BPF program and releases all its related resources.
-// Closes all Probe's channels. Can only be called after Start().
+// Closes all Probe's channels. Can only be called after Start(), a stopped
+// Probe cannot be started again.
 func (ap *Probe) Stop() error {
 
 	ap.startMu.Lock()
@@ -314,37 +365,138 @@ func (ap *Probe) Stop() error {
 		return errProbeNotStarted
 	}
 
-	if err := ap.updateReader.Close(); err != nil {
-		return err
+	// Release all resources even if some of them fail to close,
+	// the Probe cannot be stopped again.
+	ap.started = false
+	ap.closed = true
+
+	var err error
+	keep := func(e error) {
+		if e != nil && err == nil {
+			err = e
+		}
 	}
 
-	if err := ap.destroyReader.Close(); err != nil {
-		return err
+	if ap.transport == TransportRingBuf {
+		keep(ap.ringReader.Close())
+	} else {
+		keep(ap.updateReader.Close())
+		keep(ap.destroyReader.Close())
 	}
 
-	close(ap.lost)
+	close(ap.done)
 
-	if err := ap.disablePerfEvents(); err != nil {
-		return err
+	// Wait for the read loops to exit before closing the error channel
+	// they are writing to.
+	ap.workers.Wait()
+	close(ap.errors)
+
+	// Deliver events still pending in batch consumers.
+	ap.flushConsumers()
+
+	keep(ap.disablePerfEvents())
+	keep(ap.closeTraceEvents())
+
+	ap.collection.Close()
+
+	return err
+}
+
+// Close releases the resources of a Probe that was never started, eg. when
+// starting it failed. Consumers and lost sample subscribers are removed from
+// the Probe without closing their channels, so they can be registered to
+// another Probe. Started Probes need to be stopped using Stop().
+func (ap *Probe) Close() error {
+
+	ap.startMu.Lock()
+	defer ap.startMu.Unlock()
+
+	if ap.started {
+		return errProbeStarted
 	}
 
-	if err := ap.closeTraceEvents(); err != nil {
-		return err
+	if ap.closed {
+		return errProbeClosed
 	}
 
+	ap.closed = true
+
+	ap.consumerMu.Lock()
+	ap.consumers = nil
+	ap.consumerMu.Unlock()
+
+	ap.lostMu.Lock()
+	ap.lostSubs = nil
+	ap.lostMu.Unlock()
+
 	ap.collection.Close()
 
 	return nil
 }
 
+// Errors returns a channel receiving errors encountered while reading events
+// from the kernel, usually a *ReadError, or while seeding existing flows.
+// Errors are dropped if the channel is not drained. A Fatal ReadError means
+// the Probe stopped reading from one of its buffers and needs to be replaced.
+// The channel is closed by Stop.
+func (ap *Probe) Errors() <-chan error {
+	return ap.errors
+}
+
 // Kernel returns the target kernel structure of the selected probe.
+// Kernel().Mode() reports whether the probe uses struct offsets resolved
+// from the running kernel's BTF or offsets fixed at build time.
 func (ap *Probe) Kernel() kernel.Kernel {
 	return ap.kernel
 }
 
+// Transport returns the event transport used by the Probe.
+func (ap *Probe) Transport() Transport {
+	return ap.transport
+}
+
 // Stats returns a snapshot copy of the Probe's statistics.
 func (ap *Probe) Stats() ProbeStats {
-	return ap.stats.Get()
+
+	s := ap.stats.Get()
+
+	// The ring buffer doesn't report lost samples to the reader,
+	// they are counted by the BPF program instead.
+	if ap.transport == TransportRingBuf {
+		s.PerfEventsUpdateLost, s.PerfEventsDestroyLost = ap.ringBufLost()
+	}
+
+	// Flows ignored by filters and failed inserts into the
+	// flow tracking maps are counted by the BPF program.
+	ap.filterStats(&s)
+	ap.flowStats(&s)
+
+	return s
+}
+
+// ringBufLost returns the amount of update and destroy events the BPF
+// program failed to write to the ring buffer, summed across all CPUs.
+// Returns zero values if the counters cannot be read.
+func (ap *Probe) ringBufLost() (update uint64, destroy uint64) {
+
+	m, ok := ap.collection.Maps[ringBufLostMap]
+	if !ok {
+		return 0, 0
+	}
+
+	sum := func(et eventType) uint64 {
+		var out uint64
+		var vals []uint64
+		if err := m.Lookup(uint32(et), &vals); err != nil {
+			return 0
+		}
+		for _, v := range vals {
+			out += v
+		}
+		return out
+	}
+
+	return sum(eventUpdate), sum(eventDestroy)
 }
 
 // updateWorker reads binady flow update events from the Probe's ring buffer,
@@ -352,6 +504,9 @@ func (ap *Probe) Stats() ProbeStats {
 // consumers' event channels.
 func (ap *Probe) updateWorker() {
 
+	defer ap.workers.Done()
+
+	var failed int
 	for {
 		rec, err := ap.updateReader.Read()
 		if err != nil {
@@ -359,22 +514,36 @@ func (ap *Probe) updateWorker() {
 			if perf.IsClosed(err) {
 				return
 			}
-			panic(fmt.Sprint("unexpected error reading from updateReader:", err))
+			if ap.readFailed(perfUpdateMap, err, &failed) {
+				return
+			}
+			continue
 		}
+		failed = 0
 
-		// Log the amount of lost samples and skip processing the sample.
+		// Record the amount of lost samples and skip processing the sample.
 		if rec.LostSamples > 0 {
 			ap.stats.incrPerfEventsUpdateLost(rec.LostSamples)
+			ap.notifyLost(LostSamples{
+				Count:  rec.LostSamples,
+				Buffer: BufferPerfUpdate,
+				CPU:    rec.CPU,
+				Time:   time.Now(),
+			})
 			continue
 		}
 
 		ap.stats.incrPerfEventsUpdate()
 
 		var ae Event
-		if err := ae.unmarshalBinary(rec.RawSample); err != nil {
-			panic(err)
+		if err := ap.unmarshalEvent(&ae, rec.RawSample); err != nil {
+			ap.stats.incrPerfEventsMalformed()
+			continue
 		}
 
+		// Give events of seeded flows the IDs of their synthetic events.
+		ap.applySeededIDs(&ae, true)
+
 		// Fan out update event to all registered consumers.
 		ap.fanoutEvent(ae, true)
 	}
@@ -385,6 +554,9 @@ func (ap *Probe) updateWorker() {
 // consumers' event channels .
 func (ap *Probe) destroyWorker() {
 
+	defer ap.workers.Done()
+
+	var failed int
 	for {
 		rec, err := ap.destroyReader.Read()
 		if err != nil {
@@ -392,52 +564,118 @@ func (ap *Probe) destroyWorker() {
 			if perf.IsClosed(err) {
 				return
 			}
-			panic(fmt.Sprint("unexpected error reading from destroyReader:", err))
+			if ap.readFailed(perfDestroyMap, err, &failed) {
+				return
+			}
+			continue
 		}
+		failed = 0
 
-		// Log the amount of lost samples and skip processing the sample.
+		// Record the amount of lost samples and skip processing the sample.
 		if rec.LostSamples > 0 {
 			ap.stats.incrPerfEventsDestroyLost(rec.LostSamples)
+			ap.notifyLost(LostSamples{
+				Count:  rec.LostSamples,
+				Buffer: BufferPerfDestroy,
+				CPU:    rec.CPU,
+				Time:   time.Now(),
+			})
 			continue
 		}
 
 		ap.stats.incrPerfEventsDestroy()
 
 		var ae Event
-		if err := ae.unmarshalBinary(rec.RawSample); err != nil {
-			panic(err)
+		if err := ap.unmarshalEvent(&ae, rec.RawSample); err != nil {
+			ap.stats.incrPerfEventsMalformed()
+			continue
 		}
 
+		// Give events of seeded flows the IDs of their synthetic events.
+		ap.applySeededIDs(&ae, false)
+
 		// Fan out destroy event to all registered consumers.
 		ap.fanoutEvent(ae, false)
 	}
 }
 
-// fanoutEvent sends the given Event to all registered consumers.
-// The update flag specifies whether the event is an update (true) or destroy
-// (false) event.
-func (ap *Probe) fanoutEvent(ae Event, update bool) {
-
-	// Take a read lock on the consumers so we don't send to closed or already
-	// unregistered consumer channels.
-	ap.consumerMu.RLock()
-
-	for _, c := range ap.consumers {
-		// Require the update/destroy condition of the event to match
-		// the requested event type of the consumer.
-		if (update && c.WantUpdate()) || (!update && c.WantDestroy()) {
-			// Non-blocking send to the consumer's event channel.
-			select {
-			case c.events <- ae:
-				c.stats.setQueueLength(len(c.events))
-				c.stats.incrEventsReceived()
-			default:
-				// If the channel can't be written to immediately,
-				// increment the consumer's lost counter.
-				c.stats.incrEventsLost()
+// ringBufWorker reads binary update and destroy events from the Probe's
+// BPF ring buffer, unmarshals the events into Event structures and sends them
+// on all registered consumers' event channels.
+func (ap *Probe) ringBufWorker() {
+
+	defer ap.workers.Done()
+
+	var failed int
+	for {
+		rec, err := ap.ringReader.Read()
+		if err != nil {
+			// Reader closed, gracefully exit the read loop.
+			if err == errRingClosed {
+				return
+			}
+			if ap.readFailed(ringBufMap, err, &failed) {
+				return
 			}
+			continue
+		}
+		failed = 0
+
+		var ae Event
+		if err := ap.unmarshalEvent(&ae, rec); err != nil {
+			ap.stats.incrPerfEventsMalformed()
+			continue
+		}
+
+		// Both event types share the ring buffer, use the sample's type tag
+		// to tell them apart.
+		update := rec[eventTypeOffset] != uint8(eventDestroy)
+		if update {
+			ap.stats.incrPerfEventsUpdate()
+		} else {
+			ap.stats.incrPerfEventsDestroy()
 		}
+
+		// Give events of seeded flows the IDs of their synthetic events.
+		ap.applySeededIDs(&ae, update)
+
+		// Fan out event to all registered consumers.
+		ap.fanoutEvent(ae, update)
+	}
+}
+
+// readFailed delivers a ReadError for a failed read from the reader of map m
+// on the Probe's error channel. failed holds the amount of consecutive failed
+// reads and is incremented. Returns true if the reader should be abandoned
+// because it failed too many times in a row, the ReadError is marked Fatal.
+func (ap *Probe) readFailed(m string, err error, failed *int) bool {
+
+	*failed++
+	fatal := *failed >= readErrorLimit
+
+	// Never block the read loop, drop the error if nobody is receiving.
+	select {
+	case ap.errors <- &ReadError{Map: m, Err: err, Fatal: fatal}:
+	default:
+	}
+
+	return fatal
+}
+
+// unmarshalEvent unmarshals an event sample received from the kernel into ae
+// and sets its FlowID64 using the Probe's flow ID hashers.
+func (ap *Probe) unmarshalEvent(ae *Event, b []byte) error {
+
+	if err := ae.unmarshalBinary(b); err != nil {
+		return err
 	}
 
-	ap.consumerMu.RUnlock()
+	ae.FlowID64 = ap.flowID64(ae)
+
+	return nil
+}
+
+// flowID64 returns the FlowID64 of ae using the Probe's flow ID hashers.
+func (ap *Probe) flowID64(ae *Event) uint64 {
+	return flowID64(ap.flowIDs, ae)
 }
@@ -5,6 +5,11 @@ import "sync/atomic"
 // ProbeStats holds various statistics and information about the
 // BPF probe.
 type ProbeStats struct {
+	// event transport used by the probe, eg. 'ringbuf' or 'perf'
+	Transport string `json:"transport"`
+	// size in bytes of the ring buffer, or of each CPU's perf buffer
+	BufferSize uint64 `json:"buffer_size"`
+
 	// total amount of events received from kernel
 	PerfEventsTotal uint64 `json:"perf_events_total"`
 	// total amount of bytes read from the BPF perf buffer(s)
@@ -18,6 +23,40 @@ type ProbeStats struct {
 	PerfEventsDestroy uint64 `json:"perf_events_destroy"`
 	// amount of overwritten (lost) events from the perf destroy buffer
 	PerfEventsDestroyLost uint64 `json:"perf_events_destroy_lost"`
+	// amount of samples from the kernel that could not be decoded and were skipped
+	PerfEventsMalformed uint64 `json:"perf_events_malformed"`
+
+	// maximum amount of flows tracked for rate limiting
+	FlowMapSize uint64 `json:"flow_map_size"`
+	// amount of flows in the probe's flow_cooldown and flow_origin maps,
+	// sampled periodically
+	FlowCooldownEntries uint64 `json:"flow_cooldown_entries"`
+	FlowOriginEntries   uint64 `json:"flow_origin_entries"`
+	// amount of failed inserts into the flow_cooldown and flow_origin maps
+	// because they were full
+	FlowCooldownFull uint64 `json:"flow_cooldown_full"`
+	FlowOriginFull   uint64 `json:"flow_origin_full"`
+	// amount of existing flows whose start timestamp was seeded
+	// from the conntrack table when the probe was started
+	FlowsSeeded uint64 `json:"flows_seeded"`
+	// amount of orphaned flow_cooldown and flow_origin entries removed
+	FlowCooldownReaped uint64 `json:"flow_cooldown_reaped"`
+	FlowOriginReaped   uint64 `json:"flow_origin_reaped"`
+
+	// amount of times the netlink socket's receive buffer overran,
+	// losing an unknown amount of events
+	NetlinkOverruns uint64 `json:"netlink_overruns"`
+
+	// amount of flows ignored for not matching any of the include prefixes
+	FilteredCIDRInclude uint64 `json:"filtered_cidr_include"`
+	// amount of flows ignored for matching one of the exclude prefixes
+	FilteredCIDRExclude uint64 `json:"filtered_cidr_exclude"`
+	// amount of flows ignored for their network namespace
+	FilteredNetNS uint64 `json:"filtered_netns"`
+	// amount of flows ignored for their protocol
+	FilteredProto uint64 `json:"filtered_proto"`
+	// amount of flows ignored for not matching the connmark value and mask
+	FilteredConnmark uint64 `json:"filtered_connmark"`
 }
 
 // incrPerfEventsTotal atomically increases the total event counter by one.
@@ -52,16 +91,39 @@ func (s *ProbeStats) incrPerfEventsDestroyLost(count uint64) {
 	atomic.AddUint64(&s.PerfEventsDestroyLost, count)
 }
 
+// incrPerfEventsMalformed atomically increases the amount of
+// malformed samples received from the kernel by one.
+func (s *ProbeStats) incrPerfEventsMalformed() {
+	atomic.AddUint64(&s.PerfEventsMalformed, 1)
+}
+
 // Get returns a copy of the Stats structure created using atomic loads.
 // The values can be inconsistent with each other, as they are written and
 // read concurrently without locks.
 func (s *ProbeStats) Get() ProbeStats {
 	return ProbeStats{
+		Transport:             s.Transport,
+		BufferSize:            s.BufferSize,
 		PerfEventsTotal:       atomic.LoadUint64(&s.PerfEventsTotal),
 		PerfBytesTotal:        atomic.LoadUint64(&s.PerfBytesTotal),
 		PerfEventsUpdate:      atomic.LoadUint64(&s.PerfEventsUpdate),
 		PerfEventsUpdateLost:  atomic.LoadUint64(&s.PerfEventsUpdateLost),
 		PerfEventsDestroy:     atomic.LoadUint64(&s.PerfEventsDestroy),
 		PerfEventsDestroyLost: atomic.LoadUint64(&s.PerfEventsDestroyLost),
+		PerfEventsMalformed:   atomic.LoadUint64(&s.PerfEventsMalformed),
+		FlowMapSize:           s.FlowMapSize,
+		FlowCooldownEntries:   atomic.LoadUint64(&s.FlowCooldownEntries),
+		FlowOriginEntries:     atomic.LoadUint64(&s.FlowOriginEntries),
+		FlowCooldownFull:      atomic.LoadUint64(&s.FlowCooldownFull),
+		FlowOriginFull:        atomic.LoadUint64(&s.FlowOriginFull),
+		FlowsSeeded:           atomic.LoadUint64(&s.FlowsSeeded),
+		FlowCooldownReaped:    atomic.LoadUint64(&s.FlowCooldownReaped),
+		FlowOriginReaped:      atomic.LoadUint64(&s.FlowOriginReaped),
+		NetlinkOverruns:       atomic.LoadUint64(&s.NetlinkOverruns),
+		FilteredCIDRInclude:   atomic.LoadUint64(&s.FilteredCIDRInclude),
+		FilteredCIDRExclude:   atomic.LoadUint64(&s.FilteredCIDRExclude),
+		FilteredNetNS:         atomic.LoadUint64(&s.FilteredNetNS),
+		FilteredProto:         atomic.LoadUint64(&s.FilteredProto),
+		FilteredConnmark:      atomic.LoadUint64(&s.FilteredConnmark),
 	}
 }
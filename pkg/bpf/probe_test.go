@@ -0,0 +1,47 @@
+package bpf
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadFailed(t *testing.T) {
+
+	ap := Probe{errors: make(chan error, 1)}
+	errRead := errors.New("read failed")
+
+	var failed int
+	for i := 1; i < readErrorLimit; i++ {
+		assert.False(t, ap.readFailed(perfUpdateMap, errRead, &failed))
+	}
+
+	// Errors are dropped when the channel is full, the first one is kept.
+	re := (<-ap.errors).(*ReadError)
+	assert.False(t, re.Fatal)
+	assert.Equal(t, errRead, re.Err)
+
+	assert.True(t, ap.readFailed(perfUpdateMap, errRead, &failed))
+
+	re = (<-ap.errors).(*ReadError)
+	require.True(t, re.Fatal)
+	assert.Equal(t, perfUpdateMap, re.Map)
+}
+
+func TestCheckProbeSpec(t *testing.T) {
+
+	spec := &ebpf.CollectionSpec{
+		Maps: map[string]*ebpf.MapSpec{
+			flowCooldownMap: {},
+			flowOriginMap:   {},
+		},
+	}
+	assert.Equal(t, errProbeOutdated, checkProbeSpec(spec))
+
+	spec.Maps[flowSeedMap] = &ebpf.MapSpec{}
+	spec.Maps[flowStatsMap] = &ebpf.MapSpec{}
+	assert.NoError(t, checkProbeSpec(spec))
+}
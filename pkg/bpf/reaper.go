@@ -0,0 +1,176 @@
+package bpf
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// defaultReapHorizon is the default age of orphaned entries in the
+	// flow tracking maps before they are removed by the reaper.
+	defaultReapHorizon = 6 * time.Hour
+
+	// reapInterval is the interval at which the reaper
+	// scans the flow tracking maps.
+	reapInterval = time.Minute
+)
+
+// reapWorker periodically removes orphaned entries from the flow tracking maps.
+// Exits when the Probe is stopped.
+func (ap *Probe) reapWorker() {
+
+	defer ap.workers.Done()
+
+	t := time.NewTicker(reapInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ap.done:
+			return
+		case <-t.C:
+		}
+
+		ap.reapFlowMaps()
+	}
+}
+
+// reapFlowMaps removes the entries of flows the probe likely missed the
+// destroy event of, eg. because the probe was started while the flow already
+// existed, or because the conntrack table or the flow's network namespace
+// was flushed.
+//
+// Whether an entry's nf_conn still exists is not checked. The maps are keyed
+// by the nf_conn's address, which ctnetlink does not expose (conntrack IDs are
+// hashed since Linux 5.0), and a ctnetlink dump only covers the caller's
+// network namespace while the maps hold flows of all namespaces. Instead,
+// a flow is considered gone when it hasn't generated an event for longer
+// than the reap horizon. A flow_cooldown entry is removed when its cooldown
+// expired longer than the horizon ago. A flow_origin entry is removed when
+// it is older than the horizon and its flow has had no cooldown entry for
+// another horizon, so a live flow that was idle for longer than the horizon
+// keeps its age unless it stays idle for twice as long.
+func (ap *Probe) reapFlowMaps() {
+
+	cm, ok := ap.collection.Maps[flowCooldownMap]
+	if !ok {
+		return
+	}
+	om, ok := ap.collection.Maps[flowOriginMap]
+	if !ok {
+		return
+	}
+
+	now, err := ktime()
+	if err != nil {
+		return
+	}
+
+	horizon := uint64(ap.config.ReapHorizon)
+	if now < horizon {
+		return
+	}
+	cutoff := now - horizon
+
+	// Cooldown holds the time the flow may send its next event.
+	n := reapMap(cm, func(_, next uint64) bool {
+		return next < cutoff
+	})
+	atomic.AddUint64(&ap.stats.FlowCooldownReaped, n)
+
+	// Origin holds the time the flow was first seen. Flows without a cooldown
+	// entry are remembered along with the time they were first found without
+	// one, including flows whose cooldown entry was removed above.
+	orphans := make(map[uint64]uint64)
+	n = reapMap(om, func(ct, origin uint64) bool {
+		if origin >= cutoff {
+			return false
+		}
+
+		var next uint64
+		if cm.Lookup(ct, &next) == nil {
+			return false
+		}
+
+		since, ok := ap.orphans[ct]
+		if !ok {
+			since = now
+		}
+		if since < cutoff {
+			return true
+		}
+
+		orphans[ct] = since
+		return false
+	})
+	ap.orphans = orphans
+	atomic.AddUint64(&ap.stats.FlowOriginReaped, n)
+
+	// Seeds of existing flows that were not seen by the probe within
+	// the horizon are not going to be used anymore.
+	if !ap.seeded.IsZero() && time.Since(ap.seeded) > ap.config.ReapHorizon {
+		if sm, ok := ap.collection.Maps[flowSeedMap]; ok {
+			clearMap(sm)
+		}
+		ap.seeded = time.Time{}
+	}
+}
+
+// reapMap deletes all entries from a flow tracking map for which fn returns
+// true, and returns the amount of entries deleted. Entries are collected
+// before deleting them, since deleting keys while iterating a hash map
+// restarts the iteration.
+func reapMap(m *ebpf.Map, fn func(k, v uint64) bool) uint64 {
+
+	var k, v uint64
+	var keys []uint64
+
+	// An iteration aborted by concurrent updates from the BPF program
+	// still yields a usable set of keys, try again during the next run.
+	it := m.Iterate()
+	for it.Next(&k, &v) {
+		if fn(k, v) {
+			keys = append(keys, k)
+		}
+	}
+
+	var n uint64
+	for _, k := range keys {
+		if err := m.Delete(k); err == nil {
+			n++
+		}
+	}
+
+	return n
+}
+
+// clearMap deletes all entries from m.
+func clearMap(m *ebpf.Map) {
+
+	var k, v []byte
+	var keys [][]byte
+
+	it := m.Iterate()
+	for it.Next(&k, &v) {
+		keys = append(keys, k)
+	}
+
+	for _, k := range keys {
+		_ = m.Delete(k)
+	}
+}
+
+// ktime returns the current time of the clock used by the BPF program's
+// timestamps (bpf_ktime_get_ns) in nanoseconds.
+func ktime() (uint64, error) {
+
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return 0, err
+	}
+
+	return uint64(ts.Nano()), nil
+}
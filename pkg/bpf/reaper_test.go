@@ -0,0 +1,103 @@
+package bpf
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReapMap(t *testing.T) {
+
+	m, err := ebpf.NewMap(&ebpf.MapSpec{
+		Type:       ebpf.Hash,
+		KeySize:    8,
+		ValueSize:  8,
+		MaxEntries: 16,
+	})
+	if err != nil {
+		t.Skipf("creating hash map: %s", err)
+	}
+	defer m.Close()
+
+	for i := uint64(0); i < 10; i++ {
+		require.NoError(t, m.Put(i, i*100))
+	}
+
+	// Reap all entries with a value below 500.
+	n := reapMap(m, func(_, v uint64) bool {
+		return v < 500
+	})
+	assert.EqualValues(t, 5, n)
+	assert.EqualValues(t, 5, mapEntries(m))
+
+	var v uint64
+	assert.Error(t, m.Lookup(uint64(4), &v))
+	assert.NoError(t, m.Lookup(uint64(5), &v))
+}
+
+func TestKtime(t *testing.T) {
+
+	a, err := ktime()
+	require.NoError(t, err)
+	b, err := ktime()
+	require.NoError(t, err)
+
+	assert.NotZero(t, a)
+	assert.True(t, b >= a)
+}
+
+func TestReapFlowMaps(t *testing.T) {
+
+	spec := &ebpf.MapSpec{
+		Type:       ebpf.Hash,
+		KeySize:    8,
+		ValueSize:  8,
+		MaxEntries: 16,
+	}
+
+	cm, err := ebpf.NewMap(spec)
+	if err != nil {
+		t.Skipf("creating hash map: %s", err)
+	}
+	defer cm.Close()
+
+	om, err := ebpf.NewMap(spec)
+	require.NoError(t, err)
+	defer om.Close()
+
+	ap := Probe{
+		collection: &ebpf.Collection{Maps: map[string]*ebpf.Map{
+			flowCooldownMap: cm,
+			flowOriginMap:   om,
+		}},
+		config: Config{ReapHorizon: time.Second},
+		stats:  &ProbeStats{},
+	}
+
+	now, err := ktime()
+	require.NoError(t, err)
+	old := now - uint64(time.Minute)
+
+	// Flow 1 is idle for longer than the horizon, flow 2 is active.
+	require.NoError(t, cm.Put(uint64(1), old))
+	require.NoError(t, om.Put(uint64(1), old))
+	require.NoError(t, cm.Put(uint64(2), now+uint64(time.Minute)))
+	require.NoError(t, om.Put(uint64(2), old))
+
+	// The idle flow's origin is kept in the pass that removes its cooldown.
+	ap.reapFlowMaps()
+	assert.EqualValues(t, 1, mapEntries(cm))
+	assert.EqualValues(t, 2, mapEntries(om))
+	assert.Contains(t, ap.orphans, uint64(1))
+
+	// The flow's origin is removed once it was orphaned for the horizon.
+	ap.orphans[1] = old
+	ap.reapFlowMaps()
+	assert.EqualValues(t, 1, mapEntries(om))
+	assert.Empty(t, ap.orphans)
+	assert.EqualValues(t, 1, ap.stats.FlowCooldownReaped)
+	assert.EqualValues(t, 1, ap.stats.FlowOriginReaped)
+}
@@ -0,0 +1,213 @@
+package bpf
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/cilium/ebpf"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Flags in the length field of a ring buffer record header.
+	ringBusyBit    = 1 << 31
+	ringDiscardBit = 1 << 30
+
+	// Size of the header preceding each ring buffer record.
+	ringHeaderSize = 8
+)
+
+// ringReader reads records from a BPF ring buffer (BPF_MAP_TYPE_RINGBUF).
+//
+// The ring buffer consists of a consumer position page mapped read-write,
+// followed by a read-only producer position page and the data area. The data
+// area is mapped twice in a row, so records wrapping around the end of the
+// buffer can be read as a contiguous slice.
+type ringReader struct {
+	// Held by Read for the duration of the call, taken by Close to wait for
+	// an ongoing Read to complete before unmapping the buffer.
+	mu sync.Mutex
+
+	epollFd     int
+	epollEvents []unix.EpollEvent
+
+	// Event fd used to interrupt a blocking Read.
+	closeFd int
+
+	consumer []byte
+	producer []byte
+	data     []byte
+	mask     uint64
+
+	closed bool
+}
+
+// newRingReader creates a ringReader for the given ring buffer map.
+// size is the size of the ring buffer in bytes, the map's max_entries.
+func newRingReader(m *ebpf.Map, size int) (*ringReader, error) {
+
+	if m == nil {
+		return nil, errors.New("nil ring buffer map")
+	}
+
+	page := os.Getpagesize()
+
+	cons, err := unix.Mmap(m.FD(), 0, page, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return nil, errors.Wrap(err, "mmap consumer page")
+	}
+
+	prod, err := unix.Mmap(m.FD(), int64(page), page+2*size, unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		_ = unix.Munmap(cons)
+		return nil, errors.Wrap(err, "mmap producer page and data")
+	}
+
+	rr := &ringReader{
+		epollEvents: make([]unix.EpollEvent, 2),
+		consumer:    cons,
+		producer:    prod,
+		data:        prod[page:],
+		mask:        uint64(size - 1),
+	}
+
+	if err := rr.initEpoll(m.FD()); err != nil {
+		rr.unmap()
+		return nil, err
+	}
+
+	return rr, nil
+}
+
+// initEpoll creates the epoll instance the ringReader waits on, watching the
+// ring buffer's map fd and an eventfd used for interrupting Read.
+func (rr *ringReader) initEpoll(mapFd int) error {
+
+	efd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return errors.Wrap(err, "epoll create")
+	}
+
+	cfd, err := unix.Eventfd(0, unix.O_CLOEXEC|unix.O_NONBLOCK)
+	if err != nil {
+		_ = unix.Close(efd)
+		return errors.Wrap(err, "create eventfd")
+	}
+
+	for _, fd := range []int{mapFd, cfd} {
+		ev := unix.EpollEvent{Events: unix.EPOLLIN, Fd: int32(fd)}
+		if err := unix.EpollCtl(efd, unix.EPOLL_CTL_ADD, fd, &ev); err != nil {
+			_ = unix.Close(cfd)
+			_ = unix.Close(efd)
+			return errors.Wrap(err, "epoll add")
+		}
+	}
+
+	rr.epollFd = efd
+	rr.closeFd = cfd
+
+	return nil
+}
+
+// Read blocks until a record is available in the ring buffer and returns a
+// copy of its contents. Returns errRingClosed after Close was called.
+func (rr *ringReader) Read() ([]byte, error) {
+
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	consPos := (*uint64)(unsafe.Pointer(&rr.consumer[0]))
+	prodPos := (*uint64)(unsafe.Pointer(&rr.producer[0]))
+
+	for {
+		if rr.closed {
+			return nil, errRingClosed
+		}
+
+		cons := atomic.LoadUint64(consPos)
+		prod := atomic.LoadUint64(prodPos)
+
+		for cons < prod {
+			off := cons & rr.mask
+			hdr := atomic.LoadUint32((*uint32)(unsafe.Pointer(&rr.data[off])))
+
+			// The record is reserved but not yet committed by the producer.
+			// The kernel wakes up the consumer when it is committed.
+			if hdr&ringBusyBit != 0 {
+				break
+			}
+
+			n := uint64(hdr &^ (ringBusyBit | ringDiscardBit))
+
+			// Advance the consumer position past the header and the record,
+			// rounded up to 8 bytes.
+			cons += (ringHeaderSize + n + 7) &^ 7
+
+			if hdr&ringDiscardBit != 0 {
+				atomic.StoreUint64(consPos, cons)
+				continue
+			}
+
+			start := off + ringHeaderSize
+			out := make([]byte, n)
+			copy(out, rr.data[start:start+n])
+
+			atomic.StoreUint64(consPos, cons)
+
+			return out, nil
+		}
+
+		if err := rr.wait(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// wait blocks until the ring buffer or the close eventfd become readable.
+func (rr *ringReader) wait() error {
+
+	n, err := unix.EpollWait(rr.epollFd, rr.epollEvents, -1)
+	if err == unix.EINTR {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "epoll wait")
+	}
+
+	for _, ev := range rr.epollEvents[:n] {
+		if int(ev.Fd) == rr.closeFd {
+			rr.closed = true
+		}
+	}
+
+	return nil
+}
+
+// Close interrupts any ongoing Read and releases the ringReader's resources.
+func (rr *ringReader) Close() error {
+
+	// Wake up a blocking Read before taking the lock it holds.
+	var b [8]byte
+	*(*uint64)(unsafe.Pointer(&b[0])) = 1
+	if _, err := unix.Write(rr.closeFd, b[:]); err != nil {
+		return errors.Wrap(err, "interrupting ring reader")
+	}
+
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	rr.closed = true
+	rr.unmap()
+
+	_ = unix.Close(rr.closeFd)
+	return unix.Close(rr.epollFd)
+}
+
+// unmap releases the ringReader's memory mappings.
+func (rr *ringReader) unmap() {
+	_ = unix.Munmap(rr.consumer)
+	_ = unix.Munmap(rr.producer)
+}
@@ -0,0 +1,314 @@
+package bpf
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/ti-mo/conntracct/pkg/ctnetlink"
+)
+
+const flowSeedMap = "flow_seed"
+
+// seedKey is the key of the probe's `flow_seed` map.
+// Matches struct flow_seed_key in the BPF program.
+type seedKey struct {
+	SrcAddr [16]byte
+	DstAddr [16]byte
+	NetNS   uint32
+	// Ports are stored in network byte order, like in the nf_conn.
+	SrcPort [2]byte
+	DstPort [2]byte
+	Proto   uint8
+	Family  uint8
+	_       uint16
+}
+
+// newSeedKey builds the `flow_seed` map key of a flow in the given
+// network namespace, as read by the BPF program from its nf_conn.
+func newSeedKey(f ctnetlink.Flow, netns uint32) seedKey {
+
+	k := seedKey{
+		NetNS:  netns,
+		Proto:  f.Orig.Proto,
+		Family: f.Family,
+	}
+
+	// IPv4 addresses occupy the first four bytes of an nf_inet_addr.
+	src, dst := f.Orig.SrcAddr, f.Orig.DstAddr
+	if f.Family == unix.AF_INET {
+		src, dst = src.To4(), dst.To4()
+	}
+	copy(k.SrcAddr[:], src)
+	copy(k.DstAddr[:], dst)
+
+	// The tuple's port fields hold the echo identifier, type and code
+	// of ICMP flows.
+	if hasPorts(f.Orig.Proto) {
+		binary.BigEndian.PutUint16(k.SrcPort[:], f.Orig.SrcPort)
+		binary.BigEndian.PutUint16(k.DstPort[:], f.Orig.DstPort)
+	}
+	if isICMP(f.Orig.Proto) {
+		binary.BigEndian.PutUint16(k.SrcPort[:], f.Orig.ICMPID)
+		k.DstPort = [2]byte{f.Orig.ICMPType, f.Orig.ICMPCode}
+	}
+
+	return k
+}
+
+// seededFlow identifies a flow seeded from the conntrack table by its tuple,
+// network namespace and start timestamp, which are the same in its synthetic
+// event and the events generated by the BPF program.
+type seededFlow struct {
+	SrcAddr  [16]byte
+	DstAddr  [16]byte
+	SrcPort  uint16
+	DstPort  uint16
+	ICMPID   uint16
+	ICMPType uint8
+	ICMPCode uint8
+	Proto    uint8
+	NetNS    uint32
+	Start    uint64
+}
+
+// newSeededFlow returns the seededFlow identifying the flow of the given Event.
+func newSeededFlow(e *Event) seededFlow {
+
+	sf := seededFlow{
+		SrcPort:  e.SrcPort,
+		DstPort:  e.DstPort,
+		ICMPID:   e.ICMPID,
+		ICMPType: e.ICMPType,
+		ICMPCode: e.ICMPCode,
+		Proto:    e.Proto,
+		NetNS:    e.NetNS,
+		Start:    e.Start,
+	}
+
+	// Events from the probe hold 4-byte IPv4 addresses, synthetic events
+	// hold them in their 16-byte form.
+	copy(sf.SrcAddr[:], e.SrcAddr.To16())
+	copy(sf.DstAddr[:], e.DstAddr.To16())
+
+	return sf
+}
+
+// seededIDs are the FlowID and FlowID64 of a seeded flow's synthetic event.
+type seededIDs struct {
+	FlowID   uint32
+	FlowID64 uint64
+}
+
+// setSeededIDs records the flow IDs of the given synthetic events, so the
+// Probe's events of the same flows are given the same IDs.
+func (ap *Probe) setSeededIDs(events []Event) {
+
+	ids := make(map[seededFlow]seededIDs, len(events))
+	for i := range events {
+		ae := &events[i]
+		ids[newSeededFlow(ae)] = seededIDs{FlowID: ae.FlowID, FlowID64: ae.FlowID64}
+	}
+
+	ap.seedMu.Lock()
+	ap.seedIDs = ids
+	atomic.StoreUint32(&ap.seedCount, uint32(len(ids)))
+	ap.seedMu.Unlock()
+}
+
+// applySeededIDs gives an Event generated by the BPF program the flow IDs of
+// the synthetic event of its flow, if it was seeded from the conntrack table.
+// The flow's IDs are forgotten when it is destroyed. The IDs of flows whose
+// destroy event is lost are kept until the Probe is stopped.
+func (ap *Probe) applySeededIDs(ae *Event, update bool) {
+
+	// Avoid taking the lock once all seeded flows are destroyed.
+	if atomic.LoadUint32(&ap.seedCount) == 0 {
+		return
+	}
+
+	sf := newSeededFlow(ae)
+
+	ap.seedMu.RLock()
+	ids, ok := ap.seedIDs[sf]
+	ap.seedMu.RUnlock()
+
+	if !ok {
+		return
+	}
+
+	ae.FlowID, ae.FlowID64 = ids.FlowID, ids.FlowID64
+
+	if update {
+		return
+	}
+
+	ap.seedMu.Lock()
+	delete(ap.seedIDs, sf)
+	atomic.StoreUint32(&ap.seedCount, uint32(len(ap.seedIDs)))
+	ap.seedMu.Unlock()
+}
+
+// seedFlows dumps the host's conntrack table and writes the start timestamps
+// of its flows to the probe's `flow_seed` map, so the BPF program knows
+// their real age when it first sees them. Returns synthetic update events
+// of all dumped flows that are not ignored by the probe's filter.
+func (ap *Probe) seedFlows() ([]Event, error) {
+
+	m, ok := ap.collection.Maps[flowSeedMap]
+	if !ok {
+		return nil, errors.New("map 'flow_seed' not found in eBPF collection")
+	}
+
+	flows, err := dumpConntrack()
+	if err != nil {
+		return nil, err
+	}
+
+	netns, err := selfNetNS()
+	if err != nil {
+		return nil, err
+	}
+
+	// Flows' start timestamps are wall clock times, the BPF program's
+	// origins are monotonic. Convert using the current time of both clocks.
+	mono, err := ktime()
+	if err != nil {
+		return nil, err
+	}
+	wall := uint64(time.Now().UnixNano())
+
+	filter := ap.Filter()
+
+	var out []Event
+	for _, f := range flows {
+		ae := EventFromFlow(f, netns, mono)
+		ae.Existing = true
+		if !filter.matchEvent(ae) {
+			continue
+		}
+
+		ae.FlowID64 = ap.flowID64(&ae)
+		out = append(out, ae)
+
+		// Let the probe guess the age of flows without a start timestamp.
+		origin, ok := flowOrigin(f, mono, wall)
+		if !ok {
+			continue
+		}
+
+		// Flows that don't fit into the map are not seeded.
+		if err := m.Put(newSeedKey(f, netns), origin); err == nil {
+			atomic.AddUint64(&ap.stats.FlowsSeeded, 1)
+		}
+	}
+
+	return out, nil
+}
+
+// flowOrigin converts the start timestamp of a flow to nanoseconds since
+// boot, given the current time of the monotonic and wall clocks. Returns false
+// if the flow has no usable start timestamp, eg. because it was created before
+// timestamping was enabled.
+func flowOrigin(f ctnetlink.Flow, mono, wall uint64) (uint64, bool) {
+
+	if f.Start == 0 || f.Start > wall || wall-f.Start > mono {
+		return 0, false
+	}
+
+	return mono - (wall - f.Start), true
+}
+
+// seedWorker delivers the synthetic events of flows that existed when the
+// Probe was started to its update consumers. Exits when the Probe is stopped.
+func (ap *Probe) seedWorker(events []Event) {
+
+	defer ap.workers.Done()
+
+	for _, ae := range events {
+		select {
+		case <-ap.done:
+			return
+		default:
+		}
+
+		ap.fanoutEvent(ae, true)
+	}
+}
+
+// EventFromFlow builds an update Event from a flow in the conntrack table of
+// the network namespace with the given inode number. ts is the time of the
+// event in nanoseconds since boot, as returned by the kernel's ktime_get_ns.
+//
+// The Event's FlowID is derived from the flow's conntrack ID instead of its
+// nf_conn. A Probe that seeded the flow gives its own events of the flow the
+// same FlowID and FlowID64 as its synthetic event. Its FlowID64 is not set.
+func EventFromFlow(f ctnetlink.Flow, netns uint32, ts uint64) Event {
+
+	e := Event{
+		Start:       f.Start,
+		Timestamp:   ts,
+		Connmark:    f.Mark,
+		SrcAddr:     f.Orig.SrcAddr.To16(),
+		DstAddr:     f.Orig.DstAddr.To16(),
+		PacketsOrig: f.CountersOrig.Packets,
+		BytesOrig:   f.CountersOrig.Bytes,
+		PacketsRet:  f.CountersReply.Packets,
+		BytesRet:    f.CountersReply.Bytes,
+		NetNS:       netns,
+		Proto:       f.Orig.Proto,
+		Family:      f.Family,
+		Status:      ConnStatus(f.Status),
+		Zone:        f.Zone,
+
+		ReplySrcAddr: f.Reply.SrcAddr.To16(),
+		ReplyDstAddr: f.Reply.DstAddr.To16(),
+
+		connPtr: uint64(f.ID),
+	}
+
+	if hasPorts(e.Proto) {
+		e.SrcPort, e.DstPort = f.Orig.SrcPort, f.Orig.DstPort
+		e.ReplySrcPort, e.ReplyDstPort = f.Reply.SrcPort, f.Reply.DstPort
+	}
+	if isICMP(e.Proto) {
+		e.ICMPID, e.ICMPType, e.ICMPCode = f.Orig.ICMPID, f.Orig.ICMPType, f.Orig.ICMPCode
+	}
+	if e.Proto == unix.IPPROTO_TCP {
+		e.TCPState = TCPState(f.TCPState)
+	}
+
+	e.SrcNAT = e.Status&StatusSrcNAT != 0
+	e.DstNAT = e.Status&StatusDstNAT != 0
+
+	e.FlowID = e.hashFlow()
+
+	return e
+}
+
+// dumpConntrack returns all flows in the conntrack table
+// of the caller's network namespace.
+func dumpConntrack() ([]ctnetlink.Flow, error) {
+
+	c, err := ctnetlink.Dial()
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	return c.Dump()
+}
+
+// selfNetNS returns the inode number of the caller's network namespace.
+func selfNetNS() (uint32, error) {
+
+	var st unix.Stat_t
+	if err := unix.Stat("/proc/self/ns/net", &st); err != nil {
+		return 0, errors.Wrap(err, "reading network namespace inode")
+	}
+
+	return uint32(st.Ino), nil
+}
@@ -0,0 +1,164 @@
+package bpf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+
+	"github.com/ti-mo/conntracct/pkg/ctnetlink"
+)
+
+func TestNewSeedKey(t *testing.T) {
+
+	f := ctnetlink.Flow{
+		Family: unix.AF_INET,
+		Orig: ctnetlink.Tuple{
+			SrcAddr: net.ParseIP("10.0.0.1"),
+			DstAddr: net.ParseIP("10.0.0.2"),
+			Proto:   unix.IPPROTO_TCP,
+			SrcPort: 40000,
+			DstPort: 443,
+		},
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, binary.Write(&buf, binary.LittleEndian, newSeedKey(f, 4026531992)))
+	b := buf.Bytes()
+
+	// Same layout as struct flow_seed_key.
+	require.Len(t, b, 44)
+	assert.Equal(t, []byte{10, 0, 0, 1}, b[0:4])
+	assert.Equal(t, make([]byte, 12), b[4:16])
+	assert.Equal(t, []byte{10, 0, 0, 2}, b[16:20])
+	assert.EqualValues(t, 4026531992, binary.LittleEndian.Uint32(b[32:36]))
+	assert.Equal(t, []byte{0x9c, 0x40}, b[36:38])
+	assert.Equal(t, []byte{0x01, 0xbb}, b[38:40])
+	assert.Equal(t, []byte{unix.IPPROTO_TCP, unix.AF_INET, 0, 0}, b[40:44])
+
+	// ICMP flows store their echo identifier, type and code in the ports.
+	f.Orig.Proto = unix.IPPROTO_ICMP
+	f.Orig.ICMPID, f.Orig.ICMPType, f.Orig.ICMPCode = 0x1234, 8, 0
+	k := newSeedKey(f, 1)
+	assert.Equal(t, [2]byte{0x12, 0x34}, k.SrcPort)
+	assert.Equal(t, [2]byte{8, 0}, k.DstPort)
+}
+
+func TestEventFromFlow(t *testing.T) {
+
+	f := ctnetlink.Flow{
+		Family: unix.AF_INET,
+		Orig: ctnetlink.Tuple{
+			SrcAddr: net.IP{10, 0, 0, 1},
+			DstAddr: net.IP{10, 0, 0, 2},
+			Proto:   unix.IPPROTO_UDP,
+			SrcPort: 40000,
+			DstPort: 53,
+		},
+		Reply: ctnetlink.Tuple{
+			SrcAddr: net.IP{10, 0, 0, 2},
+			DstAddr: net.IP{192, 0, 2, 1},
+			Proto:   unix.IPPROTO_UDP,
+			SrcPort: 53,
+			DstPort: 40000,
+		},
+		Status:        uint32(StatusConfirmed | StatusSrcNAT),
+		TCPState:      3,
+		CountersOrig:  ctnetlink.Counters{Packets: 1, Bytes: 100},
+		CountersReply: ctnetlink.Counters{Packets: 2, Bytes: 200},
+		Start:         1000,
+	}
+
+	e := EventFromFlow(f, 1, 2000)
+
+	assert.False(t, e.Existing)
+	assert.Equal(t, net.ParseIP("10.0.0.1"), e.SrcAddr)
+	assert.Equal(t, net.ParseIP("192.0.2.1"), e.ReplyDstAddr)
+	assert.EqualValues(t, 40000, e.SrcPort)
+	assert.EqualValues(t, 53, e.ReplySrcPort)
+	assert.EqualValues(t, 2, e.PacketsRet)
+	assert.EqualValues(t, 1000, e.Start)
+	assert.EqualValues(t, 2000, e.Timestamp)
+	assert.True(t, e.SrcNAT)
+	assert.False(t, e.DstNAT)
+	assert.Zero(t, e.TCPState, "TCP state of a UDP flow")
+	assert.NotZero(t, e.FlowID)
+
+	// The conntrack ID tells apart flows reusing the same tuple.
+	f.ID++
+	assert.NotEqual(t, e.FlowID, EventFromFlow(f, 1, 2000).FlowID)
+}
+
+func TestFilterMatchEvent(t *testing.T) {
+
+	_, n, _ := net.ParseCIDR("10.0.0.0/8")
+	e := Event{SrcAddr: net.ParseIP("10.0.0.1"), DstAddr: net.ParseIP("192.0.2.1"),
+		Proto: unix.IPPROTO_TCP, NetNS: 1, Connmark: 0x11}
+
+	assert.True(t, Filter{}.matchEvent(e))
+	assert.True(t, Filter{CIDRInclude: []*net.IPNet{n}}.matchEvent(e))
+	assert.False(t, Filter{CIDRExclude: []*net.IPNet{n}}.matchEvent(e))
+	assert.False(t, Filter{NetNSAllow: []uint32{2}}.matchEvent(e))
+	assert.False(t, Filter{NetNSDeny: []uint32{1}}.matchEvent(e))
+	assert.False(t, Filter{Protocols: []uint8{unix.IPPROTO_UDP}}.matchEvent(e))
+	assert.True(t, Filter{ConnmarkValue: 0x1, ConnmarkMask: 0xf}.matchEvent(e))
+	assert.False(t, Filter{ConnmarkValue: 0x2, ConnmarkMask: 0xf}.matchEvent(e))
+}
+
+func TestApplySeededIDs(t *testing.T) {
+
+	f := ctnetlink.Flow{
+		Family: unix.AF_INET,
+		ID:     1,
+		Orig: ctnetlink.Tuple{
+			SrcAddr: net.IP{10, 0, 0, 1},
+			DstAddr: net.IP{10, 0, 0, 2},
+			Proto:   unix.IPPROTO_TCP,
+			SrcPort: 40000,
+			DstPort: 443,
+		},
+		Start: 1000,
+	}
+
+	var ap Probe
+	seed := EventFromFlow(f, 1, 2000)
+	seed.FlowID64 = 1234
+	ap.setSeededIDs([]Event{seed})
+
+	// The probe's events hold 4-byte IPv4 addresses and the flow's nf_conn.
+	e := Event{
+		Start:   1000,
+		SrcAddr: net.IP{10, 0, 0, 1},
+		DstAddr: net.IP{10, 0, 0, 2},
+		SrcPort: 40000,
+		DstPort: 443,
+		Proto:   unix.IPPROTO_TCP,
+		NetNS:   1,
+		connPtr: 0xffff888000000000,
+	}
+	e.FlowID = e.hashFlow()
+	require.NotEqual(t, seed.FlowID, e.FlowID)
+
+	// Later flows with the same tuple keep their own IDs.
+	later := e
+	later.Start = 3000
+	ap.applySeededIDs(&later, true)
+	assert.NotEqual(t, seed.FlowID, later.FlowID)
+
+	// Update events of the seeded flow get its synthetic event's IDs.
+	u := e
+	ap.applySeededIDs(&u, true)
+	assert.Equal(t, seed.FlowID, u.FlowID)
+	assert.EqualValues(t, 1234, u.FlowID64)
+
+	// The flow's IDs are forgotten after its destroy event.
+	d := e
+	ap.applySeededIDs(&d, false)
+	assert.Equal(t, seed.FlowID, d.FlowID)
+	assert.Empty(t, ap.seedIDs)
+	assert.Zero(t, ap.seedCount)
+}
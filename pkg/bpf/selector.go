@@ -9,6 +9,7 @@ import (
 	"github.com/blang/semver"
 	"github.com/rakyll/statik/fs"
 
+	"github.com/ti-mo/conntracct/pkg/btf"
 	"github.com/ti-mo/conntracct/pkg/kernel"
 )
 
@@ -16,12 +17,43 @@ import (
 // the given kernel release kr. Returns the bytes.Reader of the selected probe
 // and the kernel.Kernel it was built against.
 func Select(kr string) (*bytes.Reader, kernel.Kernel, error) {
+	return selectTransport(kr, TransportPerf)
+}
 
-	bfs, err := fs.New()
-	if err != nil {
-		return nil, kernel.Kernel{}, err
+// selectProbe returns the BPF program to be used for the given kernel release kr
+// and event Transport t. If the running kernel exposes BTF and all required
+// struct offsets can be resolved from it, the BTF-enabled probe is returned along
+// with the offsets to configure it with. Otherwise, falls back to the probe
+// built against the closest matching kernel version. If that fails too, the
+// returned error includes the reason the BTF-enabled probe was rejected.
+func selectProbe(kr string, t Transport) (*bytes.Reader, kernel.Kernel, []uint64, error) {
+
+	var btfErr error
+	if btf.Available() {
+		br, err := readProbe(kernel.BTF, t)
+		if err == nil {
+			offsets, err := resolveOffsets()
+			if err == nil {
+				return br, kernel.BTF, offsets, nil
+			}
+			btfErr = errors.Wrap(err, "resolving struct offsets from BTF")
+		} else {
+			btfErr = err
+		}
+	}
+
+	br, k, err := selectTransport(kr, t)
+	if err != nil && btfErr != nil {
+		err = errors.Wrapf(err, "BTF-enabled probe unusable (%s)", btfErr)
 	}
 
+	return br, k, nil, err
+}
+
+// selectTransport is like Select, but returns the variant of the BPF program
+// built for the given event Transport.
+func selectTransport(kr string, t Transport) (*bytes.Reader, kernel.Kernel, error) {
+
 	// Find an acceptable probe version for the running kernel version.
 	// Always returns a result. If there is no match, will return the lowest probe version.
 	probe, err := findProbe(kr, kernel.Builds)
@@ -29,16 +61,32 @@ func Select(kr string) (*bytes.Reader, kernel.Kernel, error) {
 		return nil, kernel.Kernel{}, err
 	}
 
-	bpfFile := fmt.Sprintf("/acct/%s.o", probe.Version)
-	b, err := fs.ReadFile(bfs, bpfFile)
+	br, err := readProbe(probe, t)
 	if err != nil {
-		return nil, kernel.Kernel{}, errors.Wrap(err, bpfFile)
+		return nil, kernel.Kernel{}, err
 	}
-	br := bytes.NewReader(b)
 
 	return br, probe, nil
 }
 
+// readProbe reads the BPF program built against Kernel k for
+// the event Transport t from the embedded probe library.
+func readProbe(k kernel.Kernel, t Transport) (*bytes.Reader, error) {
+
+	bfs, err := fs.New()
+	if err != nil {
+		return nil, err
+	}
+
+	bpfFile := fmt.Sprintf("/acct/%s%s.o", k.Version, t.objectSuffix())
+	b, err := fs.ReadFile(bfs, bpfFile)
+	if err != nil {
+		return nil, errors.Wrap(err, bpfFile)
+	}
+
+	return bytes.NewReader(b), nil
+}
+
 // findProbe returns a compatible BPF probe version in a list of kernels
 // based on the given kernel version string k.
 func findProbe(k string, kernels map[string]kernel.Kernel) (kernel.Kernel, error) {
@@ -0,0 +1,118 @@
+package bpf
+
+import (
+	"strconv"
+	"strings"
+)
+
+// ConnStatus holds the status bits of a conntrack entry,
+// as defined by enum ip_conntrack_status in the kernel.
+type ConnStatus uint32
+
+// Conntrack status bits.
+const (
+	StatusExpected ConnStatus = 1 << iota
+	StatusSeenReply
+	StatusAssured
+	StatusConfirmed
+	StatusSrcNAT
+	StatusDstNAT
+	StatusSeqAdjust
+	StatusSrcNATDone
+	StatusDstNATDone
+	StatusDying
+	StatusFixedTimeout
+	StatusTemplate
+	StatusNATClash
+	StatusHelper
+	StatusOffload
+	StatusHWOffload
+
+	// StatusNAT is set when either source or destination NAT is applied to a flow.
+	StatusNAT = StatusSrcNAT | StatusDstNAT
+)
+
+// Names of the status bits, in order of their position.
+var statusNames = []string{
+	"EXPECTED",
+	"SEEN_REPLY",
+	"ASSURED",
+	"CONFIRMED",
+	"SRC_NAT",
+	"DST_NAT",
+	"SEQ_ADJUST",
+	"SRC_NAT_DONE",
+	"DST_NAT_DONE",
+	"DYING",
+	"FIXED_TIMEOUT",
+	"TEMPLATE",
+	"NAT_CLASH",
+	"HELPER",
+	"OFFLOAD",
+	"HW_OFFLOAD",
+}
+
+// Flags returns the names of all bits set in the ConnStatus. Unknown bits are
+// returned as their position prefixed by 'BIT_'.
+func (s ConnStatus) Flags() []string {
+
+	var out []string
+	for i := uint(0); i < 32; i++ {
+		if s&(1<<i) == 0 {
+			continue
+		}
+
+		if int(i) < len(statusNames) {
+			out = append(out, statusNames[i])
+		} else {
+			out = append(out, "BIT_"+strconv.Itoa(int(i)))
+		}
+	}
+
+	return out
+}
+
+// String returns the names of all bits set in the ConnStatus separated by
+// pipe characters, eg. 'SEEN_REPLY|ASSURED|CONFIRMED'.
+func (s ConnStatus) String() string {
+	return strings.Join(s.Flags(), "|")
+}
+
+// TCPState is the state of a TCP flow tracked by conntrack,
+// as defined by enum tcp_conntrack in the kernel.
+type TCPState uint8
+
+// TCP conntrack states.
+const (
+	TCPStateNone TCPState = iota
+	TCPStateSynSent
+	TCPStateSynRecv
+	TCPStateEstablished
+	TCPStateFinWait
+	TCPStateCloseWait
+	TCPStateLastAck
+	TCPStateTimeWait
+	TCPStateClose
+	TCPStateSynSent2
+)
+
+// Names of the TCP conntrack states, indexed by TCPState.
+var tcpStateNames = []string{
+	"NONE",
+	"SYN_SENT",
+	"SYN_RECV",
+	"ESTABLISHED",
+	"FIN_WAIT",
+	"CLOSE_WAIT",
+	"LAST_ACK",
+	"TIME_WAIT",
+	"CLOSE",
+	"SYN_SENT2",
+}
+
+func (s TCPState) String() string {
+	if int(s) < len(tcpStateNames) {
+		return tcpStateNames[s]
+	}
+	return "UNKNOWN"
+}
@@ -0,0 +1,21 @@
+package bpf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnStatusString(t *testing.T) {
+
+	assert.Equal(t, "", ConnStatus(0).String())
+	assert.Equal(t, "SEEN_REPLY|ASSURED|CONFIRMED", (StatusSeenReply | StatusAssured | StatusConfirmed).String())
+	assert.Equal(t, []string{"DYING", "BIT_20"}, (StatusDying | 1<<20).Flags())
+}
+
+func TestTCPStateString(t *testing.T) {
+
+	assert.Equal(t, "ESTABLISHED", TCPStateEstablished.String())
+	assert.Equal(t, "SYN_SENT2", TCPStateSynSent2.String())
+	assert.Equal(t, "UNKNOWN", TCPState(200).String())
+}
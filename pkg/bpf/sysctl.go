@@ -1,6 +1,10 @@
 package bpf
 
-import "github.com/ti-mo/conntracct/internal/sysctl"
+import (
+	"strconv"
+
+	"github.com/ti-mo/conntracct/internal/sysctl"
+)
 
 // Sysctls applies a list of sysctls on the machine.
 // When verbose is true, logs any changes made to stdout.
@@ -20,3 +24,15 @@ func Sysctls(verbose bool) error {
 
 	return sysctl.Apply(sysctls, verbose)
 }
+
+// conntrackMax returns the maximum amount of entries in the
+// host's conntrack table.
+func conntrackMax() (int, error) {
+
+	v, err := sysctl.Get("net.netfilter.nf_conntrack_max")
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(v)
+}
@@ -0,0 +1,101 @@
+package bpf
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/cilium/ebpf"
+)
+
+// Transport is the mechanism used for delivering events from the BPF
+// program in the kernel to userspace.
+type Transport uint8
+
+// Enum of supported event transports.
+const (
+	// TransportAuto uses the BPF ring buffer if the kernel supports it,
+	// and falls back to perf event arrays otherwise.
+	TransportAuto Transport = iota
+	// TransportRingBuf sends all events through a single BPF ring buffer
+	// shared by all CPUs. Requires Linux 5.8 or later.
+	TransportRingBuf
+	// TransportPerf sends update and destroy events through separate
+	// perf event arrays with a buffer for each CPU.
+	TransportPerf
+)
+
+// mapTypeRingBuf is BPF_MAP_TYPE_RINGBUF, which is not known to the
+// vendored eBPF library.
+const mapTypeRingBuf = ebpf.MapType(27)
+
+func (t Transport) String() string {
+	switch t {
+	case TransportAuto:
+		return "auto"
+	case TransportRingBuf:
+		return "ringbuf"
+	case TransportPerf:
+		return "perf"
+	}
+
+	return fmt.Sprintf("Transport(%d)", t)
+}
+
+// ParseTransport returns the Transport with the given name.
+func ParseTransport(s string) (Transport, error) {
+	switch s {
+	case "", "auto":
+		return TransportAuto, nil
+	case "ringbuf":
+		return TransportRingBuf, nil
+	case "perf":
+		return TransportPerf, nil
+	}
+
+	return 0, fmt.Errorf(errFmtTransport, s)
+}
+
+// objectSuffix returns the suffix of the name of the BPF object
+// built for the Transport.
+func (t Transport) objectSuffix() string {
+	if t == TransportRingBuf {
+		return "-ringbuf"
+	}
+	return ""
+}
+
+// haveRingBuf returns nil if the running kernel supports BPF ring buffers.
+func haveRingBuf() error {
+
+	m, err := ebpf.NewMap(&ebpf.MapSpec{
+		Type:       mapTypeRingBuf,
+		MaxEntries: uint32(os.Getpagesize()),
+	})
+	if err != nil {
+		return errRingBufUnsupported
+	}
+
+	return m.Close()
+}
+
+// resolveTransport returns the Transport to be used by the probe given
+// the requested Transport t.
+func resolveTransport(t Transport) (Transport, error) {
+
+	switch t {
+	case TransportAuto:
+		if haveRingBuf() == nil {
+			return TransportRingBuf, nil
+		}
+		return TransportPerf, nil
+	case TransportRingBuf:
+		if err := haveRingBuf(); err != nil {
+			return 0, err
+		}
+		return TransportRingBuf, nil
+	case TransportPerf:
+		return TransportPerf, nil
+	}
+
+	return 0, fmt.Errorf(errFmtTransport, t)
+}
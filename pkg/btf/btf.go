@@ -0,0 +1,465 @@
+// Package btf resolves struct member offsets and enum values from the
+// BPF Type Format (BTF) information exposed by the kernel.
+package btf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// Path where the kernel exposes BTF of vmlinux and loaded modules.
+const sysfsPath = "/sys/kernel/btf"
+
+const (
+	btfMagic  = 0xeB9F
+	headerLen = 24
+
+	// Size of a pointer on the running architecture.
+	pointerSize = uint32(unsafe.Sizeof(uintptr(0)))
+)
+
+// BTF type kinds.
+const (
+	kindInt      = 1
+	kindPtr      = 2
+	kindArray    = 3
+	kindStruct   = 4
+	kindUnion    = 5
+	kindEnum     = 6
+	kindFwd      = 7
+	kindTypedef  = 8
+	kindVolatile = 9
+	kindConst    = 10
+	kindRestrict = 11
+	kindFunc     = 12
+	kindFuncProt = 13
+	kindVar      = 14
+	kindDatasec  = 15
+	kindFloat    = 16
+	kindDeclTag  = 17
+	kindTypeTag  = 18
+	kindEnum64   = 19
+)
+
+// btfType is a decoded BTF type. Only the information needed for resolving
+// member offsets, type sizes and enum values is kept.
+type btfType struct {
+	name     string
+	kind     uint8
+	kindFlag bool
+
+	// Size of the type, or the ID of the type it refers to,
+	// depending on its kind.
+	sizeType uint32
+
+	members []member
+	enums   []enumValue
+
+	// Element type and element count of array types.
+	elemType uint32
+	nelems   uint32
+}
+
+// member is a member of a struct or union.
+type member struct {
+	name   string
+	typ    uint32
+	offset uint32 // in bits
+}
+
+// enumValue is a single enumerator of an enum.
+type enumValue struct {
+	name  string
+	value int64
+}
+
+// Spec holds the types and strings of one or more BTF blobs, eg. those of
+// the running kernel and some of its modules.
+type Spec struct {
+	// Types indexed by their ID. ID 0 is the void type.
+	types []btfType
+
+	// Concatenated string sections of the base and split BTF.
+	strings []byte
+
+	// Struct and union type IDs, indexed by name.
+	composites map[string]uint32
+}
+
+// Available returns true if the running kernel exposes its BTF.
+func Available() bool {
+	_, err := os.Stat(path.Join(sysfsPath, "vmlinux"))
+	return err == nil
+}
+
+// LoadKernelSpec parses the BTF of the running kernel, along with the split
+// BTF of the given kernel modules. Modules that are not loaded or that don't
+// expose BTF are skipped.
+func LoadKernelSpec(modules ...string) (*Spec, error) {
+
+	b, err := ioutil.ReadFile(path.Join(sysfsPath, "vmlinux"))
+	if err != nil {
+		return nil, err
+	}
+
+	spec, err := Parse(b, nil)
+	if err != nil {
+		return nil, fmt.Errorf("parsing vmlinux BTF: %v", err)
+	}
+
+	for _, m := range modules {
+		b, err := ioutil.ReadFile(path.Join(sysfsPath, m))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		spec, err = Parse(b, spec)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s BTF: %v", m, err)
+		}
+	}
+
+	return spec, nil
+}
+
+// Parse decodes the BTF blob b. If base is not nil, b is decoded as split BTF
+// on top of base, like the BTF of kernel modules is on top of vmlinux.
+func Parse(b []byte, base *Spec) (*Spec, error) {
+
+	if len(b) < headerLen {
+		return nil, errShortHeader
+	}
+
+	var bo binary.ByteOrder = binary.LittleEndian
+	if binary.LittleEndian.Uint16(b) != btfMagic {
+		bo = binary.BigEndian
+		if bo.Uint16(b) != btfMagic {
+			return nil, errMagic
+		}
+	}
+
+	hl := bo.Uint32(b[4:])
+	typeOff, typeLen := bo.Uint32(b[8:]), bo.Uint32(b[12:])
+	strOff, strLen := bo.Uint32(b[16:]), bo.Uint32(b[20:])
+
+	if uint64(hl)+uint64(typeOff)+uint64(typeLen) > uint64(len(b)) ||
+		uint64(hl)+uint64(strOff)+uint64(strLen) > uint64(len(b)) {
+		return nil, errSectionBounds
+	}
+
+	s := &Spec{
+		types:      []btfType{{}}, // void
+		composites: make(map[string]uint32),
+	}
+
+	// Split BTF continues the type IDs and string offsets of its base.
+	if base != nil {
+		s.types = append([]btfType(nil), base.types...)
+		s.strings = append([]byte(nil), base.strings...)
+		for k, v := range base.composites {
+			s.composites[k] = v
+		}
+	}
+	s.strings = append(s.strings, b[hl+strOff:hl+strOff+strLen]...)
+
+	if err := s.parseTypes(b[hl+typeOff:hl+typeOff+typeLen], bo); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// parseTypes decodes the BTF type section tb and appends its types to the Spec.
+func (s *Spec) parseTypes(tb []byte, bo binary.ByteOrder) error {
+
+	r := bytes.NewReader(tb)
+
+	u32 := func() (uint32, error) {
+		var v uint32
+		err := binary.Read(r, bo, &v)
+		return v, err
+	}
+
+	for r.Len() > 0 {
+		var raw struct {
+			NameOff  uint32
+			Info     uint32
+			SizeType uint32
+		}
+		if err := binary.Read(r, bo, &raw); err != nil {
+			return fmt.Errorf("reading type %d: %v", len(s.types), err)
+		}
+
+		t := btfType{
+			name:     s.str(raw.NameOff),
+			kind:     uint8((raw.Info >> 24) & 0x1f),
+			kindFlag: raw.Info>>31 == 1,
+			sizeType: raw.SizeType,
+		}
+		vlen := int(raw.Info & 0xffff)
+
+		var err error
+		switch t.kind {
+		case kindInt, kindVar, kindDeclTag:
+			_, err = u32()
+
+		case kindArray:
+			var a struct{ Type, IndexType, Nelems uint32 }
+			err = binary.Read(r, bo, &a)
+			t.elemType, t.nelems = a.Type, a.Nelems
+
+		case kindStruct, kindUnion:
+			for i := 0; i < vlen && err == nil; i++ {
+				var m struct{ NameOff, Type, Offset uint32 }
+				err = binary.Read(r, bo, &m)
+				t.members = append(t.members, member{name: s.str(m.NameOff), typ: m.Type, offset: m.Offset})
+			}
+
+		case kindEnum:
+			for i := 0; i < vlen && err == nil; i++ {
+				var e struct {
+					NameOff uint32
+					Val     int32
+				}
+				err = binary.Read(r, bo, &e)
+				t.enums = append(t.enums, enumValue{name: s.str(e.NameOff), value: int64(e.Val)})
+			}
+
+		case kindEnum64:
+			for i := 0; i < vlen && err == nil; i++ {
+				var e struct{ NameOff, Lo, Hi uint32 }
+				err = binary.Read(r, bo, &e)
+				t.enums = append(t.enums, enumValue{name: s.str(e.NameOff), value: int64(uint64(e.Hi)<<32 | uint64(e.Lo))})
+			}
+
+		case kindFuncProt:
+			_, err = r.Seek(int64(vlen)*8, 1)
+
+		case kindDatasec:
+			_, err = r.Seek(int64(vlen)*12, 1)
+
+		case kindPtr, kindFwd, kindTypedef, kindVolatile, kindConst,
+			kindRestrict, kindFunc, kindFloat, kindTypeTag:
+			// No additional data.
+
+		default:
+			return fmt.Errorf(errFmtUnknownKind, t.kind, len(s.types))
+		}
+		if err != nil {
+			return fmt.Errorf("reading type %d: %v", len(s.types), err)
+		}
+
+		// Remember the first definition of each named struct or union.
+		if (t.kind == kindStruct || t.kind == kindUnion) && t.name != "" {
+			if _, ok := s.composites[t.name]; !ok {
+				s.composites[t.name] = uint32(len(s.types))
+			}
+		}
+
+		s.types = append(s.types, t)
+	}
+
+	return nil
+}
+
+// str returns the NUL-terminated string at offset off in the string section.
+func (s *Spec) str(off uint32) string {
+
+	if int(off) >= len(s.strings) {
+		return ""
+	}
+
+	b := s.strings[off:]
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+
+	return string(b)
+}
+
+// resolve follows typedefs and type qualifiers starting at type id
+// and returns the ID of the underlying type.
+func (s *Spec) resolve(id uint32) uint32 {
+
+	for int(id) < len(s.types) {
+		switch s.types[id].kind {
+		case kindTypedef, kindVolatile, kindConst, kindRestrict, kindTypeTag:
+			id = s.types[id].sizeType
+		default:
+			return id
+		}
+	}
+
+	return id
+}
+
+// sizeof returns the size in bytes of the type with the given ID.
+func (s *Spec) sizeof(id uint32) (uint32, error) {
+
+	id = s.resolve(id)
+	if int(id) >= len(s.types) {
+		return 0, fmt.Errorf(errFmtTypeID, id)
+	}
+
+	t := s.types[id]
+	switch t.kind {
+	case kindInt, kindStruct, kindUnion, kindEnum, kindEnum64, kindFloat:
+		return t.sizeType, nil
+	case kindPtr:
+		return pointerSize, nil
+	case kindArray:
+		es, err := s.sizeof(t.elemType)
+		if err != nil {
+			return 0, err
+		}
+		return es * t.nelems, nil
+	}
+
+	return 0, fmt.Errorf(errFmtNoSize, t.name, t.kind)
+}
+
+// Sizeof returns the size in bytes of the struct or union with the given name.
+func (s *Spec) Sizeof(name string) (uint32, error) {
+
+	id, ok := s.composites[name]
+	if !ok {
+		return 0, fmt.Errorf(errFmtNoType, name)
+	}
+
+	return s.sizeof(id)
+}
+
+// Offset returns the offset in bytes of a (nested) member of the struct or
+// union with the given name. Members in the path are separated by dots and
+// may index into arrays, eg. Offset("nf_conn", "tuplehash[1].tuple.dst.u3").
+// Members of anonymous structs and unions are resolved transparently.
+func (s *Spec) Offset(name, path string) (uint32, error) {
+
+	id, ok := s.composites[name]
+	if !ok {
+		return 0, fmt.Errorf(errFmtNoType, name)
+	}
+
+	var off uint32
+	for _, elem := range strings.Split(path, ".") {
+
+		field, idx, err := splitIndex(elem)
+		if err != nil {
+			return 0, err
+		}
+
+		mo, mt, err := s.findMember(id, field)
+		if err != nil {
+			return 0, fmt.Errorf("%s.%s: %v", name, path, err)
+		}
+		off += mo
+
+		id = s.resolve(mt)
+
+		if idx >= 0 {
+			t := s.types[id]
+			if t.kind != kindArray {
+				return 0, fmt.Errorf(errFmtNotArray, field)
+			}
+			if uint32(idx) >= t.nelems {
+				return 0, fmt.Errorf(errFmtIndexBounds, idx, field)
+			}
+
+			es, err := s.sizeof(t.elemType)
+			if err != nil {
+				return 0, err
+			}
+
+			off += es * uint32(idx)
+			id = s.resolve(t.elemType)
+		}
+	}
+
+	return off, nil
+}
+
+// findMember looks up member field in the struct or union with the given ID,
+// descending into anonymous members. Returns the member's offset in bytes and
+// the ID of its type.
+func (s *Spec) findMember(id uint32, field string) (uint32, uint32, error) {
+
+	id = s.resolve(id)
+	if int(id) >= len(s.types) {
+		return 0, 0, fmt.Errorf(errFmtTypeID, id)
+	}
+
+	t := s.types[id]
+	if t.kind != kindStruct && t.kind != kindUnion {
+		return 0, 0, fmt.Errorf(errFmtNotComposite, t.name, field)
+	}
+
+	for _, m := range t.members {
+		bits := m.offset
+		if t.kindFlag {
+			// Upper 8 bits hold the bitfield size.
+			bits &= 0xffffff
+		}
+
+		if m.name == field {
+			if bits%8 != 0 {
+				return 0, 0, fmt.Errorf(errFmtBitfield, field)
+			}
+			return bits / 8, m.typ, nil
+		}
+
+		// Descend into anonymous structs and unions.
+		if m.name == "" {
+			if off, typ, err := s.findMember(m.typ, field); err == nil {
+				return bits/8 + off, typ, nil
+			}
+		}
+	}
+
+	return 0, 0, fmt.Errorf(errFmtNoMember, field, t.name)
+}
+
+// EnumValue returns the value of the enumerator with the given name.
+// Enumerator names share a single namespace in C, so no enum name is needed.
+func (s *Spec) EnumValue(name string) (int64, error) {
+
+	for _, t := range s.types {
+		for _, e := range t.enums {
+			if e.name == name {
+				return e.value, nil
+			}
+		}
+	}
+
+	return 0, fmt.Errorf(errFmtNoEnum, name)
+}
+
+// splitIndex splits a path element like 'tuplehash[1]' into its name and
+// index. Returns an index of -1 if the element does not index into an array.
+func splitIndex(elem string) (string, int, error) {
+
+	i := strings.IndexByte(elem, '[')
+	if i < 0 {
+		return elem, -1, nil
+	}
+
+	if !strings.HasSuffix(elem, "]") {
+		return "", 0, fmt.Errorf(errFmtPath, elem)
+	}
+
+	idx, err := strconv.Atoi(elem[i+1 : len(elem)-1])
+	if err != nil || idx < 0 {
+		return "", 0, fmt.Errorf(errFmtPath, elem)
+	}
+
+	return elem[:i], idx, nil
+}
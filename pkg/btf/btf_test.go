@@ -0,0 +1,123 @@
+package btf_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ti-mo/conntracct/pkg/btf"
+)
+
+// testBTF builds a BTF blob describing the following types:
+//
+//	struct foo {
+//	  int a;
+//	  struct { int b; };
+//	  int arr[3];
+//	};
+//	enum ids { X = 0, Y = 3 };
+func testBTF(t *testing.T) []byte {
+
+	strs := "\x00int\x00foo\x00a\x00b\x00arr\x00ids\x00X\x00Y\x00"
+	off := func(s string) uint32 {
+		return uint32(strings.Index(strs, "\x00"+s+"\x00") + 1)
+	}
+	info := func(kind, vlen uint32) uint32 {
+		return kind<<24 | vlen
+	}
+
+	types := []uint32{
+		// [1] int
+		off("int"), info(1, 0), 4, 32,
+		// [2] anonymous struct
+		0, info(4, 1), 4,
+		off("b"), 1, 0,
+		// [3] struct foo
+		off("foo"), info(4, 3), 20,
+		off("a"), 1, 0,
+		0, 2, 32,
+		off("arr"), 4, 64,
+		// [4] int[3]
+		0, info(3, 0), 0, 1, 1, 3,
+		// [5] enum ids
+		off("ids"), info(6, 2), 4,
+		off("X"), 0,
+		off("Y"), 3,
+	}
+
+	var tb bytes.Buffer
+	require.NoError(t, binary.Write(&tb, binary.LittleEndian, types))
+
+	hdr := []uint32{0, 24, 0, uint32(tb.Len()), uint32(tb.Len()), uint32(len(strs))}
+
+	var b bytes.Buffer
+	require.NoError(t, binary.Write(&b, binary.LittleEndian, hdr))
+	out := b.Bytes()
+	// magic, version 1, flags 0
+	binary.LittleEndian.PutUint16(out[0:], 0xeB9F)
+	out[2] = 1
+
+	out = append(out, tb.Bytes()...)
+	return append(out, strs...)
+}
+
+func TestParse(t *testing.T) {
+
+	s, err := btf.Parse(testBTF(t), nil)
+	require.NoError(t, err)
+
+	sz, err := s.Sizeof("foo")
+	require.NoError(t, err)
+	assert.EqualValues(t, 20, sz)
+
+	for path, want := range map[string]uint32{
+		"a":      0,
+		"b":      4,
+		"arr":    8,
+		"arr[2]": 16,
+	} {
+		got, err := s.Offset("foo", path)
+		require.NoError(t, err, path)
+		assert.Equal(t, want, got, path)
+	}
+
+	_, err = s.Offset("foo", "arr[3]")
+	assert.Error(t, err)
+	_, err = s.Offset("foo", "c")
+	assert.Error(t, err)
+	_, err = s.Offset("bar", "a")
+	assert.Error(t, err)
+
+	v, err := s.EnumValue("Y")
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, v)
+}
+
+func TestParseInvalid(t *testing.T) {
+
+	_, err := btf.Parse([]byte{0x9f, 0xeb}, nil)
+	assert.Error(t, err)
+
+	b := testBTF(t)
+	b[0] = 0
+	_, err = btf.Parse(b, nil)
+	assert.Error(t, err)
+}
+
+func TestLoadKernelSpec(t *testing.T) {
+
+	if !btf.Available() {
+		t.Skip("kernel does not expose BTF")
+	}
+
+	s, err := btf.LoadKernelSpec()
+	require.NoError(t, err)
+
+	off, err := s.Offset("sk_buff", "len")
+	require.NoError(t, err)
+	assert.NotZero(t, off)
+}
@@ -0,0 +1,23 @@
+package btf
+
+import "errors"
+
+const (
+	errFmtUnknownKind  = "unknown BTF kind %d of type %d"
+	errFmtTypeID       = "type ID %d out of range"
+	errFmtNoSize       = "type '%s' of kind %d has no size"
+	errFmtNoType       = "struct or union '%s' not found"
+	errFmtNoMember     = "member '%s' not found in '%s'"
+	errFmtNotComposite = "type '%s' has no member '%s', not a struct or union"
+	errFmtNotArray     = "member '%s' is not an array"
+	errFmtIndexBounds  = "index %d out of bounds of array '%s'"
+	errFmtBitfield     = "member '%s' is not byte-aligned"
+	errFmtNoEnum       = "enumerator '%s' not found"
+	errFmtPath         = "invalid path element '%s'"
+)
+
+var (
+	errShortHeader   = errors.New("BTF blob shorter than its header")
+	errMagic         = errors.New("invalid BTF magic")
+	errSectionBounds = errors.New("BTF section out of bounds")
+)
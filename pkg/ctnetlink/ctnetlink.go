@@ -0,0 +1,172 @@
+// Package ctnetlink is a minimal client for the Linux kernel's conntrack
+// netlink interface (ctnetlink). It supports dumping the conntrack table
+// and listening for conntrack events.
+package ctnetlink
+
+import (
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Netfilter netlink subsystem of ctnetlink, and its message types.
+const (
+	subsysCTNetlink = 1
+
+	msgCTNew    = 0
+	msgCTGet    = 1
+	msgCTDelete = 2
+)
+
+// Group is a ctnetlink multicast group.
+type Group uint32
+
+// Multicast groups receiving conntrack events (enum nfnetlink_groups).
+const (
+	GroupNew     Group = 1
+	GroupUpdate  Group = 2
+	GroupDestroy Group = 3
+)
+
+// nfgenmsgLen is the length of the netfilter netlink header (struct nfgenmsg)
+// preceding the attributes of every ctnetlink message.
+const nfgenmsgLen = 4
+
+// Conn is a connection to the kernel's conntrack netlink interface.
+type Conn struct {
+	// Amount of messages that could not be decoded and were skipped.
+	// Accessed atomically, kept first for 64-bit alignment.
+	skipped uint64
+
+	conn *netlink.Conn
+}
+
+// Dial opens a connection to ctnetlink in the caller's network namespace.
+func Dial() (*Conn, error) {
+
+	c, err := netlink.Dial(unix.NETLINK_NETFILTER, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "dialing netfilter netlink")
+	}
+
+	return &Conn{conn: c}, nil
+}
+
+// Close closes the connection.
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// Dump returns all flows in the conntrack table of all address families.
+// Flows that cannot be decoded are skipped, see Skipped.
+func (c *Conn) Dump() ([]Flow, error) {
+
+	req := netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType(subsysCTNetlink<<8 | msgCTGet),
+			Flags: netlink.Request | netlink.Dump,
+		},
+		Data: nfgenmsg(unix.AF_UNSPEC),
+	}
+
+	msgs, err := c.conn.Execute(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "dumping conntrack table")
+	}
+
+	out := make([]Flow, 0, len(msgs))
+	for _, m := range msgs {
+		var f Flow
+		if err := f.unmarshal(m.Data); err != nil {
+			atomic.AddUint64(&c.skipped, 1)
+			continue
+		}
+		out = append(out, f)
+	}
+
+	return out, nil
+}
+
+// nfgenmsg returns a netfilter netlink header for the given address family,
+// using netlink protocol version 0 and resource ID 0.
+func nfgenmsg(family uint8) []byte {
+	return []byte{family, 0, 0, 0}
+}
+
+// Subscribe joins the given multicast groups. Events of the groups
+// are read using Receive.
+func (c *Conn) Subscribe(groups ...Group) error {
+
+	for _, g := range groups {
+		if err := c.conn.JoinGroup(uint32(g)); err != nil {
+			return errors.Wrapf(err, "joining ctnetlink group %d", g)
+		}
+	}
+
+	return nil
+}
+
+// SetReadBuffer sets the size in bytes of the connection's socket receive
+// buffer. Events are lost when the buffer overruns, see IsOverrun.
+func (c *Conn) SetReadBuffer(bytes int) error {
+	return c.conn.SetReadBuffer(bytes)
+}
+
+// SetReadDeadline sets the deadline of calls to Receive. A deadline in the
+// past unblocks a pending Receive.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// Receive waits for and returns the next conntrack events of the subscribed
+// multicast groups. Messages that are not conntrack events are skipped, as
+// are events that cannot be decoded, see Skipped.
+func (c *Conn) Receive() ([]Event, error) {
+
+	msgs, err := c.conn.Receive()
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]Event, 0, len(msgs))
+	for _, m := range msgs {
+		var e Event
+		ok, err := e.unmarshal(m)
+		if err != nil {
+			atomic.AddUint64(&c.skipped, 1)
+			continue
+		}
+		if ok {
+			out = append(out, e)
+		}
+	}
+
+	return out, nil
+}
+
+// Skipped returns the amount of flows and events that could not be decoded
+// and were skipped by Dump and Receive.
+func (c *Conn) Skipped() uint64 {
+	return atomic.LoadUint64(&c.skipped)
+}
+
+// IsOverrun returns true if err is returned by Receive because the socket's
+// receive buffer overran and events were lost.
+func IsOverrun(err error) bool {
+
+	oe, ok := err.(*netlink.OpError)
+	if !ok {
+		return false
+	}
+
+	err = oe.Err
+	if se, ok := err.(*os.SyscallError); ok {
+		err = se.Err
+	}
+
+	return err == unix.ENOBUFS
+}
@@ -0,0 +1,64 @@
+package ctnetlink
+
+import (
+	"github.com/mdlayher/netlink"
+)
+
+// EventType is the kind of change to the conntrack table an Event reports.
+type EventType uint8
+
+// Types of conntrack events.
+const (
+	EventNew EventType = iota + 1
+	EventUpdate
+	EventDestroy
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventNew:
+		return "new"
+	case EventUpdate:
+		return "update"
+	case EventDestroy:
+		return "destroy"
+	}
+	return "unknown"
+}
+
+// Event is a change to a Flow in the conntrack table, received from one of
+// the ctnetlink multicast groups. Only destroy events carry the Flow's
+// counters and stop timestamp.
+type Event struct {
+	Type EventType
+	Flow Flow
+}
+
+// unmarshal decodes a ctnetlink message into the Event. Returns false if
+// the message is not a conntrack event.
+func (e *Event) unmarshal(m netlink.Message) (bool, error) {
+
+	if m.Header.Type>>8 != subsysCTNetlink {
+		return false, nil
+	}
+
+	switch m.Header.Type & 0xff {
+	case msgCTNew:
+		// The kernel sets the create and exclusive flags on
+		// events of flows inserted into the table.
+		e.Type = EventUpdate
+		if m.Header.Flags&(netlink.Create|netlink.Excl) != 0 {
+			e.Type = EventNew
+		}
+	case msgCTDelete:
+		e.Type = EventDestroy
+	default:
+		return false, nil
+	}
+
+	if err := e.Flow.unmarshal(m.Data); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,53 @@
+package ctnetlink
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/mdlayher/netlink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestEventUnmarshal(t *testing.T) {
+
+	ae := netlink.NewAttributeEncoder()
+	ae.ByteOrder = binary.BigEndian
+	ae.Uint32(ctaID, 1234)
+	attrs, err := ae.Encode()
+	require.NoError(t, err)
+
+	msg := func(typ uint16, flags netlink.HeaderFlags) netlink.Message {
+		return netlink.Message{
+			Header: netlink.Header{Type: netlink.HeaderType(typ), Flags: flags},
+			Data:   append(nfgenmsg(unix.AF_INET), attrs...),
+		}
+	}
+
+	tests := []struct {
+		name string
+		msg  netlink.Message
+		typ  EventType
+		ok   bool
+	}{
+		{name: "new", msg: msg(subsysCTNetlink<<8|msgCTNew, netlink.Create|netlink.Excl), typ: EventNew, ok: true},
+		{name: "update", msg: msg(subsysCTNetlink<<8|msgCTNew, 0), typ: EventUpdate, ok: true},
+		{name: "destroy", msg: msg(subsysCTNetlink<<8|msgCTDelete, 0), typ: EventDestroy, ok: true},
+		{name: "get", msg: msg(subsysCTNetlink<<8|msgCTGet, 0)},
+		{name: "expectation", msg: msg(2<<8|msgCTNew, 0)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var e Event
+			ok, err := e.unmarshal(tt.msg)
+			require.NoError(t, err)
+			assert.Equal(t, tt.ok, ok)
+			if ok {
+				assert.Equal(t, tt.typ, e.Type)
+				assert.EqualValues(t, 1234, e.Flow.ID)
+			}
+		})
+	}
+}
@@ -0,0 +1,249 @@
+package ctnetlink
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/mdlayher/netlink"
+)
+
+// Attribute types of ctnetlink messages (enum ctattr_type).
+const (
+	ctaTupleOrig     = 1
+	ctaTupleReply    = 2
+	ctaStatus        = 3
+	ctaProtoInfo     = 4
+	ctaMark          = 8
+	ctaCountersOrig  = 9
+	ctaCountersReply = 10
+	ctaID            = 12
+	ctaZone          = 18
+	ctaTimestamp     = 20
+)
+
+// Attribute types nested in tuples and their members.
+const (
+	ctaTupleIP    = 1
+	ctaTupleProto = 2
+
+	ctaIPv4Src = 1
+	ctaIPv4Dst = 2
+	ctaIPv6Src = 3
+	ctaIPv6Dst = 4
+
+	ctaProtoNum        = 1
+	ctaProtoSrcPort    = 2
+	ctaProtoDstPort    = 3
+	ctaProtoICMPID     = 4
+	ctaProtoICMPType   = 5
+	ctaProtoICMPCode   = 6
+	ctaProtoICMPv6ID   = 7
+	ctaProtoICMPv6Type = 8
+	ctaProtoICMPv6Code = 9
+)
+
+// Attribute types nested in protocol info, counters and timestamps.
+const (
+	ctaProtoInfoTCP      = 1
+	ctaProtoInfoTCPState = 1
+
+	ctaCountersPackets   = 1
+	ctaCountersBytes     = 2
+	ctaCounters32Packets = 3
+	ctaCounters32Bytes   = 4
+
+	ctaTimestampStart = 1
+	ctaTimestampStop  = 2
+)
+
+// Tuple is the layer 3 and 4 identity of one direction of a Flow.
+type Tuple struct {
+	SrcAddr net.IP
+	DstAddr net.IP
+	Proto   uint8
+
+	// Ports of protocols that have them.
+	SrcPort uint16
+	DstPort uint16
+
+	// Echo identifier, type and code of ICMP and ICMPv6 flows.
+	ICMPID   uint16
+	ICMPType uint8
+	ICMPCode uint8
+}
+
+// Counters holds the amount of packets and bytes
+// sent in one direction of a Flow.
+type Counters struct {
+	Packets uint64
+	Bytes   uint64
+}
+
+// Flow is an entry in the conntrack table.
+type Flow struct {
+	// Address family of the flow, AF_INET or AF_INET6.
+	Family uint8
+
+	// Original and reply directions of the flow.
+	Orig  Tuple
+	Reply Tuple
+
+	// Opaque identifier of the flow, unique while the flow exists.
+	ID uint32
+
+	// Status bits, connection mark and zone of the flow.
+	Status uint32
+	Mark   uint32
+	Zone   uint16
+
+	// Conntrack state of TCP flows, zero for other protocols.
+	TCPState uint8
+
+	// Counters of both directions, only set if the
+	// net.netfilter.nf_conntrack_acct sysctl is enabled.
+	CountersOrig  Counters
+	CountersReply Counters
+
+	// Start and stop timestamps of the flow in nanoseconds since the
+	// epoch, only set if net.netfilter.nf_conntrack_timestamp is enabled.
+	Start uint64
+	Stop  uint64
+}
+
+// unmarshal decodes a ctnetlink message into the Flow.
+func (f *Flow) unmarshal(b []byte) error {
+
+	if len(b) < nfgenmsgLen {
+		return fmt.Errorf("ctnetlink message too short: %d bytes", len(b))
+	}
+	f.Family = b[0]
+
+	ad, err := netlink.NewAttributeDecoder(b[nfgenmsgLen:])
+	if err != nil {
+		return err
+	}
+	ad.ByteOrder = binary.BigEndian
+
+	for ad.Next() {
+		switch ad.Type() {
+		case ctaTupleOrig:
+			ad.Nested(f.Orig.unmarshal)
+		case ctaTupleReply:
+			ad.Nested(f.Reply.unmarshal)
+		case ctaStatus:
+			f.Status = ad.Uint32()
+		case ctaProtoInfo:
+			ad.Nested(f.unmarshalProtoInfo)
+		case ctaMark:
+			f.Mark = ad.Uint32()
+		case ctaCountersOrig:
+			ad.Nested(f.CountersOrig.unmarshal)
+		case ctaCountersReply:
+			ad.Nested(f.CountersReply.unmarshal)
+		case ctaID:
+			f.ID = ad.Uint32()
+		case ctaZone:
+			f.Zone = ad.Uint16()
+		case ctaTimestamp:
+			ad.Nested(f.unmarshalTimestamp)
+		}
+	}
+
+	return ad.Err()
+}
+
+// unmarshalProtoInfo decodes the TCP state from a CTA_PROTOINFO attribute.
+func (f *Flow) unmarshalProtoInfo(ad *netlink.AttributeDecoder) error {
+	for ad.Next() {
+		if ad.Type() != ctaProtoInfoTCP {
+			continue
+		}
+		ad.Nested(func(ad *netlink.AttributeDecoder) error {
+			for ad.Next() {
+				if ad.Type() == ctaProtoInfoTCPState {
+					f.TCPState = ad.Uint8()
+				}
+			}
+			return nil
+		})
+	}
+	return nil
+}
+
+// unmarshalTimestamp decodes a CTA_TIMESTAMP attribute.
+func (f *Flow) unmarshalTimestamp(ad *netlink.AttributeDecoder) error {
+	for ad.Next() {
+		switch ad.Type() {
+		case ctaTimestampStart:
+			f.Start = ad.Uint64()
+		case ctaTimestampStop:
+			f.Stop = ad.Uint64()
+		}
+	}
+	return nil
+}
+
+// unmarshal decodes a CTA_TUPLE_* attribute into the Tuple.
+func (t *Tuple) unmarshal(ad *netlink.AttributeDecoder) error {
+	for ad.Next() {
+		switch ad.Type() {
+		case ctaTupleIP:
+			ad.Nested(t.unmarshalIP)
+		case ctaTupleProto:
+			ad.Nested(t.unmarshalProto)
+		}
+	}
+	return nil
+}
+
+// unmarshalIP decodes a CTA_TUPLE_IP attribute.
+func (t *Tuple) unmarshalIP(ad *netlink.AttributeDecoder) error {
+	for ad.Next() {
+		switch ad.Type() {
+		case ctaIPv4Src, ctaIPv6Src:
+			t.SrcAddr = net.IP(ad.Bytes())
+		case ctaIPv4Dst, ctaIPv6Dst:
+			t.DstAddr = net.IP(ad.Bytes())
+		}
+	}
+	return nil
+}
+
+// unmarshalProto decodes a CTA_TUPLE_PROTO attribute.
+func (t *Tuple) unmarshalProto(ad *netlink.AttributeDecoder) error {
+	for ad.Next() {
+		switch ad.Type() {
+		case ctaProtoNum:
+			t.Proto = ad.Uint8()
+		case ctaProtoSrcPort:
+			t.SrcPort = ad.Uint16()
+		case ctaProtoDstPort:
+			t.DstPort = ad.Uint16()
+		case ctaProtoICMPID, ctaProtoICMPv6ID:
+			t.ICMPID = ad.Uint16()
+		case ctaProtoICMPType, ctaProtoICMPv6Type:
+			t.ICMPType = ad.Uint8()
+		case ctaProtoICMPCode, ctaProtoICMPv6Code:
+			t.ICMPCode = ad.Uint8()
+		}
+	}
+	return nil
+}
+
+// unmarshal decodes a CTA_COUNTERS_* attribute.
+func (c *Counters) unmarshal(ad *netlink.AttributeDecoder) error {
+	for ad.Next() {
+		switch ad.Type() {
+		case ctaCountersPackets:
+			c.Packets = ad.Uint64()
+		case ctaCountersBytes:
+			c.Bytes = ad.Uint64()
+		case ctaCounters32Packets:
+			c.Packets = uint64(ad.Uint32())
+		case ctaCounters32Bytes:
+			c.Bytes = uint64(ad.Uint32())
+		}
+	}
+	return nil
+}
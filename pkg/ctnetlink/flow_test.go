@@ -0,0 +1,97 @@
+package ctnetlink
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/mdlayher/netlink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestFlowUnmarshal(t *testing.T) {
+
+	ae := netlink.NewAttributeEncoder()
+	ae.ByteOrder = binary.BigEndian
+
+	tuple := func(src, dst string, sport, dport uint16) func(*netlink.AttributeEncoder) error {
+		return func(ae *netlink.AttributeEncoder) error {
+			ae.Nested(ctaTupleIP, func(ae *netlink.AttributeEncoder) error {
+				ae.Bytes(ctaIPv4Src, net.ParseIP(src).To4())
+				ae.Bytes(ctaIPv4Dst, net.ParseIP(dst).To4())
+				return nil
+			})
+			ae.Nested(ctaTupleProto, func(ae *netlink.AttributeEncoder) error {
+				ae.Uint8(ctaProtoNum, unix.IPPROTO_TCP)
+				ae.Uint16(ctaProtoSrcPort, sport)
+				ae.Uint16(ctaProtoDstPort, dport)
+				return nil
+			})
+			return nil
+		}
+	}
+
+	ae.Nested(ctaTupleOrig|unix.NLA_F_NESTED, tuple("10.0.0.1", "10.0.0.2", 40000, 443))
+	ae.Nested(ctaTupleReply|unix.NLA_F_NESTED, tuple("10.0.0.2", "192.0.2.1", 443, 40000))
+	ae.Uint32(ctaStatus, 0x1ce)
+	ae.Nested(ctaProtoInfo, func(ae *netlink.AttributeEncoder) error {
+		ae.Nested(ctaProtoInfoTCP, func(ae *netlink.AttributeEncoder) error {
+			ae.Uint8(ctaProtoInfoTCPState, 3)
+			return nil
+		})
+		return nil
+	})
+	ae.Uint32(ctaMark, 0xff)
+	ae.Nested(ctaCountersOrig, func(ae *netlink.AttributeEncoder) error {
+		ae.Uint64(ctaCountersPackets, 10)
+		ae.Uint64(ctaCountersBytes, 1000)
+		return nil
+	})
+	ae.Nested(ctaCountersReply, func(ae *netlink.AttributeEncoder) error {
+		ae.Uint64(ctaCountersPackets, 20)
+		ae.Uint64(ctaCountersBytes, 2000)
+		return nil
+	})
+	ae.Uint32(ctaID, 1234)
+	ae.Uint16(ctaZone, 5)
+	ae.Nested(ctaTimestamp, func(ae *netlink.AttributeEncoder) error {
+		ae.Uint64(ctaTimestampStart, 1585000000000000000)
+		return nil
+	})
+
+	b, err := ae.Encode()
+	require.NoError(t, err)
+
+	var f Flow
+	require.NoError(t, f.unmarshal(append(nfgenmsg(unix.AF_INET), b...)))
+
+	assert.Equal(t, Flow{
+		Family: unix.AF_INET,
+		Orig: Tuple{
+			SrcAddr: net.ParseIP("10.0.0.1").To4(),
+			DstAddr: net.ParseIP("10.0.0.2").To4(),
+			Proto:   unix.IPPROTO_TCP,
+			SrcPort: 40000,
+			DstPort: 443,
+		},
+		Reply: Tuple{
+			SrcAddr: net.ParseIP("10.0.0.2").To4(),
+			DstAddr: net.ParseIP("192.0.2.1").To4(),
+			Proto:   unix.IPPROTO_TCP,
+			SrcPort: 443,
+			DstPort: 40000,
+		},
+		ID:            1234,
+		Status:        0x1ce,
+		Mark:          0xff,
+		Zone:          5,
+		TCPState:      3,
+		CountersOrig:  Counters{Packets: 10, Bytes: 1000},
+		CountersReply: Counters{Packets: 20, Bytes: 2000},
+		Start:         1585000000000000000,
+	}, f)
+
+	assert.Error(t, f.unmarshal([]byte{unix.AF_INET}))
+}
@@ -58,6 +58,17 @@ var Builds = map[string]Kernel{
 	},
 }
 
+// BTF is the Kernel the BTF-enabled probe is built against. The kernel headers
+// only provide type definitions to the probe, offsets of struct members and
+// values of enums are read from the running kernel's BTF when loading the probe.
+var BTF = Kernel{
+	Version: "btf",
+	URL:     "https://cdn.kernel.org/pub/linux/kernel/v5.x/linux-5.5.10.tar.xz",
+	Params:  params["MarkNFTNat"],
+	Probes:  kprobes["acct_v1"],
+	BTF:     true,
+}
+
 var params = map[string]Params{
 	"MarkNFTNat": {
 		"CONFIG_NETFILTER":          "y",
@@ -66,6 +77,10 @@ var params = map[string]Params{
 		"CONFIG_NF_CONNTRACK":      "m",
 		"CONFIG_NF_CONNTRACK_MARK": "y",
 
+		// Adds the zone field to struct nf_conn, read by the probe. Enabled
+		// by most distributions, doesn't change the offsets of other fields.
+		"CONFIG_NF_CONNTRACK_ZONES": "y",
+
 		// Changes alignment of the ct extensions enum for timestamp.
 		"CONFIG_NF_NAT":                 "m",
 		"CONFIG_NF_CONNTRACK_EVENTS":    "y",
@@ -50,6 +50,20 @@ type Kernel struct {
 	URL     string
 	Params  Params
 	Probes  Probes
+
+	// BTF is set on Kernels whose probe resolves the layout of kernel
+	// structures at load time using the running kernel's BTF.
+	BTF bool
+}
+
+// Mode returns the way the Kernel's probe obtains the layout of kernel
+// structures: 'btf' if resolved from the running kernel at load time,
+// 'prebuilt' if fixed when the probe was built against the kernel's headers.
+func (k Kernel) Mode() string {
+	if k.BTF {
+		return "btf"
+	}
+	return "prebuilt"
 }
 
 // ArchiveName returns the file name of the archive based on its URL.